@@ -1,10 +1,46 @@
 package api
 
+import "encoding/json"
+
 // Request represents the content of the request that ptemplate-form-handler will accept.
 // It must be in JSON.
+//
+// Site is the ID of the site the form belongs to. It's only needed when the site cannot be determined
+// by the request path or by its Host header.
+//
+// Recaptcha is the captcha response of the sites that use reCAPTCHA with the default field name.
+// The captcha responses of other providers or field names (like "h-captcha-response") are sent as another member.
+//
+// Fields contains the rest of the members of the JSON object, which are the fields of the form.
+// Which fields are accepted is declared in the config of each site, being "name", "mail" and "msg" by default.
 type Request struct {
-	Name      string `json:"name"`
-	Mail      string `json:"mail"`
-	Msg       string `json:"msg"`
-	Recaptcha string `json:"g-recaptcha-response"`
+	Site      string                 `json:"site"`
+	Recaptcha string                 `json:"g-recaptcha-response"`
+	Fields    map[string]interface{} `json:"-"`
+}
+
+// Names of the members of the request that are not fields of the form.
+const (
+	FieldSite      = "site"
+	FieldRecaptcha = "g-recaptcha-response"
+)
+
+// UnmarshalJSON parses the JSON object provided into the request.
+func (r *Request) UnmarshalJSON(data []byte) error {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	type request Request
+	var r2 request
+	if err := json.Unmarshal(data, &r2); err != nil {
+		return err
+	}
+
+	delete(fields, FieldSite)
+	delete(fields, FieldRecaptcha)
+	r2.Fields = fields
+	*r = Request(r2)
+	return nil
 }
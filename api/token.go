@@ -0,0 +1,9 @@
+package api
+
+// Token represents the content of the responses of the token endpoint of ptemplate-form-handler,
+// GET /token (or /sites/<id>/token). It's a JSON with the token of the traps of the site in "token",
+// which must be sent with the form in the field named "field".
+type Token struct {
+	Field string `json:"field"`
+	Token string `json:"token"`
+}
@@ -0,0 +1,27 @@
+//go:build dev
+// +build dev
+
+package main
+
+import (
+	"flag"
+	"github.com/nethruster/ptemplate-form-handler/pkg/captcha/captchatest"
+	"github.com/nethruster/ptemplate-form-handler/pkg/server"
+)
+
+// dev is the --dev flag, only available in the builds with the "dev" tag so the fake captcha server is not part
+// of the release builds. It's a package variable so it's declared before init parses the flags.
+var dev = flag.Bool("dev", false, "Development mode: verify captchas with a fake server")
+
+func init() {
+	startDev = func() func() {
+		if !*dev {
+			return func() {}
+		}
+
+		fake := captchatest.NewServer()
+		server.CaptchaURL = fake.URL
+		log.Infof("Development mode: captchas are verified by a fake server (use \"%s\" to pass)", captchatest.ResponsePass)
+		return fake.Close
+	}
+}
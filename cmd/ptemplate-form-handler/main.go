@@ -14,6 +14,10 @@ var (
 	configPath string
 	port       int
 	log *logolang.Logger
+
+	// startDev starts the development mode if it's enabled, and returns the function that stops it.
+	// It's only set in the builds with the "dev" tag.
+	startDev func() (stop func())
 )
 
 func init() {
@@ -25,6 +29,11 @@ func init() {
 	flag.IntVar(&port, "port", 8080, "Port to listen")
 	flag.BoolVar(&verbose, "verbose", false, "Verbose output")
 	flag.BoolVar(&version, "version", false, "Print version and exit")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [queue <command> [arguments]]\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\n%s", queueUsage)
+	}
 	flag.Parse()
 
 	if version {
@@ -43,6 +52,17 @@ func init() {
 }
 
 func main() {
+	if flag.NArg() != 0 {
+		if flag.Arg(0) != "queue" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(runQueueCommand(flag.Args()[1:]))
+	}
+
 	server.Log = log
+	if startDev != nil {
+		defer startDev()()
+	}
 	server.Run(configPath, strconv.Itoa(port))
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg/config"
+	"github.com/nethruster/ptemplate-form-handler/pkg/queue"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+const queueUsage = `Usage: ptemplate-form-handler [flags] queue <command> [arguments]
+
+Commands:
+  list                         List the pending and dead forms
+  show <id>                    Print the form with the ID provided
+  replay <id>|--all            Retry the delivery of the form with the ID provided, or of all the dead forms
+  purge --older-than <age>     Delete the dead forms older than the age provided (e.g. 720h)
+
+Replayed forms are delivered by the running server.
+`
+
+// runQueueCommand runs the "queue" subcommand with the arguments provided, and returns the exit code.
+func runQueueCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, queueUsage)
+		return 2
+	}
+
+	conf, err := config.LoadConfig(configPath)
+	if err != nil {
+		log.Criticalf("error loading config file from path \"%s\": %s", configPath, err)
+		return 1
+	}
+	if conf.Queue == nil {
+		log.Critical("queue not enabled in config file")
+		return 1
+	}
+	q := conf.Queue
+
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "list":
+		err = queueList(os.Stdout, q)
+	case "show":
+		if len(args) != 1 {
+			fmt.Fprint(os.Stderr, queueUsage)
+			return 2
+		}
+		err = queueShow(os.Stdout, q, args[0])
+	case "replay":
+		fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+		all := fs.Bool("all", false, "Replay all the dead forms")
+		if err = fs.Parse(args); err != nil || *all == (fs.NArg() == 1) || fs.NArg() > 1 {
+			fmt.Fprint(os.Stderr, queueUsage)
+			return 2
+		}
+		err = queueReplay(os.Stdout, q, fs.Arg(0), *all)
+	case "purge":
+		fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+		olderThan := fs.Duration("older-than", 0, "Minimum age of the dead forms to delete")
+		if err = fs.Parse(args); err != nil || *olderThan <= 0 || fs.NArg() != 0 {
+			fmt.Fprint(os.Stderr, queueUsage)
+			return 2
+		}
+		err = queuePurge(os.Stdout, q, *olderThan)
+	default:
+		fmt.Fprint(os.Stderr, queueUsage)
+		return 2
+	}
+
+	if err != nil {
+		log.Criticalf("%s", err)
+		return 1
+	}
+	return 0
+}
+
+// queueList writes to w a table with the pending and dead items of the queue provided.
+func queueList(w io.Writer, q *queue.Queue) error {
+	pending, err := q.Pending()
+	if err != nil {
+		return err
+	}
+	dead, err := q.Dead()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATE\tSITE\tCREATED\tATTEMPTS\tLAST ERROR")
+	for _, items := range []struct {
+		state string
+		list  []*queue.Item
+	}{{"pending", pending}, {"dead", dead}} {
+		for _, it := range items.list {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n",
+				it.ID, items.state, it.Site, it.Created.Local().Format(time.RFC3339), it.Attempts, it.LastError)
+		}
+	}
+	return tw.Flush()
+}
+
+// queueShow writes to w the item of the queue provided with the ID provided.
+func queueShow(w io.Writer, q *queue.Queue, id string) error {
+	it, dead, err := q.Get(id)
+	if err != nil {
+		return fmt.Errorf("error getting form %s: %w", id, err)
+	}
+
+	data, err := json.MarshalIndent(struct {
+		*queue.Item
+		Dead bool `json:"dead"`
+	}{it, dead}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding form %s: %w", id, err)
+	}
+
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// queueReplay makes the item of the queue provided with the ID provided, or all the dead items if all is true,
+// due for delivery immediately.
+func queueReplay(w io.Writer, q *queue.Queue, id string, all bool) error {
+	ids := []string{id}
+	if all {
+		dead, err := q.Dead()
+		if err != nil {
+			return err
+		}
+		ids = make([]string, 0, len(dead))
+		for _, it := range dead {
+			ids = append(ids, it.ID)
+		}
+	}
+
+	for _, id := range ids {
+		if err := q.Replay(id); err != nil {
+			return fmt.Errorf("error replaying form %s: %w", id, err)
+		}
+		fmt.Fprintf(w, "Form %s queued for delivery\n", id)
+	}
+	return nil
+}
+
+// queuePurge deletes the dead items of the queue provided older than the age provided.
+func queuePurge(w io.Writer, q *queue.Queue, olderThan time.Duration) error {
+	n, err := q.Purge(time.Now().Add(-olderThan))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%d form(s) deleted\n", n)
+	return err
+}
@@ -4,6 +4,8 @@ go 1.13
 
 require (
 	github.com/Miguel-Dorta/logolang v0.5.1
+	github.com/ProtonMail/go-crypto v1.0.0
 	github.com/pelletier/go-toml v1.6.0
-	golang.org/x/sys v0.0.0-20191119060738-e882bf8e40c2
+	go.mozilla.org/pkcs7 v0.9.0
+	golang.org/x/sys v0.6.0
 )
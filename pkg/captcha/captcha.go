@@ -0,0 +1,298 @@
+package captcha
+
+// Package captcha verifies the responses of the captchas solved by the submitters of the forms,
+// with the siteverify API of the captcha provider.
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg"
+	"github.com/nethruster/ptemplate-form-handler/pkg/client"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Captcha providers supported.
+const (
+	ProviderRecaptchaV2 = "recaptcha_v2"
+	ProviderRecaptchaV3 = "recaptcha_v3"
+	ProviderHCaptcha    = "hcaptcha"
+	ProviderTurnstile   = "turnstile"
+	ProviderNone        = "none"
+)
+
+// URLs of the siteverify APIs of the providers.
+const (
+	recaptchaVerifyURL = "https://www.google.com/recaptcha/api/siteverify"
+	hCaptchaVerifyURL  = "https://api.hcaptcha.com/siteverify"
+	turnstileVerifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+)
+
+// Error codes of the failed verifications. The ones of the siteverify APIs are shared by all the providers,
+// and the rest are set by the verifiers.
+const (
+	CodeMissingInputSecret   = "missing-input-secret"
+	CodeInvalidInputSecret   = "invalid-input-secret"
+	CodeMissingInputResponse = "missing-input-response"
+	CodeInvalidInputResponse = "invalid-input-response"
+	CodeBadRequest           = "bad-request"
+	CodeTimeoutOrDuplicate   = "timeout-or-duplicate"
+
+	CodeLowScore         = "low-score"
+	CodeActionMismatch   = "action-mismatch"
+	CodeHostnameMismatch = "hostname-mismatch"
+	CodeExpired          = "expired"
+)
+
+// ErrEmptyResponse is returned when the client didn't send a captcha response.
+var ErrEmptyResponse = &VerificationError{Codes: []string{CodeMissingInputResponse}, Reason: "empty captcha response"}
+
+// Verifier represents a type that verifies the captcha responses sent by the clients.
+type Verifier interface {
+	// Verify checks if the captcha response provided, sent by the client with the IP address remoteIP,
+	// passes the verification. remoteIP is optional. A *VerificationError is returned if the response
+	// doesn't pass it, and any other error if the verification couldn't be done.
+	Verify(response, remoteIP string) error
+}
+
+// VerificationError represents a captcha response that didn't pass the verification.
+// Codes are the error codes returned by the siteverify API or set by the verifier, and Reason
+// describes why the response was rejected when the codes are not enough.
+type VerificationError struct {
+	Codes  []string
+	Reason string
+}
+
+// Endpoint represents the siteverify API used by a Verifier. URL defaults to the API of the provider,
+// and Client to the HTTP client of the client package.
+type Endpoint struct {
+	URL    string
+	Client *http.Client
+}
+
+// Recaptcha represents a Verifier of Google's reCAPTCHA v2 responses.
+type Recaptcha struct {
+	Secret   string
+	Endpoint Endpoint
+}
+
+// RecaptchaV3 represents a Verifier of Google's reCAPTCHA v3 responses.
+//
+// Besides being valid, the responses must have a score of at least MinScore, one of the Actions
+// and one of the Hostnames (if they are not empty), and be issued less than MaxAge ago (if it's not zero).
+type RecaptchaV3 struct {
+	Secret    string
+	MinScore  float64
+	Actions   []string
+	Hostnames []string
+	MaxAge    time.Duration
+	Endpoint  Endpoint
+}
+
+// HCaptcha represents a Verifier of hCaptcha responses.
+type HCaptcha struct {
+	Secret   string
+	Endpoint Endpoint
+}
+
+// Turnstile represents a Verifier of Cloudflare Turnstile responses.
+type Turnstile struct {
+	Secret   string
+	Endpoint Endpoint
+}
+
+// None represents a Verifier that accepts any response, for internal forms that don't need a captcha.
+type None struct{}
+
+// response represents the response of a siteverify API, telling if the captcha response sent passes the verification.
+// Score and Action are only returned by reCAPTCHA v3.
+type response struct {
+	Success     bool     `json:"success"`
+	Errors      []string `json:"error-codes"`
+	ChallengeTS string   `json:"challenge_ts"`
+	Hostname    string   `json:"hostname"`
+	Score       *float64 `json:"score"`
+	Action      string   `json:"action"`
+}
+
+// Error returns the reason of the failed verification, or its error codes if there is no reason.
+func (e *VerificationError) Error() string {
+	switch {
+	case e.Reason != "":
+		return "captcha verification failed: " + e.Reason
+	case len(e.Codes) != 0:
+		return fmt.Sprintf("captcha verification failed: \"%s\"", strings.Join(e.Codes, "\", \""))
+	}
+	return "captcha verification failed"
+}
+
+// Misconfigured checks if the verification failed because of the secret of the verifier
+// instead of the response of the client.
+func (e *VerificationError) Misconfigured() bool {
+	return contains(e.Codes, CodeMissingInputSecret) || contains(e.Codes, CodeInvalidInputSecret)
+}
+
+// DefaultField returns the name of the field of the requests with the captcha response of the provider provided,
+// which is the one that the widget of the provider adds to the forms. It returns an empty string for unknown providers.
+func DefaultField(provider string) string {
+	switch provider {
+	case ProviderRecaptchaV2, ProviderRecaptchaV3:
+		return "g-recaptcha-response"
+	case ProviderHCaptcha:
+		return "h-captcha-response"
+	case ProviderTurnstile:
+		return "cf-turnstile-response"
+	}
+	return ""
+}
+
+// WithEndpoint returns a copy of the Verifier provided that uses the siteverify API provided.
+// Verifiers that don't use a siteverify API, like None, are returned as they are.
+func WithEndpoint(v Verifier, e Endpoint) Verifier {
+	switch v := v.(type) {
+	case *Recaptcha:
+		r := *v
+		r.Endpoint = e
+		return &r
+	case *RecaptchaV3:
+		r := *v
+		r.Endpoint = e
+		return &r
+	case *HCaptcha:
+		h := *v
+		h.Endpoint = e
+		return &h
+	case *Turnstile:
+		t := *v
+		t.Endpoint = e
+		return &t
+	}
+	return v
+}
+
+// Verify checks if the reCAPTCHA v2 response provided passes the verification.
+func (r *Recaptcha) Verify(response, remoteIP string) error {
+	_, err := r.Endpoint.verify(recaptchaVerifyURL, r.Secret, response, remoteIP)
+	return err
+}
+
+// Verify checks if the reCAPTCHA v3 response provided passes the verification,
+// and if its score, action, hostname and age are the expected ones.
+func (r *RecaptchaV3) Verify(response, remoteIP string) error {
+	return r.verify(response, remoteIP, time.Now())
+}
+
+// verify is Verify at the time provided.
+func (r *RecaptchaV3) verify(userResponse, remoteIP string, now time.Time) error {
+	resp, err := r.Endpoint.verify(recaptchaVerifyURL, r.Secret, userResponse, remoteIP)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case r.MinScore <= 0:
+	case resp.Score == nil:
+		return &VerificationError{Codes: []string{CodeLowScore}, Reason: "response without score"}
+	case *resp.Score < r.MinScore:
+		return &VerificationError{
+			Codes:  []string{CodeLowScore},
+			Reason: fmt.Sprintf("score %.2f lower than %.2f", *resp.Score, r.MinScore),
+		}
+	}
+	if len(r.Actions) != 0 && !contains(r.Actions, resp.Action) {
+		return &VerificationError{
+			Codes:  []string{CodeActionMismatch},
+			Reason: fmt.Sprintf("unexpected action \"%s\"", resp.Action),
+		}
+	}
+	if len(r.Hostnames) != 0 && !contains(r.Hostnames, strings.ToLower(resp.Hostname)) {
+		return &VerificationError{
+			Codes:  []string{CodeHostnameMismatch},
+			Reason: fmt.Sprintf("unexpected hostname \"%s\"", resp.Hostname),
+		}
+	}
+	if r.MaxAge > 0 {
+		issued, err := time.Parse(time.RFC3339, resp.ChallengeTS)
+		if err != nil {
+			return &VerificationError{
+				Codes:  []string{CodeExpired},
+				Reason: fmt.Sprintf("invalid challenge_ts \"%s\"", resp.ChallengeTS),
+			}
+		}
+		if age := now.Sub(issued); age > r.MaxAge {
+			return &VerificationError{
+				Codes:  []string{CodeExpired},
+				Reason: fmt.Sprintf("response issued %s ago, more than %s", age.Round(time.Second), r.MaxAge),
+			}
+		}
+	}
+	return nil
+}
+
+// Verify checks if the hCaptcha response provided passes the verification.
+func (h *HCaptcha) Verify(response, remoteIP string) error {
+	_, err := h.Endpoint.verify(hCaptchaVerifyURL, h.Secret, response, remoteIP)
+	return err
+}
+
+// Verify checks if the Turnstile response provided passes the verification.
+func (t *Turnstile) Verify(response, remoteIP string) error {
+	_, err := t.Endpoint.verify(turnstileVerifyURL, t.Secret, response, remoteIP)
+	return err
+}
+
+// Verify accepts any response.
+func (None) Verify(string, string) error {
+	return nil
+}
+
+// verify checks if the captcha response provided passes the verification of the siteverify API of the endpoint,
+// with the secret provided, and returns the response of the API. defaultURL is used if the endpoint has no URL.
+// The parameters are sent form-urlencoded, including remoteIP if it's not empty.
+func (e *Endpoint) verify(defaultURL, secret, userResponse, remoteIP string) (*response, error) {
+	if userResponse == "" {
+		return nil, ErrEmptyResponse
+	}
+
+	verifyURL := e.URL
+	if verifyURL == "" {
+		verifyURL = defaultURL
+	}
+	params := url.Values{"secret": {secret}, "response": {userResponse}}
+	if remoteIP != "" {
+		params.Set("remoteip", remoteIP)
+	}
+	data := params.Encode()
+	var rawResp []byte
+	var err error
+	if e.Client != nil {
+		rawResp, err = client.PostWith(e.Client, verifyURL, pkg.MimeFormURLEncoded, nil, []byte(data))
+	} else {
+		rawResp, err = client.Post(verifyURL, pkg.MimeFormURLEncoded, nil, []byte(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error doing request for captcha verification: %w", err)
+	}
+
+	var resp response
+	if err = json.Unmarshal(rawResp, &resp); err != nil {
+		return nil, fmt.Errorf("error parsing captcha server response: %w", err)
+	}
+
+	if !resp.Success {
+		return nil, &VerificationError{Codes: resp.Errors}
+	}
+	return &resp, nil
+}
+
+// contains checks if the list provided contains the string provided.
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package captcha
+
+import (
+	"errors"
+	"github.com/nethruster/ptemplate-form-handler/pkg"
+	"github.com/nethruster/ptemplate-form-handler/pkg/captcha/captchatest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost || r.Header.Get(pkg.MimeContentType) != pkg.MimeFormURLEncoded {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set(pkg.MimeContentType, pkg.MimeJSON)
+		switch {
+		case r.PostFormValue("remoteip") != "" && r.PostFormValue("remoteip") != "203.0.113.7":
+			_, _ = w.Write([]byte(`{"success": false, "error-codes": ["bad-request"]}`))
+		case r.PostFormValue("secret") != "secret":
+			_, _ = w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-secret"]}`))
+		case r.PostFormValue("response") == "valid":
+			_, _ = w.Write([]byte(`{"success": true}`))
+		case r.PostFormValue("response") == "broken":
+			_, _ = w.Write([]byte(`{"success": tru`))
+		default:
+			_, _ = w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-response", "timeout-or-duplicate"]}`))
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		secret        string
+		response      string
+		remoteIP      string
+		expected      string
+		codes         []string
+		misconfigured bool
+	}{
+		{"secret", "valid", "", "", nil, false},
+		{"secret", "valid", "203.0.113.7", "", nil, false},
+		{"secret", "valid", "198.51.100.1", `captcha verification failed: "bad-request"`, []string{CodeBadRequest}, false},
+		{"secret", "invalid", "", `captcha verification failed: "invalid-input-response", "timeout-or-duplicate"`,
+			[]string{CodeInvalidInputResponse, CodeTimeoutOrDuplicate}, false},
+		{"wrong", "valid", "", `captcha verification failed: "invalid-input-secret"`, []string{CodeInvalidInputSecret}, true},
+		{"secret", "broken", "", "error parsing captcha server response", nil, false},
+		{"secret", "", "", ErrEmptyResponse.Error(), []string{CodeMissingInputResponse}, false},
+	}
+	for _, test := range tests {
+		_, err := (&Endpoint{URL: srv.URL}).verify(recaptchaVerifyURL, test.secret, test.response, test.remoteIP)
+		if test.expected == "" {
+			if err != nil {
+				t.Errorf("%s/%s: unexpected error: %s", test.secret, test.response, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), test.expected) {
+			t.Errorf("%s/%s: unexpected error:\n-> Expected: %s\n-> Found: %v", test.secret, test.response, test.expected, err)
+			continue
+		}
+
+		var verr *VerificationError
+		if !errors.As(err, &verr) {
+			if test.codes != nil {
+				t.Errorf("%s/%s: error is not a verification error: %s", test.secret, test.response, err)
+			}
+			continue
+		}
+		if strings.Join(verr.Codes, ",") != strings.Join(test.codes, ",") {
+			t.Errorf("%s/%s: unexpected codes:\n-> Expected: %v\n-> Found: %v", test.secret, test.response, test.codes, verr.Codes)
+		}
+		if verr.Misconfigured() != test.misconfigured {
+			t.Errorf("%s/%s: unexpected misconfiguration: %t", test.secret, test.response, verr.Misconfigured())
+		}
+	}
+
+	_, err := (&Endpoint{URL: srv.URL + "/404"}).verify(recaptchaVerifyURL, "secret", "valid", "")
+	if err == nil {
+		t.Error("no error found for an unreachable server")
+	} else if errors.As(err, new(*VerificationError)) {
+		t.Errorf("verification error found for an unreachable server: %s", err)
+	}
+}
+
+func TestRecaptchaV3_Verify(t *testing.T) {
+	srv := captchatest.NewServer()
+	defer srv.Close()
+	srv.Record()
+
+	now := time.Now().Truncate(time.Second)
+	for response, result := range map[string]captchatest.Result{
+		"valid":        {Success: true, Score: 0.7, Action: "contact", Hostname: "shop.example.com", ChallengeTS: now.Add(-time.Minute)},
+		"low-score":    {Success: true, Score: 0.3, Action: "contact", Hostname: "shop.example.com", ChallengeTS: now},
+		"other-action": {Success: true, Score: 0.9, Action: "login", Hostname: "shop.example.com", ChallengeTS: now},
+		"other-host":   {Success: true, Score: 0.9, Action: "contact", Hostname: "evil.com", ChallengeTS: now},
+		"old":          {Success: true, Score: 0.9, Action: "contact", Hostname: "shop.example.com", ChallengeTS: now.Add(-3 * time.Minute)},
+	} {
+		srv.Script(response, result)
+	}
+
+	r := &RecaptchaV3{
+		Secret:    "secret",
+		MinScore:  0.5,
+		Actions:   []string{"contact", "quote"},
+		Hostnames: []string{"shop.example.com"},
+		MaxAge:    2 * time.Minute,
+		Endpoint:  Endpoint{URL: srv.URL},
+	}
+	tests := []struct {
+		response string
+		expected string
+		code     string
+	}{
+		{"valid", "", ""},
+		{"low-score", "score 0.30 lower than 0.50", CodeLowScore},
+		{"other-action", `unexpected action "login"`, CodeActionMismatch},
+		{"other-host", `unexpected hostname "evil.com"`, CodeHostnameMismatch},
+		{"old", "response issued 3m0s ago, more than 2m0s", CodeExpired},
+		{captchatest.ResponseFail, `"invalid-input-response"`, CodeInvalidInputResponse},
+	}
+	for _, test := range tests {
+		err := r.verify(test.response, "203.0.113.7", now)
+		if test.expected == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.response, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasSuffix(err.Error(), test.expected) {
+			t.Errorf("%s: unexpected error:\n-> Expected: %s\n-> Found: %v", test.response, test.expected, err)
+			continue
+		}
+		var verr *VerificationError
+		if !errors.As(err, &verr) || len(verr.Codes) != 1 || verr.Codes[0] != test.code {
+			t.Errorf("%s: unexpected codes:\n-> Expected: %s\n-> Found: %v", test.response, test.code, err)
+		}
+	}
+	for _, req := range srv.Requests() {
+		if ip := req.Get("remoteip"); ip != "203.0.113.7" {
+			t.Errorf("unexpected remoteip sent: %s", ip)
+		}
+	}
+
+	// Without requirements, any valid response passes
+	r = &RecaptchaV3{Secret: "secret", Endpoint: Endpoint{URL: srv.URL, Client: &http.Client{Timeout: time.Second}}}
+	for _, response := range []string{"low-score", "other-action", "other-host", "old"} {
+		if err := r.Verify(response, ""); err != nil {
+			t.Errorf("%s: unexpected error without requirements: %s", response, err)
+		}
+	}
+}
+
+func TestWithEndpoint(t *testing.T) {
+	srv := captchatest.NewServer()
+	defer srv.Close()
+	srv.Record()
+
+	e := Endpoint{URL: srv.URL}
+	for _, v := range []Verifier{
+		&Recaptcha{Secret: "secret"},
+		&RecaptchaV3{Secret: "secret", MinScore: 0.5},
+		&HCaptcha{Secret: "secret"},
+		&Turnstile{Secret: "secret"},
+		None{},
+	} {
+		if err := WithEndpoint(v, e).Verify(captchatest.ResponsePass, ""); err != nil {
+			t.Errorf("%T: unexpected error: %s", v, err)
+		}
+		if err := WithEndpoint(v, e).Verify(captchatest.ResponseFail, ""); err == nil && v != (None{}) {
+			t.Errorf("%T: no error found for an invalid response", v)
+		}
+	}
+	if n := len(srv.Requests()); n != 8 {
+		t.Errorf("unexpected number of requests to the fake server: %d", n)
+	}
+}
+
+func TestNone_Verify(t *testing.T) {
+	for _, response := range []string{"", "anything"} {
+		if err := (None{}).Verify(response, ""); err != nil {
+			t.Errorf("unexpected error for response %q: %s", response, err)
+		}
+	}
+	if err := (&HCaptcha{Secret: "secret"}).Verify("", ""); !errors.Is(err, ErrEmptyResponse) {
+		t.Errorf("unexpected error for an empty response: %v", err)
+	}
+}
+
+func TestDefaultField(t *testing.T) {
+	for provider, expected := range map[string]string{
+		ProviderRecaptchaV2: "g-recaptcha-response",
+		ProviderRecaptchaV3: "g-recaptcha-response",
+		ProviderHCaptcha:    "h-captcha-response",
+		ProviderTurnstile:   "cf-turnstile-response",
+		ProviderNone:        "",
+	} {
+		if field := DefaultField(provider); field != expected {
+			t.Errorf("unexpected field of %s:\n-> Expected: %s\n-> Found: %s", provider, expected, field)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package captchatest
+
+// Package captchatest provides a fake siteverify API, compatible with the ones of the captcha providers,
+// that verifies scripted captcha responses. It's used in tests and in the development mode,
+// so forms can be submitted without reaching the captcha providers.
+
+import (
+	"encoding/json"
+	"github.com/nethruster/ptemplate-form-handler/pkg"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Captcha responses known by a new Server. Responses like "pass:<action>" are valid with the action provided.
+const (
+	ResponsePass     = "pass"      // valid, with score 0.9
+	ResponseLowScore = "low-score" // valid, with score 0.1
+	ResponseFail     = "fail"      // invalid
+	ResponseExpired  = "expired"   // already verified or too old
+)
+
+// DefaultHostname is the hostname of the site where the known responses were solved.
+const DefaultHostname = "localhost"
+
+// Result represents the result of verifying a captcha response. ChallengeTS is the time the captcha was solved,
+// which defaults to the time of the verification.
+type Result struct {
+	Success     bool
+	ErrorCodes  []string
+	Score       float64
+	Action      string
+	Hostname    string
+	ChallengeTS time.Time
+}
+
+// Server represents a fake siteverify API listening on URL. Responses that are not scripted are invalid.
+type Server struct {
+	URL string
+
+	srv       *httptest.Server
+	mutex     sync.Mutex
+	results   map[string]Result
+	recording bool
+	requests  []url.Values
+}
+
+// jsonResult represents the body of the responses of the Server.
+type jsonResult struct {
+	Success     bool     `json:"success"`
+	ErrorCodes  []string `json:"error-codes,omitempty"`
+	ChallengeTS string   `json:"challenge_ts,omitempty"`
+	Hostname    string   `json:"hostname,omitempty"`
+	Score       float64  `json:"score"`
+	Action      string   `json:"action,omitempty"`
+}
+
+// NewServer starts a Server in a random port of the loopback interface, which knows the responses
+// ResponsePass, ResponseLowScore, ResponseFail and ResponseExpired. It must be closed after being used.
+func NewServer() *Server {
+	s := &Server{results: map[string]Result{
+		ResponsePass:     {Success: true, Score: 0.9, Hostname: DefaultHostname},
+		ResponseLowScore: {Success: true, Score: 0.1, Hostname: DefaultHostname},
+		ResponseFail:     {ErrorCodes: []string{"invalid-input-response"}},
+		ResponseExpired:  {ErrorCodes: []string{"timeout-or-duplicate"}},
+	}}
+	s.srv = httptest.NewServer(s)
+	s.URL = s.srv.URL
+	return s
+}
+
+// Script sets the result of verifying the captcha response provided.
+func (s *Server) Script(response string, r Result) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.results[response] = r
+}
+
+// Record makes the Server keep the parameters of the verification requests it receives from now on, so they are
+// returned by Requests. They are not kept by default, so a Server that runs for long doesn't grow without limit.
+func (s *Server) Record() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.recording = true
+}
+
+// Requests returns the parameters of the verification requests received since Record was called, in order.
+func (s *Server) Requests() []url.Values {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]url.Values{}, s.requests...)
+}
+
+// Close shuts down the Server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// ServeHTTP verifies the captcha response of the form-urlencoded POST request provided,
+// like the siteverify APIs do.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	response := r.PostForm.Get("response")
+	s.mutex.Lock()
+	if s.recording {
+		s.requests = append(s.requests, r.PostForm)
+	}
+	result, ok := s.results[response]
+	s.mutex.Unlock()
+
+	if !ok && strings.HasPrefix(response, ResponsePass+":") {
+		result = Result{Success: true, Score: 0.9, Action: strings.TrimPrefix(response, ResponsePass+":"), Hostname: DefaultHostname}
+		ok = true
+	}
+	switch {
+	case r.PostForm.Get("secret") == "":
+		result = Result{ErrorCodes: []string{"missing-input-secret"}}
+	case response == "":
+		result = Result{ErrorCodes: []string{"missing-input-response"}}
+	case !ok:
+		result = Result{ErrorCodes: []string{"invalid-input-response"}}
+	}
+
+	resp := jsonResult{
+		Success:    result.Success,
+		ErrorCodes: result.ErrorCodes,
+		Hostname:   result.Hostname,
+		Score:      result.Score,
+		Action:     result.Action,
+	}
+	if result.Success {
+		ts := result.ChallengeTS
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+		resp.ChallengeTS = ts.UTC().Format(time.RFC3339)
+	}
+
+	data, _ := json.Marshal(resp)
+	w.Header().Set(pkg.MimeContentType, pkg.MimeJSON)
+	_, _ = w.Write(data)
+}
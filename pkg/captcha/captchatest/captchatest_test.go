@@ -0,0 +1,95 @@
+package captchatest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.Record()
+	srv.Script("scripted", Result{Success: true, Score: 0.4, Action: "quote", Hostname: "example.com", ChallengeTS: time.Unix(1528637909, 0)})
+
+	tests := []struct {
+		secret   string
+		response string
+		expected string
+	}{
+		{"secret", ResponsePass, `{"success":true,"challenge_ts":"*","hostname":"localhost","score":0.9}`},
+		{"secret", ResponseLowScore, `{"success":true,"challenge_ts":"*","hostname":"localhost","score":0.1}`},
+		{"secret", ResponsePass + ":contact", `{"success":true,"challenge_ts":"*","hostname":"localhost","score":0.9,"action":"contact"}`},
+		{"secret", "scripted", `{"success":true,"challenge_ts":"2018-06-10T13:38:29Z","hostname":"example.com","score":0.4,"action":"quote"}`},
+		{"secret", ResponseFail, `{"success":false,"error-codes":["invalid-input-response"],"score":0}`},
+		{"secret", ResponseExpired, `{"success":false,"error-codes":["timeout-or-duplicate"],"score":0}`},
+		{"secret", "unknown", `{"success":false,"error-codes":["invalid-input-response"],"score":0}`},
+		{"secret", "", `{"success":false,"error-codes":["missing-input-response"],"score":0}`},
+		{"", ResponsePass, `{"success":false,"error-codes":["missing-input-secret"],"score":0}`},
+	}
+	for _, test := range tests {
+		resp, err := http.PostForm(srv.URL, url.Values{"secret": {test.secret}, "response": {test.response}})
+		if err != nil {
+			t.Fatalf("error doing request: %s", err)
+		}
+		var result map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("error parsing response: %s", err)
+		}
+
+		// The time of the verification is replaced with "*"
+		if ts, ok := result["challenge_ts"].(string); ok && strings.Contains(test.expected, `"challenge_ts":"*"`) {
+			if _, err = time.Parse(time.RFC3339, ts); err != nil {
+				t.Errorf("%s: invalid challenge_ts %s", test.response, ts)
+			}
+			result["challenge_ts"] = "*"
+		}
+		data, _ := json.Marshal(result)
+		var expected map[string]interface{}
+		_ = json.Unmarshal([]byte(test.expected), &expected)
+		if expectedData, _ := json.Marshal(expected); string(data) != string(expectedData) {
+			t.Errorf("%s: unexpected result:\n-> Expected: %s\n-> Found: %s", test.response, expectedData, data)
+		}
+	}
+
+	requests := srv.Requests()
+	if len(requests) != len(tests) || requests[0].Get("secret") != "secret" || requests[0].Get("response") != ResponsePass {
+		t.Errorf("unexpected requests: %v", requests)
+	}
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("error doing request: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status code of a GET request: %d", resp.StatusCode)
+	}
+}
+
+func TestServer_Record(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.PostForm(srv.URL, url.Values{"secret": {"secret"}, "response": {ResponsePass}})
+		if err != nil {
+			t.Fatalf("error doing request: %s", err)
+		}
+		resp.Body.Close()
+		if i == 0 {
+			if requests := srv.Requests(); len(requests) != 0 {
+				t.Errorf("requests kept without recording: %v", requests)
+			}
+			srv.Record()
+		}
+	}
+	if requests := srv.Requests(); len(requests) != 1 {
+		t.Errorf("unexpected requests: %v", requests)
+	}
+}
@@ -12,8 +12,29 @@ import (
 
 var c = &http.Client{Timeout: 10 * time.Second}
 
+// PostJSON makes a POST request to the URL provided with the JSON data provided, and returns the response body.
 func PostJSON(url string, data []byte) ([]byte, error) {
-	resp, err := c.Post(url, pkg.MimeJSON, bytes.NewReader(data))
+	return Post(url, pkg.MimeJSON, nil, data)
+}
+
+// Post makes a POST request to the URL provided with the content type, extra headers and data provided,
+// and returns the response body.
+func Post(url, contentType string, headers map[string]string, data []byte) ([]byte, error) {
+	return PostWith(c, url, contentType, headers, data)
+}
+
+// PostWith is Post with the HTTP client provided instead of the default one.
+func PostWith(hc *http.Client, url, contentType string, headers map[string]string, data []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error creating http request: %s", err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set(pkg.MimeContentType, contentType)
+
+	resp, err := hc.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed http request: %s", err)
 	}
@@ -7,6 +7,7 @@ import (
 	"github.com/nethruster/ptemplate-form-handler/pkg/client"
 	"golang.org/x/sys/unix"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -58,8 +59,13 @@ func TestPostJSON(t *testing.T) {
 		end <- true //Send end status
 	}()
 
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		t.Fatalf("error listening to %s: %s", srv.Addr, err)
+	}
+
 	go func() {
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
 			t.Errorf("Unexpected error which closed the server: %s", err)
 		}
 	}()
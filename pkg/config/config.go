@@ -3,29 +3,418 @@ package config
 // Package config is the package that manages the functions related to the config file of ptemplate-form-handler.
 
 import (
+	"crypto"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/api"
+	"github.com/nethruster/ptemplate-form-handler/pkg/captcha"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"github.com/nethruster/ptemplate-form-handler/pkg/queue"
+	"github.com/nethruster/ptemplate-form-handler/pkg/ratelimit"
 	"github.com/nethruster/ptemplate-form-handler/pkg/sender"
+	"github.com/nethruster/ptemplate-form-handler/pkg/spam"
+	"github.com/nethruster/ptemplate-form-handler/pkg/trap"
 	"github.com/pelletier/go-toml"
 	"io/ioutil"
+	"mime"
+	"net"
+	netmail "net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// defaultSiteID is the ID given to the site described at the top level of a single-site config file.
+	defaultSiteID = "default"
+
+	// Default settings of the queue
+	defaultMaxAttempts    = 10
+	defaultInitialBackoff = time.Minute
+	defaultMaxBackoff     = time.Hour
+
+	// Default limits of the acknowledgements sent to the same address, for the forms of the same client IP address
+	// and in total
+	defaultAutoReplyRateLimit       = 3
+	defaultAutoReplyIPRateLimit     = 10
+	defaultAutoReplyGlobalRateLimit = 500
+	defaultAutoReplyRatePeriod      = 24 * time.Hour
+
+	// Default settings of the tokens of the traps
+	defaultTokenField   = "form_token"
+	defaultTokenMinTime = 3 * time.Second
+	defaultTokenMaxAge  = 24 * time.Hour
+
+	// minTokenSecretLength is the minimum length of the secret the tokens of the traps are signed with.
+	minTokenSecretLength = 16
+
+	// Default settings of the spam rules
+	defaultCapsMaxRatio   = 0.7
+	defaultCapsMinLetters = 20
+	defaultRepeatedMax    = 1
+	defaultRepeatedPeriod = time.Hour
+
+	// Default action taken with the spam found by the spam daemons
+	defaultSpamDaemonAction = spam.ActionTag
+)
+
+var (
+	regexSiteID    = regexp.MustCompile("^[-0-9A-Za-z_.]+$")
+	regexFieldName = regexp.MustCompile("^[-0-9A-Za-z_]+$")
 )
 
 // config represents the structure of the config file of ptemplate-form-handler.
+//
+// The top level fields describe a single site and are kept for compatibility with single-site config files.
+// They cannot be used together with the "sites" array.
 type config struct {
-	WebName string `toml:"web_name"`
-	RecaptchaSecret string `toml:"recaptcha_secret"`
-	Mail struct {
-		Mailto string `toml:"mailto"`
-		Username string `toml:"username"`
-		Password string `toml:"password"`
-		SmtpServer string `toml:"smtp_server"`
-		Port int `toml:"port"`
-	} `toml:"mail"`
-}
-
-// LoadConfig will read the config from the path provided and return a sender.Mail object.
-func LoadConfig(path string) (*sender.Mail, error) {
+	SiteSettings
+	Sites          []site    `toml:"sites"`
+	Queue          *outbox   `toml:"queue"`
+	SMTPPool       *smtpPool `toml:"smtp_pool"`
+	TrustedProxies []string  `toml:"trusted_proxies"`
+	RateLimitStore string    `toml:"rate_limit_store"`
+}
+
+// outbox represents the settings of the queue where the forms pending delivery are kept.
+type outbox struct {
+	Dir            string        `toml:"dir"`
+	MaxAttempts    int           `toml:"max_attempts"`
+	InitialBackoff time.Duration `toml:"initial_backoff"`
+	MaxBackoff     time.Duration `toml:"max_backoff"`
+}
+
+// smtpPool represents the settings of the pool of connections used by all the SMTP accounts.
+type smtpPool struct {
+	MaxConnections int           `toml:"max_connections"`
+	MaxMessages    int           `toml:"max_messages"`
+	IdleTimeout    time.Duration `toml:"idle_timeout"`
+}
+
+// site represents each element of the "sites" array of the config file.
+type site struct {
+	ID    string   `toml:"id"`
+	Hosts []string `toml:"hosts"`
+	SiteSettings
+}
+
+// SiteSettings represents the settings of a site, used both by the elements of the "sites" array
+// and by the top level of single-site config files.
+// It's exported because go-toml only decodes the fields of exported embedded structs.
+type SiteSettings struct {
+	WebName         string           `toml:"web_name"`
+	RecaptchaSecret string           `toml:"recaptcha_secret"`
+	Captcha         *captchaSettings `toml:"captcha"`
+	SuccessURL      string           `toml:"success_url"`
+	ErrorURL        string           `toml:"error_url"`
+	Mail            mail             `toml:"mail"`
+	Sender          *backend         `toml:"sender"`
+	Senders         []backend        `toml:"senders"`
+	Fields          []field          `toml:"fields"`
+	Templates       templates        `toml:"templates"`
+	FromName        string           `toml:"from_name"`
+	ReplyTo         *bool            `toml:"reply_to"`
+	AutoReply       *autoReply       `toml:"autoreply"`
+	Recipients      recipients       `toml:"recipients"`
+	Routes          []route          `toml:"routes"`
+	DKIM            *dkim            `toml:"dkim"`
+	Encryption      *encryption      `toml:"encryption"`
+	Traps           *traps           `toml:"traps"`
+	Spam            *spamSettings    `toml:"spam"`
+	SpamDaemon      *spamDaemon      `toml:"spam_daemon"`
+	RateLimit       *rateLimits      `toml:"rate_limit"`
+}
+
+// captchaSettings represents the captcha that the forms of a site must pass. Field is the name of the field
+// of the requests with the captcha response, which defaults to the one of the provider.
+// MinScore, Actions, Hostnames and MaxAge are the requirements of reCAPTCHA v3 responses.
+type captchaSettings struct {
+	Provider  string        `toml:"provider"`
+	Secret    string        `toml:"secret"`
+	Field     string        `toml:"field"`
+	MinScore  float64       `toml:"min_score"`
+	Actions   []string      `toml:"actions"`
+	Hostnames []string      `toml:"hostnames"`
+	MaxAge    time.Duration `toml:"max_age"`
+}
+
+// recipients represents the addresses the forms of a site are sent to via SMTP.
+type recipients struct {
+	To  []string `toml:"to"`
+	Cc  []string `toml:"cc"`
+	Bcc []string `toml:"bcc"`
+}
+
+// route represents a rule that sends the forms whose field has a value to other recipients.
+type route struct {
+	Field string   `toml:"field"`
+	Value string   `toml:"value"`
+	To    []string `toml:"to"`
+	Cc    []string `toml:"cc"`
+	Bcc   []string `toml:"bcc"`
+}
+
+// dkim represents the settings used to sign with DKIM the messages of a site sent via SMTP.
+// Canonicalization has the format of the "c" tag of the signatures: "<header>/<body>" or "<header>".
+type dkim struct {
+	Domain           string   `toml:"domain"`
+	Selector         string   `toml:"selector"`
+	PrivateKey       string   `toml:"private_key"`
+	Canonicalization string   `toml:"canonicalization"`
+	Headers          []string `toml:"headers"`
+
+	// key is the key of PrivateKey, set by load.
+	key crypto.Signer
+}
+
+// encryption represents the public keys the messages of a site sent via SMTP are encrypted for.
+// Only one of OpenPGPKey and SMIMECertificate can be set.
+type encryption struct {
+	OpenPGPKey       string `toml:"openpgp_key"`
+	SMIMECertificate string `toml:"smime_certificate"`
+
+	// encrypter is the encrypter of the key, set by load.
+	encrypter sender.Encrypter
+}
+
+// traps represents the settings of the traps that detect the forms of a site submitted by bots.
+// The forms must have a token only if TokenSecret is set.
+type traps struct {
+	HoneypotFields []string      `toml:"honeypot_fields"`
+	TokenSecret    string        `toml:"token_secret"`
+	TokenField     string        `toml:"token_field"`
+	MinTime        time.Duration `toml:"min_time"`
+	MaxAge         time.Duration `toml:"max_age"`
+}
+
+// spamSettings represents the rules that score how likely the forms of a site are spam, and the scores
+// the forms are tagged or rejected with. Rules are enabled by declaring them.
+type spamSettings struct {
+	TagScore          float64                `toml:"tag_score"`
+	RejectScore       float64                `toml:"reject_score"`
+	Links             *spamLinks             `toml:"links"`
+	Keywords          *spamKeywords          `toml:"keywords"`
+	Scripts           *spamScripts           `toml:"scripts"`
+	Caps              *spamCaps              `toml:"caps"`
+	DisposableDomains *spamDisposableDomains `toml:"disposable_domains"`
+	Repeated          *spamRepeated          `toml:"repeated"`
+}
+
+// spamLinks represents the settings of the spam.Links rule.
+type spamLinks struct {
+	Max   int     `toml:"max"`
+	Score float64 `toml:"score"`
+}
+
+// spamKeywords represents the settings of the spam.Keywords rule. Patterns are regular expressions.
+type spamKeywords struct {
+	Words    []string `toml:"words"`
+	Patterns []string `toml:"patterns"`
+	Score    float64  `toml:"score"`
+
+	// patterns are the compiled Patterns, set by load.
+	patterns []*regexp.Regexp
+}
+
+// spamScripts represents the settings of the spam.Scripts rule.
+type spamScripts struct {
+	Blocked []string `toml:"blocked"`
+	Score   float64  `toml:"score"`
+}
+
+// spamCaps represents the settings of the spam.Caps rule.
+type spamCaps struct {
+	MaxRatio   float64 `toml:"max_ratio"`
+	MinLetters int     `toml:"min_letters"`
+	Score      float64 `toml:"score"`
+}
+
+// spamDisposableDomains represents the settings of the spam.DisposableDomains rule.
+// Domains are added to spam.DefaultDisposableDomains.
+type spamDisposableDomains struct {
+	Domains []string `toml:"domains"`
+	Score   float64  `toml:"score"`
+}
+
+// spamRepeated represents the settings of the spam.Repeated rule.
+type spamRepeated struct {
+	Max    int           `toml:"max"`
+	Period time.Duration `toml:"period"`
+	Score  float64       `toml:"score"`
+}
+
+// spamDaemon represents the spam daemon the messages of the forms of a site are checked with before delivering them,
+// and the action taken with the ones that are spam. Address and User are the settings of spamd, and URL and Password
+// the ones of rspamd. Quarantine is the path of the Maildir the spam is delivered to with the quarantine action.
+type spamDaemon struct {
+	Type       string        `toml:"type"`
+	Address    string        `toml:"address"`
+	User       string        `toml:"user"`
+	URL        string        `toml:"url"`
+	Password   string        `toml:"password"`
+	Timeout    time.Duration `toml:"timeout"`
+	Action     string        `toml:"action"`
+	Quarantine string        `toml:"quarantine"`
+}
+
+// rateLimits represents the limits of how often the forms of a site can be submitted from the same client IP
+// address, with the same email address and in total. Limits are enabled by declaring them.
+type rateLimits struct {
+	PerIP    *rateLimit `toml:"per_ip"`
+	PerEmail *rateLimit `toml:"per_email"`
+	Global   *rateLimit `toml:"global"`
+}
+
+// rateLimit represents a limit of Limit forms every Period, which allows bursts of Limit forms.
+type rateLimit struct {
+	Limit  int           `toml:"limit"`
+	Period time.Duration `toml:"period"`
+}
+
+// autoReply represents the settings of the acknowledgements sent to the submitters of the forms of a site.
+// They are sent with the "mail" account of the site. The rate limits are the maximum number of acknowledgements
+// sent every RatePeriod to the same address, for the forms of the same client IP address and in total.
+type autoReply struct {
+	Templates       templates     `toml:"templates"`
+	RateLimit       int           `toml:"rate_limit"`
+	IPRateLimit     int           `toml:"ip_rate_limit"`
+	GlobalRateLimit int           `toml:"global_rate_limit"`
+	RatePeriod      time.Duration `toml:"rate_period"`
+}
+
+// templates represents the paths of the template files used to build the messages of a site.
+type templates struct {
+	Subject string `toml:"subject"`
+	Text    string `toml:"text"`
+	HTML    string `toml:"html"`
+}
+
+// field represents each of the fields declared in the form schema of a site.
+type field struct {
+	Name      string   `toml:"name"`
+	Label     string   `toml:"label"`
+	Type      string   `toml:"type"`
+	Required  bool     `toml:"required"`
+	MaxLength int      `toml:"max_length"`
+	Values    []string `toml:"values"`
+	MaxSize   int64    `toml:"max_size"`
+	MaxCount  int      `toml:"max_count"`
+	MimeTypes []string `toml:"mime_types"`
+}
+
+// backend represents a backend used to deliver the forms of a site.
+// The SMTP backend takes its settings from the "mail" table of the site.
+type backend struct {
+	Name    string            `toml:"name"`
+	Policy  string            `toml:"policy"`
+	Type    string            `toml:"type"`
+	URL     string            `toml:"url"`
+	Headers map[string]string `toml:"headers"`
+	Path    string            `toml:"path"`
+}
+
+// mail represents the SMTP account used to send the forms of a site, and the settings of the connection to its server.
+// Fallbacks are the accounts used, in order, when the server of the previous one fails. They cannot have
+// mailto, fallbacks or cooldown.
+type mail struct {
+	Mailto             string        `toml:"mailto"`
+	From               string        `toml:"from"`
+	Username           string        `toml:"username"`
+	Password           string        `toml:"password"`
+	SmtpServer         string        `toml:"smtp_server"`
+	Port               int           `toml:"port"`
+	TLS                string        `toml:"tls"`
+	CAFile             string        `toml:"ca_file"`
+	ServerName         string        `toml:"server_name"`
+	InsecureSkipVerify bool          `toml:"insecure_skip_verify"`
+	Auth               string        `toml:"auth"`
+	HELO               string        `toml:"helo"`
+	DialTimeout        time.Duration `toml:"dial_timeout"`
+	CommandTimeout     time.Duration `toml:"command_timeout"`
+	Fallbacks          []mail        `toml:"fallbacks"`
+	Cooldown           time.Duration `toml:"cooldown"`
+
+	// rootCAs is the pool of the certificates of CAFile, set by load.
+	rootCAs *x509.CertPool
+}
+
+// Config represents the configuration of ptemplate-form-handler once loaded and validated.
+// Queue is nil if the forms that cannot be delivered are not kept to be retried.
+// SMTPPool is the pool of connections used by the SMTP accounts, or nil if a new connection is opened for each message.
+// TrustedProxies are the networks of the reverse proxies whose X-Forwarded-For headers are trusted.
+// RateLimits keeps the rate limits of all the sites, or is nil if no site has them.
+type Config struct {
+	Sites          []*Site
+	Queue          *queue.Queue
+	SMTPPool       *sender.Pool
+	TrustedProxies []*net.IPNet
+	RateLimits     *ratelimit.Store
+}
+
+// Site represents a website whose forms are handled by ptemplate-form-handler.
+// SuccessURL and ErrorURL are the pages browsers are redirected to after submitting a form, or nil if there are none.
+// AutoReply sends the acknowledgements of the forms, or is nil if they are not sent.
+// Traps detect the forms submitted by bots, or are nil if the site has none.
+// Spam scores how likely the forms are spam, or is nil if they are not scored.
+// SpamDaemon checks the messages of the forms with a spam daemon before delivering them, or is nil if they are not checked.
+// IPLimit, EmailLimit and GlobalLimit limit how often the forms are submitted from the same client IP address,
+// with the same email address and in total, or are nil if they are not limited.
+type Site struct {
+	ID           string
+	Hosts        []string
+	Captcha      captcha.Verifier
+	CaptchaField string
+	Traps        *trap.Traps
+	Spam         *spam.Filter
+	SpamDaemon   *spam.Stage
+	IPLimit      *ratelimit.Bucket
+	EmailLimit   *ratelimit.Bucket
+	GlobalLimit  *ratelimit.Bucket
+	SuccessURL   *url.URL
+	ErrorURL     *url.URL
+	Schema       form.Schema
+	Sender       *sender.Multi
+	AutoReply    *sender.AutoReply
+}
+
+// Types of backends that can be used to deliver the forms of a site.
+const (
+	backendSMTP       = "smtp"
+	backendWebhook    = "webhook"
+	backendSlack      = sender.ChatSlack
+	backendMattermost = sender.ChatMattermost
+	backendDiscord    = sender.ChatDiscord
+	backendMaildir    = "maildir"
+	backendMbox       = "mbox"
+	backendStdout     = "stdout"
+)
+
+// Types of spam daemons the messages of a site can be checked with.
+const (
+	daemonSpamd  = "spamd"
+	daemonRspamd = "rspamd"
+)
+
+// Rate limits of a site.
+const (
+	rateLimitPerIP    = "per_ip"
+	rateLimitPerEmail = "per_email"
+	rateLimitGlobal   = "global"
+)
+
+// Delivery policies of the backends of a site.
+const (
+	policyRequired   = "required"
+	policyBestEffort = "best_effort"
+)
+
+// LoadConfig will read the config from the path provided and return the sites described in it.
+func LoadConfig(path string) (*Config, error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("error reading config file from path \"%s\": %w", path, err)
@@ -36,43 +425,1364 @@ func LoadConfig(path string) (*sender.Mail, error) {
 		return nil, fmt.Errorf("error parsing config file from path \"%s\": %w", path, err)
 	}
 
-	if err = checkValidInput(&c); err != nil {
+	sites, err := c.sites()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration file: %w", err)
+	}
+
+	q, err := c.queue(sites)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration file: %w", err)
+	}
+
+	pool, err := c.smtpPool()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration file: %w", err)
+	}
+
+	proxies, err := c.trustedProxies()
+	if err != nil {
 		return nil, fmt.Errorf("invalid configuration file: %w", err)
 	}
 
-	return &sender.Mail{
-		WebName:         c.WebName,
-		RecaptchaSecret: c.RecaptchaSecret,
-		Mailto:          c.Mail.Mailto,
-		Username:        c.Mail.Username,
-		Password:        c.Mail.Password,
-		Hostname:        c.Mail.SmtpServer,
-		Port:            strconv.Itoa(c.Mail.Port),
+	conf := &Config{
+		Sites:          make([]*Site, 0, len(sites)),
+		Queue:          q,
+		SMTPPool:       pool,
+		TrustedProxies: proxies,
+	}
+	for i := range sites {
+		s := &sites[i]
+		if err = s.load(); err != nil {
+			return nil, fmt.Errorf("invalid configuration file: site \"%s\": %w", s.ID, err)
+		}
+		schema := s.schema()
+		t, err := loadTemplates(&s.Templates, s.WebName, schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid configuration file: site \"%s\": %w", s.ID, err)
+		}
+		autoReply, err := s.newAutoReply(schema, pool)
+		if err != nil {
+			return nil, fmt.Errorf("invalid configuration file: site \"%s\": autoreply: %w", s.ID, err)
+		}
+
+		site := &Site{
+			ID:           s.ID,
+			Hosts:        s.Hosts,
+			Captcha:      s.captcha(),
+			CaptchaField: s.captchaField(),
+			Traps:        s.traps(),
+			Spam:         s.spamFilter(),
+			SpamDaemon:   s.spamDaemon(t, pool),
+			IPLimit:      s.RateLimit.bucket(rateLimitPerIP),
+			EmailLimit:   s.RateLimit.bucket(rateLimitPerEmail),
+			GlobalLimit:  s.RateLimit.bucket(rateLimitGlobal),
+			SuccessURL:   parseURL(s.SuccessURL),
+			ErrorURL:     parseURL(s.ErrorURL),
+			Schema:       schema,
+			Sender:       s.newSender(t, pool),
+			AutoReply:    autoReply,
+		}
+		conf.Sites = append(conf.Sites, site)
+
+		buckets := map[string]*ratelimit.Bucket{
+			rateLimitPerIP:    site.IPLimit,
+			rateLimitPerEmail: site.EmailLimit,
+			rateLimitGlobal:   site.GlobalLimit,
+		}
+		for name, b := range buckets {
+			if b == nil {
+				continue
+			}
+			if conf.RateLimits == nil {
+				conf.RateLimits = &ratelimit.Store{Path: c.RateLimitStore}
+			}
+			conf.RateLimits.Add(s.ID+"/"+name, b)
+		}
+	}
+	return conf, nil
+}
+
+// parseURL returns the URL provided parsed, or nil if it's empty. The URL must be valid.
+func parseURL(rawURL string) *url.URL {
+	if rawURL == "" {
+		return nil
+	}
+	u, _ := url.Parse(rawURL)
+	return u
+}
+
+// schema returns the form schema of the site provided, which is form.DefaultSchema if no field is declared.
+// The site must be valid.
+func (s *site) schema() form.Schema {
+	if len(s.Fields) == 0 {
+		return form.DefaultSchema
+	}
+
+	schema := make(form.Schema, 0, len(s.Fields))
+	for _, f := range s.Fields {
+		label := f.Label
+		if label == "" {
+			label = f.Name
+		}
+		schema = append(schema, form.Field{
+			Name:      f.Name,
+			Label:     label,
+			Type:      form.Type(f.Type),
+			Required:  f.Required,
+			MaxLength: f.MaxLength,
+			Values:    f.Values,
+			MaxSize:   f.MaxSize,
+			MaxCount:  f.MaxCount,
+			MimeTypes: f.MimeTypes,
+		})
+	}
+	return schema
+}
+
+// loadTemplates returns the templates with the paths provided, after checking that they can be executed
+// for the site with the name and schema provided. It returns nil if there are no templates.
+func loadTemplates(paths *templates, webName string, schema form.Schema) (*sender.Templates, error) {
+	if *paths == (templates{}) {
+		return nil, nil
+	}
+
+	t, err := sender.LoadTemplates(paths.Subject, paths.Text, paths.HTML)
+	if err != nil {
+		return nil, err
+	}
+	if err = t.Check(webName, schema); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// newAutoReply returns the sender.AutoReply that sends the acknowledgements of the forms of the site provided,
+// which have the schema provided, using the pool of SMTP connections provided.
+// It returns nil if the site has no autoreply. The site must be valid.
+func (s *site) newAutoReply(schema form.Schema, pool *sender.Pool) (*sender.AutoReply, error) {
+	if s.AutoReply == nil {
+		return nil, nil
+	}
+
+	t, err := loadTemplates(&s.AutoReply.Templates, s.WebName, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	period := s.AutoReply.RatePeriod
+	if period == 0 {
+		period = defaultAutoReplyRatePeriod
+	}
+	limiter := func(limit, defaultLimit int) *ratelimit.Limiter {
+		if limit == 0 {
+			limit = defaultLimit
+		}
+		return &ratelimit.Limiter{Limit: limit, Period: period}
+	}
+
+	// Acknowledgements are sent to the submitters, who cannot decrypt them
+	m := s.newBackend(&backend{Type: backendSMTP}, nil, pool).(*sender.Mail)
+	m.Encrypter = nil
+	return &sender.AutoReply{
+		Mail:          m,
+		Templates:     t,
+		Limiter:       limiter(s.AutoReply.RateLimit, defaultAutoReplyRateLimit),
+		IPLimiter:     limiter(s.AutoReply.IPRateLimit, defaultAutoReplyIPRateLimit),
+		GlobalLimiter: limiter(s.AutoReply.GlobalRateLimit, defaultAutoReplyGlobalRateLimit),
 	}, nil
 }
 
-// checkValidInput checks if all the fields in the config provided are valid
-func checkValidInput(c *config) error {
-	if c.WebName == "" {
+// newSender returns the sender.Multi that delivers the forms of the site provided,
+// whose messages are built with the templates provided. SMTP backends use the pool of connections provided.
+// The site must be valid.
+func (s *site) newSender(t *sender.Templates, pool *sender.Pool) *sender.Multi {
+	backends := s.backends()
+	m := &sender.Multi{Targets: make([]sender.Target, 0, len(backends))}
+	for i := range backends {
+		b := &backends[i]
+		m.Targets = append(m.Targets, sender.Target{
+			Name:     b.name(),
+			Sender:   s.newBackend(b, t, pool),
+			Required: b.Policy != policyBestEffort,
+		})
+	}
+	return m
+}
+
+// backends returns the backends of the site provided.
+// If none is set, the SMTP backend with the "mail" table of the site is returned.
+func (s *site) backends() []backend {
+	if len(s.Senders) != 0 {
+		return s.Senders
+	}
+	if s.Sender != nil {
+		return []backend{*s.Sender}
+	}
+	return []backend{{Type: backendSMTP}}
+}
+
+// name returns the name of the backend provided, which defaults to its type.
+func (b *backend) name() string {
+	if b.Name != "" {
+		return b.Name
+	}
+	return b.Type
+}
+
+// newBackend returns the sender.Sender described by the backend of the site provided.
+// The templates provided are used by the backends that deliver messages,
+// and the pool of connections provided, which can be nil, by the SMTP backend.
+func (s *site) newBackend(b *backend, t *sender.Templates, pool *sender.Pool) sender.Sender {
+	switch b.Type {
+	case backendWebhook:
+		return &sender.Webhook{
+			WebName: s.WebName,
+			URL:     b.URL,
+			Headers: b.Headers,
+		}
+	case backendSlack, backendMattermost, backendDiscord:
+		return &sender.Chat{
+			Format:  b.Type,
+			WebName: s.WebName,
+			URL:     b.URL,
+		}
+	case backendMaildir:
+		return &sender.Maildir{
+			WebName:   s.WebName,
+			Path:      b.Path,
+			Templates: t,
+		}
+	case backendMbox:
+		return &sender.Mbox{
+			WebName:   s.WebName,
+			Path:      b.Path,
+			Templates: t,
+		}
+	case backendStdout:
+		return &sender.Stdout{WebName: s.WebName}
+	default:
+		return &sender.Mail{
+			WebName:    s.WebName,
+			Recipients: s.recipients(),
+			Routes:     s.routes(),
+			Account:    s.Mail.account(),
+			From:       s.Mail.From,
+			Fallbacks:  s.Mail.fallbacks(),
+			Cooldown:   s.Mail.Cooldown,
+			Pool:       pool,
+			DKIM:       s.dkim(),
+			Encrypter:  s.encrypter(),
+			FromName:   s.FromName,
+			ReplyTo:    s.ReplyTo == nil || *s.ReplyTo,
+			Templates:  t,
+		}
+	}
+}
+
+// account returns the sender.Account described by the SMTP account provided. The account must be valid.
+func (m *mail) account() sender.Account {
+	return sender.Account{
+		Hostname:           m.SmtpServer,
+		Port:               strconv.Itoa(m.Port),
+		Username:           m.Username,
+		Password:           m.Password,
+		TLS:                m.TLS,
+		RootCAs:            m.rootCAs,
+		ServerName:         m.ServerName,
+		InsecureSkipVerify: m.InsecureSkipVerify,
+		Auth:               m.Auth,
+		HELO:               m.HELO,
+		DialTimeout:        m.DialTimeout,
+		CommandTimeout:     m.CommandTimeout,
+	}
+}
+
+// dkim returns the sender.DKIM that signs the messages of the site provided sent via SMTP,
+// or nil if they are not signed. The site must be valid.
+func (s *site) dkim() *sender.DKIM {
+	if s.DKIM == nil {
+		return nil
+	}
+
+	headerCanon, bodyCanon := s.DKIM.canonicalization()
+	return &sender.DKIM{
+		Domain:                 s.DKIM.Domain,
+		Selector:               s.DKIM.Selector,
+		Key:                    s.DKIM.key,
+		HeaderCanonicalization: headerCanon,
+		BodyCanonicalization:   bodyCanon,
+		Headers:                s.DKIM.Headers,
+	}
+}
+
+// captcha returns the captcha.Verifier of the responses sent with the forms of the site provided.
+// The site must be valid.
+func (s *site) captcha() captcha.Verifier {
+	if s.Captcha == nil {
+		return &captcha.Recaptcha{Secret: s.RecaptchaSecret}
+	}
+	switch s.Captcha.Provider {
+	case captcha.ProviderRecaptchaV2:
+		return &captcha.Recaptcha{Secret: s.Captcha.Secret}
+	case captcha.ProviderRecaptchaV3:
+		hostnames := make([]string, len(s.Captcha.Hostnames))
+		for i, h := range s.Captcha.Hostnames {
+			hostnames[i] = strings.ToLower(h)
+		}
+		return &captcha.RecaptchaV3{
+			Secret:    s.Captcha.Secret,
+			MinScore:  s.Captcha.MinScore,
+			Actions:   s.Captcha.Actions,
+			Hostnames: hostnames,
+			MaxAge:    s.Captcha.MaxAge,
+		}
+	case captcha.ProviderHCaptcha:
+		return &captcha.HCaptcha{Secret: s.Captcha.Secret}
+	case captcha.ProviderTurnstile:
+		return &captcha.Turnstile{Secret: s.Captcha.Secret}
+	default:
+		return captcha.None{}
+	}
+}
+
+// captchaField returns the name of the field of the requests with the captcha response of the site provided,
+// or an empty string if the site has no captcha.
+func (s *site) captchaField() string {
+	switch {
+	case s.Captcha == nil:
+		return api.FieldRecaptcha
+	case s.Captcha.Field != "":
+		return s.Captcha.Field
+	default:
+		return captcha.DefaultField(s.Captcha.Provider)
+	}
+}
+
+// traps returns the traps of the forms of the site provided, or nil if it has none. The site must be valid.
+func (s *site) traps() *trap.Traps {
+	if s.Traps == nil {
+		return nil
+	}
+
+	t := &trap.Traps{HoneypotFields: s.Traps.HoneypotFields}
+	if s.Traps.TokenSecret == "" {
+		return t
+	}
+	t.Secret = []byte(s.Traps.TokenSecret)
+	t.TokenField = s.Traps.TokenField
+	if t.TokenField == "" {
+		t.TokenField = defaultTokenField
+	}
+	t.MinTime = s.Traps.MinTime
+	if t.MinTime == 0 {
+		t.MinTime = defaultTokenMinTime
+	}
+	t.MaxAge = s.Traps.MaxAge
+	if t.MaxAge == 0 {
+		t.MaxAge = defaultTokenMaxAge
+	}
+	return t
+}
+
+// spamFilter returns the spam filter of the forms of the site provided, or nil if it has none.
+// The site must be valid.
+func (s *site) spamFilter() *spam.Filter {
+	sp := s.Spam
+	if sp == nil {
+		return nil
+	}
+
+	fl := &spam.Filter{TagScore: sp.TagScore, RejectScore: sp.RejectScore}
+	if sp.Links != nil {
+		fl.Rules = append(fl.Rules, &spam.Links{Max: sp.Links.Max, Score: sp.Links.Score})
+	}
+	if sp.Keywords != nil {
+		fl.Rules = append(fl.Rules, &spam.Keywords{Words: sp.Keywords.Words, Patterns: sp.Keywords.patterns, Score: sp.Keywords.Score})
+	}
+	if sp.Scripts != nil {
+		fl.Rules = append(fl.Rules, &spam.Scripts{Blocked: sp.Scripts.Blocked, Score: sp.Scripts.Score})
+	}
+	if sp.Caps != nil {
+		c := &spam.Caps{MaxRatio: sp.Caps.MaxRatio, MinLetters: sp.Caps.MinLetters, Score: sp.Caps.Score}
+		if c.MaxRatio == 0 {
+			c.MaxRatio = defaultCapsMaxRatio
+		}
+		if c.MinLetters == 0 {
+			c.MinLetters = defaultCapsMinLetters
+		}
+		fl.Rules = append(fl.Rules, c)
+	}
+	if sp.DisposableDomains != nil {
+		domains := append([]string{}, spam.DefaultDisposableDomains...)
+		for _, d := range sp.DisposableDomains.Domains {
+			domains = append(domains, strings.ToLower(d))
+		}
+		fl.Rules = append(fl.Rules, &spam.DisposableDomains{Domains: domains, Score: sp.DisposableDomains.Score})
+	}
+	if sp.Repeated != nil {
+		r := &spam.Repeated{Max: sp.Repeated.Max, Period: sp.Repeated.Period, Score: sp.Repeated.Score}
+		if r.Max == 0 {
+			r.Max = defaultRepeatedMax
+		}
+		if r.Period == 0 {
+			r.Period = defaultRepeatedPeriod
+		}
+		fl.Rules = append(fl.Rules, r)
+	}
+	return fl
+}
+
+// spamDaemon returns the stage that checks the messages of the forms of the site provided with a spam daemon,
+// which are built with the templates provided, or nil if they are not checked. The site must be valid.
+func (s *site) spamDaemon(t *sender.Templates, pool *sender.Pool) *spam.Stage {
+	sd := s.SpamDaemon
+	if sd == nil {
+		return nil
+	}
+
+	st := &spam.Stage{
+		Mail:   s.newBackend(&backend{Type: backendSMTP}, t, pool).(*sender.Mail),
+		Action: sd.Action,
+	}
+	if st.Action == "" {
+		st.Action = defaultSpamDaemonAction
+	}
+	if sd.Type == daemonRspamd {
+		st.Daemon = &spam.Rspamd{URL: sd.URL, Password: sd.Password, Timeout: sd.Timeout}
+	} else {
+		st.Daemon = &spam.Spamd{Address: sd.Address, User: sd.User, Timeout: sd.Timeout}
+	}
+	if sd.Quarantine != "" {
+		st.Quarantine = &sender.Maildir{WebName: s.WebName, Path: sd.Quarantine, Templates: t}
+	}
+	return st
+}
+
+// bucket returns the ratelimit.Bucket of the rate limit with the name provided of the rate limits provided,
+// or nil if there are no rate limits or the limit is not set. The rate limits must be valid.
+func (rl *rateLimits) bucket(name string) *ratelimit.Bucket {
+	if rl == nil {
+		return nil
+	}
+	l := rl.limits()[name]
+	if l == nil {
+		return nil
+	}
+	return &ratelimit.Bucket{Limit: l.Limit, Period: l.Period}
+}
+
+// limits returns the rate limits provided by name.
+func (rl *rateLimits) limits() map[string]*rateLimit {
+	return map[string]*rateLimit{rateLimitPerIP: rl.PerIP, rateLimitPerEmail: rl.PerEmail, rateLimitGlobal: rl.Global}
+}
+
+// encrypter returns the sender.Encrypter that encrypts the messages of the site provided sent via SMTP,
+// or nil if they are not encrypted. The site must be valid.
+func (s *site) encrypter() sender.Encrypter {
+	if s.Encryption == nil {
+		return nil
+	}
+	return s.Encryption.encrypter
+}
+
+// canonicalization returns the header and body canonicalization algorithms of the DKIM settings provided.
+// As in the "c" tag of the signatures, the body one is "simple" if only the header one is set.
+func (d *dkim) canonicalization() (header, body string) {
+	if d.Canonicalization == "" {
+		return "", ""
+	}
+	parts := strings.SplitN(d.Canonicalization, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], sender.CanonicalizationSimple
+	}
+	return parts[0], parts[1]
+}
+
+// fallbacks returns the sender.Account described by each of the fallbacks of the SMTP account provided,
+// or nil if there are none. The account must be valid.
+func (m *mail) fallbacks() []sender.Account {
+	if len(m.Fallbacks) == 0 {
+		return nil
+	}
+	accounts := make([]sender.Account, len(m.Fallbacks))
+	for i := range m.Fallbacks {
+		accounts[i] = m.Fallbacks[i].account()
+	}
+	return accounts
+}
+
+// load loads the files and compiles the patterns referenced by the settings of the site provided,
+// keeping them in the settings for the builders. The site must be valid.
+func (s *site) load() error {
+	if err := s.Mail.load(); err != nil {
+		return err
+	}
+	if s.DKIM != nil {
+		if err := s.DKIM.load(); err != nil {
+			return fmt.Errorf("dkim: %w", err)
+		}
+	}
+	if s.Encryption != nil {
+		if err := s.Encryption.load(); err != nil {
+			return fmt.Errorf("encryption: %w", err)
+		}
+	}
+	if s.Spam != nil && s.Spam.Keywords != nil {
+		if err := s.Spam.Keywords.load(); err != nil {
+			return fmt.Errorf("spam: keywords: %w", err)
+		}
+	}
+	return nil
+}
+
+// load loads the certificates of the CA file of the SMTP account provided and of its fallbacks, if they have one.
+func (m *mail) load() error {
+	if m.CAFile != "" {
+		pool, err := loadCertPool(m.CAFile)
+		if err != nil {
+			return fmt.Errorf("invalid ca_file: %w", err)
+		}
+		m.rootCAs = pool
+	}
+	for i := range m.Fallbacks {
+		if err := m.Fallbacks[i].load(); err != nil {
+			return fmt.Errorf("fallback #%d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// load loads the private key of the DKIM settings provided.
+func (d *dkim) load() error {
+	key, err := sender.LoadDKIMKey(d.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("invalid private_key: %w", err)
+	}
+	d.key = key
+	return nil
+}
+
+// load loads the encrypter of the key of the encryption settings provided.
+func (e *encryption) load() error {
+	if e.OpenPGPKey != "" {
+		o, err := sender.LoadOpenPGPKeys(e.OpenPGPKey)
+		if err != nil {
+			return fmt.Errorf("invalid openpgp_key: %w", err)
+		}
+		e.encrypter = o
+		return nil
+	}
+
+	smime, err := sender.LoadSMIMECertificates(e.SMIMECertificate)
+	if err != nil {
+		return fmt.Errorf("invalid smime_certificate: %w", err)
+	}
+	e.encrypter = smime
+	return nil
+}
+
+// load compiles the patterns of the keywords settings provided.
+func (k *spamKeywords) load() error {
+	k.patterns = make([]*regexp.Regexp, len(k.Patterns))
+	for i, p := range k.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("invalid pattern \"%s\": %w", p, err)
+		}
+		k.patterns[i] = re
+	}
+	return nil
+}
+
+// loadCertPool returns a pool with the PEM encoded certificates of the file in the path provided.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in \"%s\"", path)
+	}
+	return pool, nil
+}
+
+// recipients returns the default recipients of the forms of the site provided sent via SMTP,
+// which are the "recipients" table or, if it has no "to" addresses, the "mailto" of the "mail" table.
+func (s *site) recipients() sender.Recipients {
+	r := sender.Recipients{To: s.Recipients.To, Cc: s.Recipients.Cc, Bcc: s.Recipients.Bcc}
+	if len(r.To) == 0 && s.Mail.Mailto != "" {
+		r.To = []string{s.Mail.Mailto}
+	}
+	return r
+}
+
+// routes returns the routing rules of the forms of the site provided sent via SMTP.
+func (s *site) routes() []sender.Route {
+	routes := make([]sender.Route, len(s.Routes))
+	for i, r := range s.Routes {
+		routes[i] = sender.Route{
+			Field:      r.Field,
+			Value:      r.Value,
+			Recipients: sender.Recipients{To: r.To, Cc: r.Cc, Bcc: r.Bcc},
+		}
+	}
+	return routes
+}
+
+// MaxRequestSize returns the maximum size of a request with a form of any of the sites.
+func (c *Config) MaxRequestSize() int64 {
+	var size int64
+	for _, s := range c.Sites {
+		if siteSize := s.Schema.MaxRequestSize(); siteSize > size {
+			size = siteSize
+		}
+	}
+	return size
+}
+
+// Site returns the site with the ID provided, or nil if there is none.
+func (c *Config) Site(id string) *Site {
+	for _, s := range c.Sites {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// SiteByHost returns the site that serves the host provided, or nil if there is none.
+// The port of the host, if any, is ignored.
+func (c *Config) SiteByHost(host string) *Site {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, s := range c.Sites {
+		for _, h := range s.Hosts {
+			if strings.EqualFold(h, host) {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+// TrustedProxy checks if the IP address provided belongs to a trusted reverse proxy.
+func (c *Config) TrustedProxy(ip net.IP) bool {
+	for _, n := range c.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// queue returns the queue described by the config provided after checking that it's valid,
+// or nil if there is none.
+// The queue cannot be used with sites with encryption, because it stores the forms unencrypted on disk.
+func (c *config) queue(sites []site) (*queue.Queue, error) {
+	if c.Queue == nil {
+		return nil, nil
+	}
+
+	q := &queue.Queue{
+		Dir:            c.Queue.Dir,
+		MaxAttempts:    c.Queue.MaxAttempts,
+		InitialBackoff: c.Queue.InitialBackoff,
+		MaxBackoff:     c.Queue.MaxBackoff,
+	}
+	if q.MaxAttempts == 0 {
+		q.MaxAttempts = defaultMaxAttempts
+	}
+	if q.InitialBackoff == 0 {
+		q.InitialBackoff = defaultInitialBackoff
+	}
+	if q.MaxBackoff == 0 {
+		q.MaxBackoff = defaultMaxBackoff
+	}
+
+	if q.Dir == "" {
+		return nil, errors.New("empty queue dir")
+	}
+	if q.MaxAttempts < 1 {
+		return nil, errors.New("invalid queue max_attempts")
+	}
+	if q.InitialBackoff < 0 {
+		return nil, errors.New("invalid queue initial_backoff")
+	}
+	if q.MaxBackoff < q.InitialBackoff {
+		return nil, errors.New("queue max_backoff is lower than initial_backoff")
+	}
+	for _, s := range sites {
+		if s.Encryption != nil {
+			return nil, fmt.Errorf("site \"%s\": encryption cannot be used with the queue, it would store the forms unencrypted", s.ID)
+		}
+	}
+	return q, nil
+}
+
+// smtpPool returns the pool of SMTP connections described by the config provided after checking that it's valid,
+// or nil if there is none.
+func (c *config) smtpPool() (*sender.Pool, error) {
+	if c.SMTPPool == nil {
+		return nil, nil
+	}
+
+	if c.SMTPPool.MaxConnections < 0 {
+		return nil, errors.New("invalid smtp_pool max_connections")
+	}
+	if c.SMTPPool.MaxMessages < 0 {
+		return nil, errors.New("invalid smtp_pool max_messages")
+	}
+	if c.SMTPPool.IdleTimeout < 0 {
+		return nil, errors.New("invalid smtp_pool idle_timeout")
+	}
+	return &sender.Pool{
+		MaxConns:    c.SMTPPool.MaxConnections,
+		MaxMessages: c.SMTPPool.MaxMessages,
+		IdleTimeout: c.SMTPPool.IdleTimeout,
+	}, nil
+}
+
+// trustedProxies returns the networks of the trusted proxies of the config provided after checking that they are valid.
+// Each proxy can be an IP address or a network in CIDR notation.
+func (c *config) trustedProxies() ([]*net.IPNet, error) {
+	proxies := make([]*net.IPNet, 0, len(c.TrustedProxies))
+	for _, p := range c.TrustedProxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy \"%s\"", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy \"%s\"", p)
+		}
+		proxies = append(proxies, n)
+	}
+	return proxies, nil
+}
+
+// sites returns the list of sites described by the config provided after checking that they are valid.
+func (c *config) sites() ([]site, error) {
+	if len(c.Sites) == 0 {
+		s := site{ID: defaultSiteID, SiteSettings: c.SiteSettings}
+		if err := checkValidInput(&s); err != nil {
+			return nil, err
+		}
+		return []site{s}, nil
+	}
+
+	if !reflect.DeepEqual(c.SiteSettings, SiteSettings{}) {
+		return nil, errors.New("top level site fields cannot be used together with sites")
+	}
+
+	ids := make(map[string]bool, len(c.Sites))
+	hosts := make(map[string]string)
+	for i := range c.Sites {
+		s := &c.Sites[i]
+		if err := checkValidInput(s); err != nil {
+			return nil, fmt.Errorf("site #%d: %w", i+1, err)
+		}
+		if ids[s.ID] {
+			return nil, fmt.Errorf("site #%d: duplicated id \"%s\"", i+1, s.ID)
+		}
+		ids[s.ID] = true
+
+		for _, h := range s.Hosts {
+			h = strings.ToLower(h)
+			if other, ok := hosts[h]; ok {
+				return nil, fmt.Errorf("site \"%s\": host \"%s\" already used by site \"%s\"", s.ID, h, other)
+			}
+			hosts[h] = s.ID
+		}
+	}
+	return c.Sites, nil
+}
+
+// checkValidInput checks if all the fields in the site provided are valid
+func checkValidInput(s *site) error {
+	if !regexSiteID.MatchString(s.ID) {
+		return fmt.Errorf("invalid id \"%s\"", s.ID)
+	}
+	for _, h := range s.Hosts {
+		if h == "" {
+			return errors.New("empty host")
+		}
+	}
+	if s.WebName == "" {
 		return errors.New("empty web_name")
 	}
-	if c.RecaptchaSecret == "" {
-		return errors.New("empty recaptcha_secret")
+	if err := checkValidCaptcha(s); err != nil {
+		return err
+	}
+	for _, page := range []string{s.SuccessURL, s.ErrorURL} {
+		if _, err := url.Parse(page); err != nil {
+			return fmt.Errorf("invalid page URL \"%s\"", page)
+		}
+	}
+	if strings.ContainsAny(s.FromName, "\r\n") {
+		return errors.New("invalid from_name")
 	}
-	if c.Mail.Mailto == "" {
+	if err := checkValidFields(s.Fields, s.captchaField()); err != nil {
+		return err
+	}
+	if s.Traps != nil {
+		if err := checkValidTraps(s); err != nil {
+			return fmt.Errorf("traps: %w", err)
+		}
+	}
+	if s.Spam != nil {
+		if err := checkValidSpam(s.Spam); err != nil {
+			return fmt.Errorf("spam: %w", err)
+		}
+	}
+	if s.SpamDaemon != nil {
+		if err := checkValidSpamDaemon(s); err != nil {
+			return fmt.Errorf("spam_daemon: %w", err)
+		}
+	}
+	if s.RateLimit != nil {
+		if err := checkValidRateLimits(s.RateLimit); err != nil {
+			return fmt.Errorf("rate_limit: %w", err)
+		}
+	}
+	if s.DKIM != nil {
+		if err := checkValidDKIM(s.DKIM); err != nil {
+			return fmt.Errorf("dkim: %w", err)
+		}
+	}
+	if s.Encryption != nil {
+		if err := checkValidEncryption(s.Encryption); err != nil {
+			return fmt.Errorf("encryption: %w", err)
+		}
+	}
+	if s.AutoReply != nil {
+		if err := checkValidAutoReply(s.AutoReply, &s.Mail); err != nil {
+			return err
+		}
+	}
+	if s.Sender != nil && len(s.Senders) != 0 {
+		return errors.New("sender and senders cannot be used together")
+	}
+
+	names := make(map[string]bool, len(s.Senders))
+	backends := s.backends()
+	for i := range backends {
+		b := &backends[i]
+		if err := checkValidBackend(b, &s.Mail); err != nil {
+			return err
+		}
+		if b.Type == backendSMTP {
+			if err := checkValidRecipients(s); err != nil {
+				return err
+			}
+		}
+		if names[b.name()] {
+			return fmt.Errorf("duplicated sender name \"%s\"", b.name())
+		}
+		names[b.name()] = true
+	}
+	return nil
+}
+
+// checkValidFields checks if all the fields of the form schema provided are valid.
+// The names of the fields cannot be the one of the field with the captcha response provided.
+func checkValidFields(fields []field, captchaField string) error {
+	names := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		if !regexFieldName.MatchString(f.Name) || f.Name == api.FieldSite || f.Name == api.FieldRecaptcha || f.Name == captchaField {
+			return fmt.Errorf("invalid field name \"%s\"", f.Name)
+		}
+		if names[f.Name] {
+			return fmt.Errorf("duplicated field \"%s\"", f.Name)
+		}
+		names[f.Name] = true
+
+		if !form.ValidType(form.Type(f.Type)) {
+			return fmt.Errorf("invalid type \"%s\" for field \"%s\"", f.Type, f.Name)
+		}
+		if f.MaxLength < 0 {
+			return fmt.Errorf("invalid max_length for field \"%s\"", f.Name)
+		}
+		if (f.Type == string(form.TypeSelect)) != (len(f.Values) != 0) {
+			return fmt.Errorf("values must be declared for select fields only (field \"%s\")", f.Name)
+		}
+		if f.Type != string(form.TypeFile) && (f.MaxSize != 0 || f.MaxCount != 0 || len(f.MimeTypes) != 0) {
+			return fmt.Errorf("max_size, max_count and mime_types are only allowed in file fields (field \"%s\")", f.Name)
+		}
+		if f.MaxSize < 0 || f.MaxCount < 0 {
+			return fmt.Errorf("invalid max_size or max_count for field \"%s\"", f.Name)
+		}
+		for _, t := range f.MimeTypes {
+			if _, _, err := mime.ParseMediaType(t); err != nil && !strings.HasSuffix(t, "/*") {
+				return fmt.Errorf("invalid mime type \"%s\" for field \"%s\"", t, f.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// checkValidRecipients checks if the recipients and the routes of the site provided are valid.
+// The forms must have recipients when no route matches, in the "mailto" of the "mail" table
+// or in the "recipients" table.
+func checkValidRecipients(s *site) error {
+	if s.Mail.Mailto != "" && len(s.Recipients.To) != 0 {
+		return errors.New("mailto and recipients cannot be used together")
+	}
+	if s.Mail.Mailto == "" && len(s.Recipients.To) == 0 {
 		return errors.New("empty mailto")
 	}
-	if c.Mail.Username == "" {
-		return errors.New("empty username")
+	if err := checkValidAddresses([]string{s.Mail.Mailto}, s.Recipients.To, s.Recipients.Cc, s.Recipients.Bcc); err != nil {
+		return err
+	}
+
+	schema := s.schema()
+	for i, r := range s.Routes {
+		found := false
+		for _, f := range schema {
+			found = found || f.Name == r.Field
+		}
+		if !found {
+			return fmt.Errorf("route #%d: unknown field \"%s\"", i+1, r.Field)
+		}
+		if len(r.To) == 0 {
+			return fmt.Errorf("route #%d: empty to", i+1)
+		}
+		if err := checkValidAddresses(r.To, r.Cc, r.Bcc); err != nil {
+			return fmt.Errorf("route #%d: %w", i+1, err)
+		}
 	}
-	if c.Mail.Password == "" {
-		return errors.New("empty password")
+	return nil
+}
+
+// checkValidAddresses checks if the email addresses of the lists provided, which can have a display name, are valid.
+// Empty addresses are ignored.
+func checkValidAddresses(lists ...[]string) error {
+	for _, list := range lists {
+		for _, a := range list {
+			if _, err := netmail.ParseAddress(a); a != "" && err != nil {
+				return fmt.Errorf("invalid address \"%s\"", a)
+			}
+		}
 	}
-	if c.Mail.SmtpServer == "" {
+	return nil
+}
+
+// checkValidCaptcha checks if the captcha of the site provided is valid. Sites must have either a recaptcha_secret
+// (reCAPTCHA v2) or a captcha, whose secret is required unless its provider is "none".
+func checkValidCaptcha(s *site) error {
+	if s.Captcha == nil {
+		if s.RecaptchaSecret == "" {
+			return errors.New("empty recaptcha_secret")
+		}
+		return nil
+	}
+	if s.RecaptchaSecret != "" {
+		return errors.New("recaptcha_secret and captcha cannot be used together")
+	}
+
+	c := s.Captcha
+	switch c.Provider {
+	case captcha.ProviderRecaptchaV2, captcha.ProviderRecaptchaV3, captcha.ProviderHCaptcha, captcha.ProviderTurnstile:
+		if c.Secret == "" {
+			return errors.New("captcha: empty secret")
+		}
+	case captcha.ProviderNone:
+		if c.Secret != "" || c.Field != "" {
+			return errors.New("captcha: secret and field cannot be used with provider \"none\"")
+		}
+	default:
+		return fmt.Errorf("captcha: invalid provider \"%s\"", c.Provider)
+	}
+	if c.Field != "" && (!regexFieldName.MatchString(c.Field) || c.Field == api.FieldSite) {
+		return fmt.Errorf("captcha: invalid field \"%s\"", c.Field)
+	}
+
+	if c.Provider != captcha.ProviderRecaptchaV3 {
+		if c.MinScore != 0 || len(c.Actions) != 0 || len(c.Hostnames) != 0 || c.MaxAge != 0 {
+			return errors.New("captcha: min_score, actions, hostnames and max_age are only allowed with provider \"recaptcha_v3\"")
+		}
+		return nil
+	}
+	if c.MinScore < 0 || c.MinScore > 1 {
+		return errors.New("captcha: min_score must be between 0 and 1")
+	}
+	if c.MaxAge < 0 {
+		return errors.New("captcha: invalid max_age")
+	}
+	for _, list := range [][]string{c.Actions, c.Hostnames} {
+		for _, v := range list {
+			if v == "" {
+				return errors.New("captcha: empty action or hostname")
+			}
+		}
+	}
+	return nil
+}
+
+// checkValidTraps checks if the traps of the site provided are valid. The honeypot fields and the token field
+// cannot be the fields of the form, the captcha field or other reserved fields. The fields of the site must be valid.
+func checkValidTraps(s *site) error {
+	t := s.Traps
+	reserved := map[string]bool{api.FieldSite: true, api.FieldRecaptcha: true, s.captchaField(): true}
+	for _, f := range s.schema() {
+		reserved[f.Name] = true
+	}
+
+	fields := append([]string{}, t.HoneypotFields...)
+	if t.TokenSecret != "" {
+		tokenField := t.TokenField
+		if tokenField == "" {
+			tokenField = defaultTokenField
+		}
+		fields = append(fields, tokenField)
+	} else if t.TokenField != "" || t.MinTime != 0 || t.MaxAge != 0 {
+		return errors.New("token_field, min_time and max_age are only allowed with token_secret")
+	}
+	for _, f := range fields {
+		if !regexFieldName.MatchString(f) || reserved[f] {
+			return fmt.Errorf("invalid field \"%s\"", f)
+		}
+		reserved[f] = true
+	}
+
+	if t.TokenSecret != "" && len(t.TokenSecret) < minTokenSecretLength {
+		return fmt.Errorf("token_secret shorter than %d characters", minTokenSecretLength)
+	}
+	if t.MinTime < 0 || t.MaxAge < 0 {
+		return errors.New("invalid min_time or max_age")
+	}
+	minTime := t.MinTime
+	if minTime == 0 {
+		minTime = defaultTokenMinTime
+	}
+	if t.MaxAge != 0 && t.MaxAge <= minTime {
+		return errors.New("max_age must be greater than min_time")
+	}
+	return nil
+}
+
+// checkValidSpam checks if the spam settings provided are valid. At least one of the thresholds must be set,
+// and the scores of the rules must be positive.
+func checkValidSpam(sp *spamSettings) error {
+	if sp.TagScore < 0 || sp.RejectScore < 0 {
+		return errors.New("invalid tag_score or reject_score")
+	}
+	if sp.TagScore == 0 && sp.RejectScore == 0 {
+		return errors.New("empty tag_score and reject_score")
+	}
+	if sp.TagScore > 0 && sp.RejectScore > 0 && sp.RejectScore <= sp.TagScore {
+		return errors.New("reject_score must be greater than tag_score")
+	}
+
+	scores := make(map[string]float64)
+	if l := sp.Links; l != nil {
+		scores["links"] = l.Score
+		if l.Max < 0 {
+			return errors.New("links: invalid max")
+		}
+	}
+	if k := sp.Keywords; k != nil {
+		scores["keywords"] = k.Score
+		if len(k.Words) == 0 && len(k.Patterns) == 0 {
+			return errors.New("keywords: empty words and patterns")
+		}
+		for _, w := range k.Words {
+			if strings.TrimSpace(w) == "" {
+				return errors.New("keywords: empty word")
+			}
+		}
+	}
+	if sc := sp.Scripts; sc != nil {
+		scores["scripts"] = sc.Score
+		if len(sc.Blocked) == 0 {
+			return errors.New("scripts: empty blocked")
+		}
+		for _, name := range sc.Blocked {
+			if unicode.Scripts[name] == nil {
+				return fmt.Errorf("scripts: unknown script \"%s\"", name)
+			}
+		}
+	}
+	if c := sp.Caps; c != nil {
+		scores["caps"] = c.Score
+		if c.MaxRatio < 0 || c.MaxRatio >= 1 || c.MinLetters < 0 {
+			return errors.New("caps: invalid max_ratio or min_letters")
+		}
+	}
+	if d := sp.DisposableDomains; d != nil {
+		scores["disposable_domains"] = d.Score
+		for _, domain := range d.Domains {
+			if domain == "" || strings.ContainsAny(domain, "@ ") {
+				return fmt.Errorf("disposable_domains: invalid domain \"%s\"", domain)
+			}
+		}
+	}
+	if r := sp.Repeated; r != nil {
+		scores["repeated"] = r.Score
+		if r.Max < 0 || r.Period < 0 {
+			return errors.New("repeated: invalid max or period")
+		}
+	}
+
+	if len(scores) == 0 {
+		return errors.New("no rules")
+	}
+	for rule, score := range scores {
+		if score <= 0 {
+			return fmt.Errorf("%s: invalid score", rule)
+		}
+	}
+	return nil
+}
+
+// checkValidSpamDaemon checks if the spam daemon of the site provided is valid. The site must be delivered via SMTP,
+// since the messages checked are the ones of its SMTP backend.
+func checkValidSpamDaemon(s *site) error {
+	sd := s.SpamDaemon
+	switch sd.Type {
+	case daemonSpamd:
+		if sd.URL != "" || sd.Password != "" {
+			return errors.New("url and password are only allowed with rspamd")
+		}
+		if strings.ContainsAny(sd.User, "\r\n") {
+			return errors.New("invalid user")
+		}
+	case daemonRspamd:
+		if sd.Address != "" || sd.User != "" {
+			return errors.New("address and user are only allowed with spamd")
+		}
+		if sd.URL != "" {
+			if u, err := url.Parse(sd.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return errors.New("invalid url")
+			}
+		}
+		if strings.ContainsAny(sd.Password, "\r\n") {
+			return errors.New("invalid password")
+		}
+	case "":
+		return errors.New("empty type")
+	default:
+		return fmt.Errorf("unknown type \"%s\"", sd.Type)
+	}
+	if sd.Timeout < 0 {
+		return errors.New("invalid timeout")
+	}
+
+	switch sd.Action {
+	case "", spam.ActionHeaders, spam.ActionTag, spam.ActionReject:
+		if sd.Quarantine != "" {
+			return errors.New("quarantine is only allowed with the quarantine action")
+		}
+	case spam.ActionQuarantine:
+		if sd.Quarantine == "" {
+			return errors.New("empty quarantine")
+		}
+		// The quarantine stores the forms unencrypted on disk
+		if s.Encryption != nil {
+			return errors.New("quarantine cannot be used with encryption")
+		}
+	default:
+		return fmt.Errorf("unknown action \"%s\"", sd.Action)
+	}
+
+	for _, b := range s.backends() {
+		if b.Type == backendSMTP {
+			return nil
+		}
+	}
+	return errors.New("no smtp sender")
+}
+
+// checkValidRateLimits checks if the rate limits provided are valid. At least one of them must be set.
+func checkValidRateLimits(rl *rateLimits) error {
+	var n int
+	for name, l := range rl.limits() {
+		if l == nil {
+			continue
+		}
+		n++
+		if l.Limit < 1 || l.Period <= 0 {
+			return fmt.Errorf("%s: invalid limit or period", name)
+		}
+	}
+	if n == 0 {
+		return errors.New("no limits")
+	}
+	return nil
+}
+
+// checkValidEncryption checks if the encryption settings provided have exactly one key.
+func checkValidEncryption(e *encryption) error {
+	if e.OpenPGPKey != "" && e.SMIMECertificate != "" {
+		return errors.New("openpgp_key and smime_certificate cannot be used together")
+	}
+	if e.OpenPGPKey == "" && e.SMIMECertificate == "" {
+		return errors.New("empty openpgp_key and smime_certificate")
+	}
+	return nil
+}
+
+// checkValidDKIM checks if all the fields in the DKIM settings provided are valid.
+func checkValidDKIM(d *dkim) error {
+	if d.Domain == "" {
+		return errors.New("empty domain")
+	}
+	if d.Selector == "" {
+		return errors.New("empty selector")
+	}
+	if d.PrivateKey == "" {
+		return errors.New("empty private_key")
+	}
+
+	if d.Canonicalization != "" {
+		header, body := d.canonicalization()
+		for _, c := range []string{header, body} {
+			if c != sender.CanonicalizationSimple && c != sender.CanonicalizationRelaxed {
+				return fmt.Errorf("invalid canonicalization \"%s\"", d.Canonicalization)
+			}
+		}
+	}
+
+	if len(d.Headers) == 0 {
+		return nil
+	}
+	from := false
+	for _, h := range d.Headers {
+		if h == "" || strings.ContainsAny(h, ": \t\r\n") {
+			return fmt.Errorf("invalid header \"%s\"", h)
+		}
+		from = from || strings.EqualFold(h, "From")
+	}
+	if !from {
+		return errors.New("headers must include From")
+	}
+	return nil
+}
+
+// checkValidAutoReply checks if all the fields in the autoreply provided are valid,
+// and if the mail provided, which is used to send the acknowledgements, is valid.
+func checkValidAutoReply(ar *autoReply, m *mail) error {
+	if ar.RateLimit < 0 {
+		return errors.New("invalid autoreply rate_limit")
+	}
+	if ar.IPRateLimit < 0 {
+		return errors.New("invalid autoreply ip_rate_limit")
+	}
+	if ar.GlobalRateLimit < 0 {
+		return errors.New("invalid autoreply global_rate_limit")
+	}
+	if ar.RatePeriod < 0 {
+		return errors.New("invalid autoreply rate_period")
+	}
+	if err := checkValidMail(m); err != nil {
+		return fmt.Errorf("autoreply: %w", err)
+	}
+	return nil
+}
+
+// checkValidBackend checks if all the fields in the backend provided are valid.
+// The mail provided is checked if the backend is SMTP.
+func checkValidBackend(b *backend, m *mail) error {
+	if b.Policy != "" && b.Policy != policyRequired && b.Policy != policyBestEffort {
+		return fmt.Errorf("invalid policy \"%s\" for sender \"%s\"", b.Policy, b.name())
+	}
+
+	switch b.Type {
+	case backendSMTP:
+		return checkValidMail(m)
+	case backendWebhook, backendSlack, backendMattermost, backendDiscord:
+		if b.URL == "" {
+			return fmt.Errorf("empty url for %s sender", b.Type)
+		}
+		if u, err := url.Parse(b.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid url for %s sender", b.Type)
+		}
+	case backendMaildir, backendMbox:
+		if b.Path == "" {
+			return fmt.Errorf("empty path for %s sender", b.Type)
+		}
+	case backendStdout:
+	case "":
+		return errors.New("empty sender type")
+	default:
+		return fmt.Errorf("unknown sender type \"%s\"", b.Type)
+	}
+	return nil
+}
+
+// checkValidMail checks if all the fields in the SMTP account provided, and in its fallbacks, are valid.
+func checkValidMail(m *mail) error {
+	if err := checkValidAccount(m); err != nil {
+		return err
+	}
+	if m.From != "" {
+		if addr, err := netmail.ParseAddress(m.From); err != nil || addr.Name != "" || addr.Address != m.From {
+			return errors.New("invalid from")
+		}
+	} else if m.Username == "" {
+		return errors.New("empty from")
+	}
+
+	if m.Cooldown < 0 {
+		return errors.New("invalid cooldown")
+	}
+	for i := range m.Fallbacks {
+		fb := &m.Fallbacks[i]
+		if fb.Mailto != "" || fb.From != "" || len(fb.Fallbacks) != 0 || fb.Cooldown != 0 {
+			return fmt.Errorf("fallback #%d: mailto, from, fallbacks and cooldown are not allowed", i+1)
+		}
+		if err := checkValidAccount(fb); err != nil {
+			return fmt.Errorf("fallback #%d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// checkValidAccount checks if the credentials and the connection settings of the SMTP account provided are valid.
+func checkValidAccount(m *mail) error {
+	switch m.Auth {
+	case "", sender.AuthPlain, sender.AuthLogin, sender.AuthCRAMMD5, sender.AuthXOAUTH2:
+		if m.Username == "" {
+			return errors.New("empty username")
+		}
+		if m.Password == "" {
+			return errors.New("empty password")
+		}
+	case sender.AuthNone:
+	default:
+		return fmt.Errorf("unknown auth \"%s\"", m.Auth)
+	}
+	if m.SmtpServer == "" {
 		return errors.New("empty smtp_server")
 	}
-	if c.Mail.Port < 1 || c.Mail.Port > 65535 {
+	if m.Port < 1 || m.Port > 65535 {
 		return errors.New("invalid port")
 	}
+
+	switch m.TLS {
+	case "", sender.TLSOpportunistic, sender.TLSStartTLS, sender.TLSImplicit, sender.TLSNone:
+	default:
+		return fmt.Errorf("unknown tls mode \"%s\"", m.TLS)
+	}
+	if strings.ContainsAny(m.HELO, " \t\r\n") {
+		return errors.New("invalid helo")
+	}
+	if m.DialTimeout < 0 {
+		return errors.New("invalid dial_timeout")
+	}
+	if m.CommandTimeout < 0 {
+		return errors.New("invalid command_timeout")
+	}
 	return nil
 }
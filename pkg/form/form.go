@@ -0,0 +1,77 @@
+package form
+
+// Package form manages the forms received by ptemplate-form-handler and the schemas they are validated against.
+
+import "time"
+
+// Form represents a form received by ptemplate-form-handler, already validated and sanitized.
+// It contains a value for each field declared in the schema of the site, in the same order,
+// and the files uploaded to its file fields.
+//
+// Submitted, ClientIP and RequestID describe the request the form was received in. They are set by the server,
+// like Spam, which tells that the form is probably spam, so it's tagged when delivered, and Headers,
+// which are extra header fields of the messages with the form, like the verdict of a spam daemon.
+type Form struct {
+	Values    []Value           `json:"values"`
+	Files     []File            `json:"files,omitempty"`
+	Submitted time.Time         `json:"submitted"`
+	ClientIP  string            `json:"client_ip,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	Spam      bool              `json:"spam,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+}
+
+// File represents a file uploaded to a file field of a form.
+// ContentType is sniffed from the file content, so it's not the one declared by the client.
+type File struct {
+	Field       string `json:"field"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+}
+
+// Value represents the value of a field of a form.
+type Value struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	Type  Type   `json:"type"`
+	Value string `json:"value"`
+}
+
+// Get returns the value of the field with the name provided, or an empty string if there is none.
+func (f *Form) Get(name string) string {
+	for _, v := range f.Values {
+		if v.Name == name {
+			return v.Value
+		}
+	}
+	return ""
+}
+
+// Email returns the first non-empty email of the form, which is considered the address of the submitter.
+// It returns an empty string if there is none.
+func (f *Form) Email() string {
+	for _, v := range f.Values {
+		if v.Type == TypeEmail && v.Value != "" {
+			return v.Value
+		}
+	}
+	return ""
+}
+
+// Name returns the value of the field "name", which is considered the name of the submitter.
+// It returns an empty string if there is none.
+func (f *Form) Name() string {
+	return f.Get("name")
+}
+
+// Display returns the value formatted to be shown to humans.
+func (v *Value) Display() string {
+	if v.Type != TypeBoolean {
+		return v.Value
+	}
+	if v.Value == "true" {
+		return "Yes"
+	}
+	return "No"
+}
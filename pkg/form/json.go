@@ -0,0 +1,45 @@
+package form
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// FromJSON converts the fields of a decoded JSON object into the values that Schema.Parse accepts.
+// Strings, numbers and booleans are converted to strings, arrays to multiple values and null is ignored.
+func FromJSON(fields map[string]interface{}) (map[string][]string, error) {
+	values := make(map[string][]string, len(fields))
+	for name, field := range fields {
+		list, ok := field.([]interface{})
+		if !ok {
+			list = []interface{}{field}
+		}
+
+		for _, item := range list {
+			if item == nil {
+				continue
+			}
+			v, err := jsonString(item)
+			if err != nil {
+				return nil, fmt.Errorf("field \"%s\": %w", name, err)
+			}
+			values[name] = append(values[name], v)
+		}
+	}
+	return values, nil
+}
+
+// jsonString returns the JSON scalar provided as a string.
+func jsonString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", errors.New("unsupported value")
+	}
+}
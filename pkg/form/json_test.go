@@ -0,0 +1,37 @@
+package form_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"testing"
+)
+
+func TestFromJSON(t *testing.T) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(`{"name": "John", "age": 30.5, "consent": true, "tags": ["a", "b"], "empty": null}`), &fields); err != nil {
+		t.Fatalf("error parsing JSON: %s", err)
+	}
+
+	values, err := form.FromJSON(fields)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := map[string]string{
+		"name":    "[John]",
+		"age":     "[30.5]",
+		"consent": "[true]",
+		"tags":    "[a b]",
+		"empty":   "[]",
+	}
+	for name, v := range expected {
+		if result := fmt.Sprint(values[name]); result != v {
+			t.Errorf("unexpected values of field \"%s\": expected %s - found %s", name, v, result)
+		}
+	}
+
+	if _, err = form.FromJSON(map[string]interface{}{"name": map[string]interface{}{}}); err == nil {
+		t.Error("no error found for object value")
+	}
+}
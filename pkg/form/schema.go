@@ -0,0 +1,288 @@
+package form
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg/sanitation"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Type represents the type of a field of a form.
+type Type string
+
+// Types of fields that can be declared in a schema.
+const (
+	TypeText      Type = "text"
+	TypeEmail     Type = "email"
+	TypeMultiline Type = "multiline"
+	TypeSelect    Type = "select"
+	TypeBoolean   Type = "boolean"
+	TypeNumber    Type = "number"
+	TypeFile      Type = "file"
+)
+
+const (
+	// DefaultMaxSize is the maximum size of each file of a file field if none is declared.
+	DefaultMaxSize = 10 << 20
+
+	// maxFieldsSize is the maximum size of the non-file fields of a form.
+	maxFieldsSize = 1 << 20
+)
+
+var (
+	// ErrTooLarge is returned when an uploaded file is larger than allowed.
+	ErrTooLarge = errors.New("file too large")
+	// ErrTypeNotAllowed is returned when the type of an uploaded file is not allowed.
+	ErrTypeNotAllowed = errors.New("file type not allowed")
+
+	errTooManyFiles   = errors.New("too many files")
+	errRequired       = errors.New("required")
+	errInvalidEmail   = errors.New("invalid email")
+	errNotAllowed     = errors.New("value not allowed")
+	errInvalidNumber  = errors.New("invalid number")
+	errInvalidBoolean = errors.New("invalid boolean")
+)
+
+// Field represents a field declared in a schema.
+//
+// MaxLength is the maximum number of characters of the value, or 0 for no limit.
+// Values are the allowed values of select fields.
+// Required boolean fields must be true, like the checkbox to accept a privacy policy.
+//
+// File fields accept up to MaxCount files (1 if 0) of MaxSize bytes each (DefaultMaxSize if 0),
+// whose sniffed type must match MimeTypes (e.g. "application/pdf" or "image/*"). Any type is allowed if it's empty.
+type Field struct {
+	Name      string
+	Label     string
+	Type      Type
+	Required  bool
+	MaxLength int
+	Values    []string
+	MaxSize   int64
+	MaxCount  int
+	MimeTypes []string
+}
+
+// Schema represents the list of fields that the forms of a site have.
+type Schema []Field
+
+// DefaultSchema is the schema of the forms of ptemplate: a name, a required email and a message.
+var DefaultSchema = Schema{
+	{Name: "name", Label: "Name", Type: TypeText},
+	{Name: "mail", Label: "Email", Type: TypeEmail, Required: true},
+	{Name: "msg", Label: "Message", Type: TypeMultiline},
+}
+
+// ValidType checks if the type provided is a known field type.
+func ValidType(t Type) bool {
+	switch t {
+	case TypeText, TypeEmail, TypeMultiline, TypeSelect, TypeBoolean, TypeNumber, TypeFile:
+		return true
+	}
+	return false
+}
+
+// MaxRequestSize returns the maximum size of a request with a form of the schema,
+// taking into account the files it can have.
+func (s Schema) MaxRequestSize() int64 {
+	size := int64(maxFieldsSize)
+	for i := range s {
+		if s[i].Type == TypeFile {
+			size += s[i].maxSize() * int64(s[i].maxCount())
+		}
+	}
+	return size
+}
+
+// Parse validates the values and files provided against the schema, and returns a form with the sanitized values
+// of the fields of the schema and its files. Values and files of fields not declared in the schema are ignored.
+//
+// The files provided only need the Filename and Data fields, the rest of them are set by Parse.
+// If a file is too large or has a type not allowed, the error returned wraps ErrTooLarge or ErrTypeNotAllowed.
+func (s Schema) Parse(values map[string][]string, files map[string][]*File) (*Form, error) {
+	f := &Form{Values: make([]Value, 0, len(s))}
+	for i := range s {
+		field := &s[i]
+		if field.Type == TypeFile {
+			fieldFiles, err := field.parseFiles(files[field.Name])
+			if err != nil {
+				return nil, fmt.Errorf("field \"%s\": %w", field.Name, err)
+			}
+
+			names := make([]string, len(fieldFiles))
+			for j := range fieldFiles {
+				names[j] = fieldFiles[j].Filename
+			}
+			f.Files = append(f.Files, fieldFiles...)
+			f.Values = append(f.Values, Value{
+				Name:  field.Name,
+				Label: field.Label,
+				Type:  field.Type,
+				Value: strings.Join(names, ", "),
+			})
+			continue
+		}
+
+		vs := values[field.Name]
+		if len(vs) > 1 {
+			return nil, fmt.Errorf("field \"%s\": multiple values", field.Name)
+		}
+
+		var v string
+		if len(vs) == 1 {
+			v = vs[0]
+		}
+		v, err := field.parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("field \"%s\": %w", field.Name, err)
+		}
+
+		f.Values = append(f.Values, Value{
+			Name:  field.Name,
+			Label: field.Label,
+			Type:  field.Type,
+			Value: v,
+		})
+	}
+	return f, nil
+}
+
+// parse validates the value provided against the field, and returns it sanitized and normalized.
+func (field *Field) parse(v string) (string, error) {
+	if field.Type == TypeMultiline {
+		v = strings.TrimSpace(sanitation.SanitizeMsg(v))
+	} else {
+		v = strings.TrimSpace(sanitation.SanitizeName(v))
+	}
+
+	if field.Type == TypeBoolean {
+		return parseBoolean(v, field.Required)
+	}
+
+	if v == "" {
+		if field.Required {
+			return "", errRequired
+		}
+		return "", nil
+	}
+
+	if field.MaxLength > 0 && utf8.RuneCountInString(v) > field.MaxLength {
+		return "", fmt.Errorf("longer than %d characters", field.MaxLength)
+	}
+
+	switch field.Type {
+	case TypeEmail:
+		if !sanitation.IsValidMail(v) {
+			return "", errInvalidEmail
+		}
+	case TypeSelect:
+		if !contains(field.Values, v) {
+			return "", errNotAllowed
+		}
+	case TypeNumber:
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return "", errInvalidNumber
+		}
+		v = strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	return v, nil
+}
+
+// parseFiles validates the files provided against the file field, and returns them with their type sniffed.
+func (field *Field) parseFiles(files []*File) ([]File, error) {
+	if len(files) == 0 && field.Required {
+		return nil, errRequired
+	}
+	if len(files) > field.maxCount() {
+		return nil, errTooManyFiles
+	}
+
+	parsed := make([]File, 0, len(files))
+	for _, file := range files {
+		filename := strings.TrimSpace(sanitation.SanitizeName(filepath.Base(strings.Replace(file.Filename, "\\", "/", -1))))
+		if filename == "" || filename == "." || filename == "/" {
+			filename = "file"
+		}
+
+		if int64(len(file.Data)) > field.maxSize() {
+			return nil, fmt.Errorf("%w: %s", ErrTooLarge, filename)
+		}
+
+		contentType, _, _ := mime.ParseMediaType(http.DetectContentType(file.Data))
+		if !matchesMimeType(field.MimeTypes, contentType) {
+			return nil, fmt.Errorf("%w: %s (%s)", ErrTypeNotAllowed, filename, contentType)
+		}
+
+		parsed = append(parsed, File{
+			Field:       field.Name,
+			Filename:    filename,
+			ContentType: contentType,
+			Data:        file.Data,
+		})
+	}
+	return parsed, nil
+}
+
+// maxSize returns the maximum size of each file of the file field.
+func (field *Field) maxSize() int64 {
+	if field.MaxSize == 0 {
+		return DefaultMaxSize
+	}
+	return field.MaxSize
+}
+
+// maxCount returns the maximum number of files of the file field.
+func (field *Field) maxCount() int {
+	if field.MaxCount == 0 {
+		return 1
+	}
+	return field.MaxCount
+}
+
+// matchesMimeType checks if the MIME type provided matches any of the patterns provided,
+// which can be full types ("image/png") or wildcards ("image/*"). An empty list matches everything.
+func matchesMimeType(patterns []string, mimeType string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if p == mimeType || (strings.HasSuffix(p, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBoolean returns the value provided normalized as "true" or "false".
+// HTML checkboxes send "on" when checked, and nothing when unchecked.
+func parseBoolean(v string, required bool) (string, error) {
+	var b bool
+	switch strings.ToLower(v) {
+	case "true", "on", "1", "yes":
+		b = true
+	case "false", "off", "0", "no", "":
+	default:
+		return "", errInvalidBoolean
+	}
+
+	if required && !b {
+		return "", errRequired
+	}
+	return strconv.FormatBool(b), nil
+}
+
+// contains checks if the list provided contains the string provided.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package form_test
+
+import (
+	"errors"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"testing"
+)
+
+var testSchema = form.Schema{
+	{Name: "name", Label: "Name", Type: form.TypeText, Required: true, MaxLength: 10},
+	{Name: "mail", Label: "Email", Type: form.TypeEmail, Required: true},
+	{Name: "phone", Label: "Phone", Type: form.TypeText},
+	{Name: "subject", Label: "Subject", Type: form.TypeSelect, Values: []string{"sales", "support"}},
+	{Name: "employees", Label: "Employees", Type: form.TypeNumber},
+	{Name: "consent", Label: "Consent", Type: form.TypeBoolean, Required: true},
+	{Name: "msg", Label: "Message", Type: form.TypeMultiline},
+}
+
+func TestSchema_Parse(t *testing.T) {
+	f, err := testSchema.Parse(map[string][]string{
+		"name":      {" John\u0007 "},
+		"mail":      {"john@example.com"},
+		"subject":   {"sales"},
+		"employees": {"050.0"},
+		"consent":   {"on"},
+		"msg":       {"Hello\nworld\u001c"},
+		"unknown":   {"ignored"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{"John", "john@example.com", "", "sales", "50", "true", "Hello\nworld"}
+	if len(f.Values) != len(expected) {
+		t.Fatalf("unexpected number of values: expected %d - found %d", len(expected), len(f.Values))
+	}
+	for i, v := range f.Values {
+		if v.Name != testSchema[i].Name || v.Label != testSchema[i].Label || v.Type != testSchema[i].Type {
+			t.Errorf("value #%d does not match its field: %+v", i, v)
+		}
+		if v.Value != expected[i] {
+			t.Errorf("unexpected value of field \"%s\": expected \"%s\" - found \"%s\"", v.Name, expected[i], v.Value)
+		}
+	}
+
+	if mail := f.Email(); mail != "john@example.com" {
+		t.Errorf("unexpected email: %s", mail)
+	}
+	if subject := f.Get("subject"); subject != "sales" {
+		t.Errorf("unexpected subject: %s", subject)
+	}
+}
+
+func TestSchema_Parse_invalid(t *testing.T) {
+	valid := map[string][]string{
+		"name":    {"John"},
+		"mail":    {"john@example.com"},
+		"consent": {"true"},
+	}
+
+	tests := []struct {
+		field  string
+		values []string
+	}{
+		{"name", nil},
+		{"name", []string{"   "}},
+		{"name", []string{"John Smith Jr."}},
+		{"name", []string{"John", "Jane"}},
+		{"mail", []string{"john@example"}},
+		{"subject", []string{"marketing"}},
+		{"employees", []string{"fifty"}},
+		{"consent", []string{"false"}},
+		{"consent", []string{"maybe"}},
+	}
+
+	for _, test := range tests {
+		values := make(map[string][]string, len(valid)+1)
+		for k, v := range valid {
+			values[k] = v
+		}
+		values[test.field] = test.values
+
+		if _, err := testSchema.Parse(values, nil); err == nil {
+			t.Errorf("no error found for field \"%s\" with values %q", test.field, test.values)
+		}
+	}
+}
+
+var fileSchema = form.Schema{
+	{Name: "cv", Label: "CV", Type: form.TypeFile, Required: true, MaxSize: 64, MimeTypes: []string{"application/pdf"}},
+	{Name: "photos", Label: "Photos", Type: form.TypeFile, MaxCount: 2, MimeTypes: []string{"image/*"}},
+}
+
+var (
+	pdf = []byte("%PDF-1.4\n%fake\n")
+	png = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+)
+
+func TestSchema_Parse_files(t *testing.T) {
+	f, err := fileSchema.Parse(nil, map[string][]*form.File{
+		"cv":      {{Filename: "C:\\Users\\john\\cv.pdf", Data: pdf}},
+		"photos":  {{Filename: "../a.png", Data: png}, {Filename: "b.png", Data: png}},
+		"unknown": {{Filename: "ignored.txt", Data: []byte("ignored")}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if cv, photos := f.Get("cv"), f.Get("photos"); cv != "cv.pdf" || photos != "a.png, b.png" {
+		t.Errorf("unexpected values: cv \"%s\", photos \"%s\"", cv, photos)
+	}
+
+	expected := []form.File{
+		{Field: "cv", Filename: "cv.pdf", ContentType: "application/pdf"},
+		{Field: "photos", Filename: "a.png", ContentType: "image/png"},
+		{Field: "photos", Filename: "b.png", ContentType: "image/png"},
+	}
+	if len(f.Files) != len(expected) {
+		t.Fatalf("unexpected number of files: expected %d - found %d", len(expected), len(f.Files))
+	}
+	for i, file := range f.Files {
+		if file.Field != expected[i].Field || file.Filename != expected[i].Filename || file.ContentType != expected[i].ContentType {
+			t.Errorf("unexpected file #%d: expected %+v - found %+v", i, expected[i], file)
+		}
+	}
+}
+
+func TestSchema_Parse_invalidFiles(t *testing.T) {
+	tests := []struct {
+		files    map[string][]*form.File
+		expected error
+	}{
+		{map[string][]*form.File{}, nil},
+		{map[string][]*form.File{"cv": {{Filename: "cv.pdf", Data: append(pdf, make([]byte, 64)...)}}}, form.ErrTooLarge},
+		{map[string][]*form.File{"cv": {{Filename: "cv.pdf", Data: png}}}, form.ErrTypeNotAllowed},
+		{map[string][]*form.File{"cv": {{Filename: "cv.pdf", Data: []byte("<html><script>")}}}, form.ErrTypeNotAllowed},
+		{map[string][]*form.File{"cv": {{Filename: "a.pdf", Data: pdf}, {Filename: "b.pdf", Data: pdf}}}, nil},
+		{map[string][]*form.File{
+			"cv":     {{Filename: "cv.pdf", Data: pdf}},
+			"photos": {{Filename: "a.png", Data: png}, {Filename: "b.png", Data: png}, {Filename: "c.png", Data: png}},
+		}, nil},
+	}
+
+	for i, test := range tests {
+		_, err := fileSchema.Parse(nil, test.files)
+		if err == nil {
+			t.Errorf("test #%d: no error found", i)
+			continue
+		}
+		if test.expected != nil && !errors.Is(err, test.expected) {
+			t.Errorf("test #%d: unexpected error: expected %s - found %s", i, test.expected, err)
+		}
+	}
+}
+
+func TestSchema_MaxRequestSize(t *testing.T) {
+	if size := fileSchema.MaxRequestSize(); size != 1<<20+64+2*form.DefaultMaxSize {
+		t.Errorf("unexpected max request size: %d", size)
+	}
+	if size := form.DefaultSchema.MaxRequestSize(); size != 1<<20 {
+		t.Errorf("unexpected max request size of the default schema: %d", size)
+	}
+}
+
+func TestValue_Display(t *testing.T) {
+	tests := []struct {
+		value    form.Value
+		expected string
+	}{
+		{form.Value{Type: form.TypeBoolean, Value: "true"}, "Yes"},
+		{form.Value{Type: form.TypeBoolean, Value: "false"}, "No"},
+		{form.Value{Type: form.TypeText, Value: "true"}, "true"},
+	}
+	for _, test := range tests {
+		if result := test.value.Display(); result != test.expected {
+			t.Errorf("unexpected display of %+v: expected %s - found %s", test.value, test.expected, result)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package pkg
 
 const (
-	MimeContentType = "Content-Type"
-	MimeJSON        = "application/json"
+	MimeContentType    = "Content-Type"
+	MimeJSON           = "application/json"
+	MimeFormURLEncoded = "application/x-www-form-urlencoded"
+	MimeMultipartForm  = "multipart/form-data"
+	MimeHTML           = "text/html"
 )
@@ -0,0 +1,384 @@
+// Package queue manages the on-disk outbox where ptemplate-form-handler keeps the forms that are pending delivery.
+//
+// Each item is stored as a JSON file named after its ID. Items waiting to be delivered are kept in the "pending"
+// directory, and the ones whose delivery failed too many times are moved to the "dead" directory.
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dirPending = "pending"
+	dirDead    = "dead"
+	extension  = ".json"
+)
+
+var regexID = regexp.MustCompile("^[0-9]{14}-[0-9a-f]{12}$")
+
+// ErrNotFound is returned when an item cannot be found in the queue.
+var ErrNotFound = errors.New("item not found")
+
+// Item represents a form that is pending delivery to some of the senders of a site.
+type Item struct {
+	ID          string     `json:"id"`
+	Site        string     `json:"site"`
+	Targets     []string   `json:"targets"`
+	Form        *form.Form `json:"form"`
+	Created     time.Time  `json:"created"`
+	Attempts    int        `json:"attempts"`
+	NextAttempt time.Time  `json:"next_attempt"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// Queue represents an on-disk outbox.
+//
+// The delivery of an item is retried with an exponential backoff that starts in InitialBackoff and
+// doubles after every attempt up to MaxBackoff. After MaxAttempts failed attempts, the item is moved to the dead items.
+//
+// The items returned by Add and Due are in flight until Remove or Fail is called for them, and Due skips
+// the items in flight, so an item is never delivered twice at the same time by the same process.
+type Queue struct {
+	Dir            string
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	mutex    sync.Mutex
+	inFlight map[string]bool
+}
+
+// Init creates the directories of the queue if they don't exist.
+func (q *Queue) Init() error {
+	for _, dir := range []string{dirPending, dirDead} {
+		if err := os.MkdirAll(filepath.Join(q.Dir, dir), 0700); err != nil {
+			return fmt.Errorf("error creating queue directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// NewItem returns a new item with a unique ID for the form provided,
+// which is pending delivery to the targets of the site provided.
+func NewItem(site string, targets []string, f *form.Form) (*Item, error) {
+	random := make([]byte, 6)
+	if _, err := rand.Read(random); err != nil {
+		return nil, fmt.Errorf("error generating item ID: %w", err)
+	}
+
+	now := time.Now().UTC()
+	return &Item{
+		ID:      now.Format("20060102150405") + "-" + hex.EncodeToString(random),
+		Site:    site,
+		Targets: targets,
+		Form:    f,
+		Created: now,
+	}, nil
+}
+
+// Add stores the item provided as pending and in flight, so the caller can attempt the first delivery.
+// Once it's no longer in flight, it won't be due until InitialBackoff has passed.
+func (q *Queue) Add(it *Item) error {
+	it.NextAttempt = time.Now().UTC().Add(q.InitialBackoff)
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if err := q.write(dirPending, it); err != nil {
+		return err
+	}
+	q.setInFlight(it.ID, true)
+	return nil
+}
+
+// Remove deletes the pending item with the ID provided. It's used once the item has been delivered.
+func (q *Queue) Remove(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.setInFlight(id, false)
+	if err := os.Remove(q.path(dirPending, id)); err != nil {
+		return fmt.Errorf("error removing item %s: %w", id, err)
+	}
+	return nil
+}
+
+// Fail records a failed delivery attempt of the pending item provided, which is still pending delivery
+// to the targets provided. It returns true if the item was moved to the dead items.
+// If the item is no longer pending (e.g. it was removed meanwhile), nothing is recorded and ErrNotFound is returned.
+func (q *Queue) Fail(it *Item, targets []string, deliveryErr error) (bool, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.setInFlight(it.ID, false)
+	if _, err := os.Stat(q.path(dirPending, it.ID)); err != nil {
+		if os.IsNotExist(err) {
+			return false, ErrNotFound
+		}
+		return false, fmt.Errorf("error reading item %s: %w", it.ID, err)
+	}
+
+	it.Targets = targets
+	it.Attempts++
+	it.LastError = deliveryErr.Error()
+	it.NextAttempt = time.Now().UTC().Add(q.backoff(it.Attempts))
+
+	if it.Attempts < q.MaxAttempts {
+		return false, q.write(dirPending, it)
+	}
+
+	if err := q.write(dirDead, it); err != nil {
+		return false, err
+	}
+	if err := os.Remove(q.path(dirPending, it.ID)); err != nil {
+		return true, fmt.Errorf("error removing item %s from pending: %w", it.ID, err)
+	}
+	return true, nil
+}
+
+// Due returns the pending items whose next attempt is due and that are not in flight, oldest first.
+// The items returned are in flight until Remove or Fail is called for them.
+func (q *Queue) Due() ([]*Item, error) {
+	items, err := q.Pending()
+	if err != nil {
+		return nil, err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := time.Now()
+	due := items[:0]
+	for _, it := range items {
+		if !it.NextAttempt.After(now) && !q.inFlight[it.ID] {
+			q.setInFlight(it.ID, true)
+			due = append(due, it)
+		}
+	}
+	return due, nil
+}
+
+// Pending returns all the pending items, oldest first.
+func (q *Queue) Pending() ([]*Item, error) {
+	return q.list(dirPending)
+}
+
+// Dead returns all the dead items, oldest first.
+func (q *Queue) Dead() ([]*Item, error) {
+	return q.list(dirDead)
+}
+
+// Get returns the item with the ID provided, and whether it's a dead item.
+// It returns ErrNotFound if there is no item with that ID.
+func (q *Queue) Get(id string) (it *Item, dead bool, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.get(id)
+}
+
+// Replay makes the item with the ID provided due for delivery immediately.
+// Dead items are moved back to pending with their attempts reset.
+func (q *Queue) Replay(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	it, dead, err := q.get(id)
+	if err != nil {
+		return err
+	}
+
+	it.NextAttempt = time.Now().UTC()
+	if !dead {
+		return q.write(dirPending, it)
+	}
+
+	it.Attempts = 0
+	if err = q.write(dirPending, it); err != nil {
+		return err
+	}
+	if err = os.Remove(q.path(dirDead, id)); err != nil {
+		return fmt.Errorf("error removing item %s from dead: %w", id, err)
+	}
+	return nil
+}
+
+// Purge deletes the dead items created before the time provided, and returns how many were deleted.
+func (q *Queue) Purge(before time.Time) (int, error) {
+	items, err := q.Dead()
+	if err != nil {
+		return 0, err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	n := 0
+	for _, it := range items {
+		if !it.Created.Before(before) {
+			continue
+		}
+		if err = os.Remove(q.path(dirDead, it.ID)); err != nil && !os.IsNotExist(err) {
+			return n, fmt.Errorf("error removing item %s: %w", it.ID, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// get returns the item with the ID provided, and whether it's a dead item. The mutex must be held.
+func (q *Queue) get(id string) (*Item, bool, error) {
+	it, err := q.read(dirPending, id)
+	if err == nil {
+		return it, false, nil
+	}
+	if err != ErrNotFound {
+		return nil, false, err
+	}
+
+	it, err = q.read(dirDead, id)
+	if err != nil {
+		return nil, false, err
+	}
+	return it, true, nil
+}
+
+// setInFlight sets whether the item with the ID provided is in flight. The mutex must be held.
+func (q *Queue) setInFlight(id string, inFlight bool) {
+	if !inFlight {
+		delete(q.inFlight, id)
+		return
+	}
+	if q.inFlight == nil {
+		q.inFlight = make(map[string]bool)
+	}
+	q.inFlight[id] = true
+}
+
+// backoff returns the time to wait after the number of failed attempts provided.
+func (q *Queue) backoff(attempts int) time.Duration {
+	d := q.InitialBackoff
+	for i := 1; i < attempts && d < q.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > q.MaxBackoff {
+		d = q.MaxBackoff
+	}
+	return d
+}
+
+// list returns the items of the directory provided, oldest first.
+func (q *Queue) list(dir string) ([]*Item, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	files, err := ioutil.ReadDir(filepath.Join(q.Dir, dir))
+	if err != nil {
+		return nil, fmt.Errorf("error listing queue directory: %w", err)
+	}
+
+	items := make([]*Item, 0, len(files))
+	for _, f := range files {
+		id := strings.TrimSuffix(f.Name(), extension)
+		if !regexID.MatchString(id) || !strings.HasSuffix(f.Name(), extension) {
+			continue
+		}
+
+		it, err := q.read(dir, id)
+		if err == ErrNotFound {
+			// Removed while listing
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Created.Before(items[j].Created)
+	})
+	return items, nil
+}
+
+// read returns the item with the ID provided from the directory provided.
+func (q *Queue) read(dir, id string) (*Item, error) {
+	if !regexID.MatchString(id) {
+		return nil, ErrNotFound
+	}
+
+	data, err := ioutil.ReadFile(q.path(dir, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("error reading item %s: %w", id, err)
+	}
+
+	var it Item
+	if err = json.Unmarshal(data, &it); err != nil {
+		return nil, fmt.Errorf("error parsing item %s: %w", id, err)
+	}
+	return &it, nil
+}
+
+// write stores the item provided in the directory provided.
+// The item is written to a temporary file that is synced to disk and then renamed,
+// so an item is never left half-written.
+func (q *Queue) write(dir string, it *Item) error {
+	data, err := json.MarshalIndent(it, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding item %s: %w", it.ID, err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Join(q.Dir, dir), "."+it.ID+"-*")
+	if err != nil {
+		return fmt.Errorf("error creating item %s: %w", it.ID, err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err = tmp.Write(data); err != nil {
+		return fmt.Errorf("error writing item %s: %w", it.ID, err)
+	}
+	if err = tmp.Sync(); err != nil {
+		return fmt.Errorf("error syncing item %s: %w", it.ID, err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("error closing item %s: %w", it.ID, err)
+	}
+	if err = os.Rename(tmp.Name(), q.path(dir, it.ID)); err != nil {
+		return fmt.Errorf("error saving item %s: %w", it.ID, err)
+	}
+
+	return syncDir(filepath.Join(q.Dir, dir))
+}
+
+// path returns the path of the file of the item with the ID provided in the directory provided.
+func (q *Queue) path(dir, id string) string {
+	return filepath.Join(q.Dir, dir, id+extension)
+}
+
+// syncDir syncs the directory provided to disk, so the files renamed into it persist.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening queue directory: %w", err)
+	}
+	defer dir.Close()
+
+	// Some systems don't support syncing directories, in which case this error is ignored
+	_ = dir.Sync()
+	return dir.Close()
+}
@@ -0,0 +1,206 @@
+package queue
+
+import (
+	"errors"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestQueue(t *testing.T) *Queue {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %s", err)
+	}
+	q := &Queue{
+		Dir:            dir,
+		MaxAttempts:    3,
+		InitialBackoff: time.Minute,
+		MaxBackoff:     3 * time.Minute,
+	}
+	if err = q.Init(); err != nil {
+		t.Fatalf("error initializing queue: %s", err)
+	}
+	return q
+}
+
+func TestQueue(t *testing.T) {
+	q := newTestQueue(t)
+	defer os.RemoveAll(q.Dir)
+
+	f := &form.Form{Values: []form.Value{
+		{Name: "mail", Label: "Email", Type: form.TypeEmail, Value: "john@example.com"},
+	}}
+	it, err := NewItem("blog", []string{"smtp", "crm"}, f)
+	if err != nil {
+		t.Fatalf("error creating item: %s", err)
+	}
+	if err = q.Add(it); err != nil {
+		t.Fatalf("error adding item: %s", err)
+	}
+
+	// Not due until the first attempt has had time to happen
+	if due, err := q.Due(); err != nil || len(due) != 0 {
+		t.Errorf("unexpected due items: %v, %v", due, err)
+	}
+
+	// Items must survive a restart, so they are read from a new queue
+	q2 := &Queue{Dir: q.Dir, MaxAttempts: q.MaxAttempts, InitialBackoff: q.InitialBackoff, MaxBackoff: q.MaxBackoff}
+	pending, err := q2.Pending()
+	if err != nil || len(pending) != 1 {
+		t.Fatalf("unexpected pending items: %v, %v", pending, err)
+	}
+	if p := pending[0]; p.ID != it.ID || p.Site != "blog" || p.Form.Email() != f.Email() || len(p.Targets) != 2 {
+		t.Errorf("unexpected pending item: %+v", p)
+	}
+
+	expectedBackoffs := []time.Duration{time.Minute, 2 * time.Minute}
+	for i, expected := range expectedBackoffs {
+		before := time.Now()
+		dead, err := q2.Fail(pending[0], []string{"crm"}, errors.New("unavailable"))
+		if err != nil || dead {
+			t.Fatalf("attempt #%d: unexpected result: dead %v, error %v", i+1, dead, err)
+		}
+		if next := pending[0].NextAttempt; next.Before(before.Add(expected)) || next.After(time.Now().Add(expected)) {
+			t.Errorf("attempt #%d: unexpected next attempt: %s", i+1, next)
+		}
+	}
+
+	pending, _ = q2.Pending()
+	if len(pending) != 1 || pending[0].Attempts != 2 || pending[0].LastError != "unavailable" || len(pending[0].Targets) != 1 {
+		t.Fatalf("unexpected pending items after failures: %+v", pending)
+	}
+
+	dead, err := q2.Fail(pending[0], []string{"crm"}, errors.New("unavailable"))
+	if err != nil || !dead {
+		t.Fatalf("item not moved to dead: dead %v, error %v", dead, err)
+	}
+	if pending, _ = q2.Pending(); len(pending) != 0 {
+		t.Errorf("unexpected pending items: %v", pending)
+	}
+	if deadItems, _ := q2.Dead(); len(deadItems) != 1 || deadItems[0].ID != it.ID {
+		t.Errorf("unexpected dead items: %v", deadItems)
+	}
+}
+
+func TestQueue_Remove(t *testing.T) {
+	q := newTestQueue(t)
+	defer os.RemoveAll(q.Dir)
+
+	it, _ := NewItem("blog", []string{"smtp"}, &form.Form{})
+	if err := q.Add(it); err != nil {
+		t.Fatalf("error adding item: %s", err)
+	}
+	if err := q.Remove(it.ID); err != nil {
+		t.Fatalf("error removing item: %s", err)
+	}
+	if pending, _ := q.Pending(); len(pending) != 0 {
+		t.Errorf("unexpected pending items: %v", pending)
+	}
+}
+
+func TestQueue_inFlight(t *testing.T) {
+	q := newTestQueue(t)
+	defer os.RemoveAll(q.Dir)
+	q.InitialBackoff = 0
+
+	it, _ := NewItem("blog", []string{"smtp"}, &form.Form{})
+	if err := q.Add(it); err != nil {
+		t.Fatalf("error adding item: %s", err)
+	}
+	// Due, but still being delivered by the caller of Add
+	if due, err := q.Due(); err != nil || len(due) != 0 {
+		t.Errorf("item in flight returned as due: %v, %v", due, err)
+	}
+
+	if _, err := q.Fail(it, it.Targets, errors.New("unavailable")); err != nil {
+		t.Fatalf("error recording failure: %s", err)
+	}
+	due, err := q.Due()
+	if err != nil || len(due) != 1 {
+		t.Fatalf("unexpected due items: %v, %v", due, err)
+	}
+	if again, err := q.Due(); err != nil || len(again) != 0 {
+		t.Errorf("item returned as due twice: %v, %v", again, err)
+	}
+
+	// Removed while in flight: the failure is not recorded, so it's not written back to pending
+	if err = q.Remove(it.ID); err != nil {
+		t.Fatalf("error removing item: %s", err)
+	}
+	if _, err = q.Fail(due[0], due[0].Targets, errors.New("unavailable")); err != ErrNotFound {
+		t.Errorf("unexpected error recording the failure of a removed item: %v", err)
+	}
+	if pending, _ := q.Pending(); len(pending) != 0 {
+		t.Errorf("unexpected pending items: %v", pending)
+	}
+}
+
+func TestQueue_backoff(t *testing.T) {
+	q := Queue{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, d := range expected {
+		if b := q.backoff(i + 1); b != d {
+			t.Errorf("unexpected backoff after %d attempts: expected %s - found %s", i+1, d, b)
+		}
+	}
+}
+
+func TestQueue_Replay(t *testing.T) {
+	q := newTestQueue(t)
+	defer os.RemoveAll(q.Dir)
+	q.MaxAttempts = 1
+
+	it, _ := NewItem("blog", []string{"smtp"}, &form.Form{})
+	if err := q.Add(it); err != nil {
+		t.Fatalf("error adding item: %s", err)
+	}
+	if dead, err := q.Fail(it, it.Targets, errors.New("unavailable")); err != nil || !dead {
+		t.Fatalf("item not moved to dead: dead %v, error %v", dead, err)
+	}
+
+	if _, dead, err := q.Get(it.ID); err != nil || !dead {
+		t.Errorf("item not found in dead: dead %v, error %v", dead, err)
+	}
+	if _, _, err := q.Get("20200101000000-000000000000"); err != ErrNotFound {
+		t.Errorf("unexpected error getting nonexistent item: %v", err)
+	}
+
+	if err := q.Replay(it.ID); err != nil {
+		t.Fatalf("error replaying item: %s", err)
+	}
+	due, err := q.Due()
+	if err != nil || len(due) != 1 || due[0].ID != it.ID || due[0].Attempts != 0 {
+		t.Errorf("replayed item not due: %v, %v", due, err)
+	}
+	if deadItems, _ := q.Dead(); len(deadItems) != 0 {
+		t.Errorf("unexpected dead items: %v", deadItems)
+	}
+}
+
+func TestQueue_Purge(t *testing.T) {
+	q := newTestQueue(t)
+	defer os.RemoveAll(q.Dir)
+	q.MaxAttempts = 1
+
+	old, _ := NewItem("blog", []string{"smtp"}, &form.Form{})
+	old.Created = old.Created.Add(-48 * time.Hour)
+	recent, _ := NewItem("blog", []string{"smtp"}, &form.Form{})
+	for _, it := range []*Item{old, recent} {
+		if err := q.Add(it); err != nil {
+			t.Fatalf("error adding item: %s", err)
+		}
+		if _, err := q.Fail(it, it.Targets, errors.New("unavailable")); err != nil {
+			t.Fatalf("error failing item: %s", err)
+		}
+	}
+
+	if n, err := q.Purge(time.Now().Add(-24 * time.Hour)); err != nil || n != 1 {
+		t.Errorf("unexpected purge result: %d, %v", n, err)
+	}
+	if deadItems, _ := q.Dead(); len(deadItems) != 1 || deadItems[0].ID != recent.ID {
+		t.Errorf("unexpected dead items: %v", deadItems)
+	}
+}
@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket represents a token-bucket rate limiter: each key has a bucket of Limit tokens, which is refilled
+// at a rate of Limit tokens every Period, and each use takes a token. So a key can be used Limit times in a row,
+// and then once every Period/Limit.
+//
+// It's implemented as a generic cell rate algorithm, so the state of a key is just the time its bucket will be full.
+type Bucket struct {
+	Limit  int
+	Period time.Duration
+
+	mutex     sync.Mutex
+	full      map[string]time.Time
+	lastSweep time.Time
+}
+
+// Allow records a use of the key provided, and returns whether it's allowed.
+// If it's not, it also returns the time left until the key can be used again.
+func (b *Bucket) Allow(key string) (bool, time.Duration) {
+	return b.allow(key, time.Now())
+}
+
+// allow is Allow at the time provided.
+func (b *Bucket) allow(key string, now time.Time) (bool, time.Duration) {
+	ok, _, wait := allowAll([]Use{{Limiter: b, Key: key}}, now)
+	return ok, wait
+}
+
+// check returns whether a use of the key provided is allowed at the time provided, without recording it.
+// If it's not, it also returns the time left until the key can be used again.
+func (b *Bucket) check(key string, now time.Time) (bool, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.full == nil {
+		b.full = make(map[string]time.Time)
+	}
+	b.sweep(now)
+
+	// The bucket has a token left if it's not fuller than Limit-1 tokens
+	if wait := b.fullAt(key, now).Sub(now) - (b.Period - b.interval()); wait > 0 {
+		return false, wait
+	}
+	return true, 0
+}
+
+// take takes a token of the bucket of the key provided at the time provided.
+func (b *Bucket) take(key string, now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.full[key] = b.fullAt(key, now).Add(b.interval())
+}
+
+// fullAt returns the time the bucket of the key provided will be full, which is the time provided if it's
+// already full. The mutex must be held.
+func (b *Bucket) fullAt(key string, now time.Time) time.Time {
+	full, ok := b.full[key]
+	if !ok || full.Before(now) {
+		return now
+	}
+	return full
+}
+
+// interval returns the time it takes to refill a token.
+func (b *Bucket) interval() time.Duration {
+	return b.Period / time.Duration(b.Limit)
+}
+
+// sweep deletes the keys whose buckets are full, at most once every period, so keys used once don't pile up.
+// The mutex must be held.
+func (b *Bucket) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < b.Period {
+		return
+	}
+	b.lastSweep = now
+
+	for key, full := range b.full {
+		if !full.After(now) {
+			delete(b.full, key)
+		}
+	}
+}
+
+// state returns the times the buckets of the keys that are not full at the time provided will be full.
+func (b *Bucket) state(now time.Time) map[string]time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	state := make(map[string]time.Time, len(b.full))
+	for key, full := range b.full {
+		if full.After(now) {
+			state[key] = full
+		}
+	}
+	return state
+}
+
+// restore sets the times the buckets of the keys provided will be full, unless they are already known.
+// Times later than a Period after the time provided are capped, since buckets cannot be emptier than empty.
+func (b *Bucket) restore(state map[string]time.Time, now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.full == nil {
+		b.full = make(map[string]time.Time, len(state))
+	}
+	for key, full := range state {
+		if _, ok := b.full[key]; ok || !full.After(now) {
+			continue
+		}
+		if max := now.Add(b.Period); full.After(max) {
+			full = max
+		}
+		b.full[key] = full
+	}
+}
@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket_Allow(t *testing.T) {
+	b := &Bucket{Limit: 2, Period: time.Hour}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		key        string
+		elapsed    time.Duration
+		allowed    bool
+		retryAfter time.Duration
+	}{
+		{"a", 0, true, 0},
+		{"a", time.Minute, true, 0},
+		{"a", 2 * time.Minute, false, 28 * time.Minute},
+		{"b", 2 * time.Minute, true, 0},
+		{"a", 30 * time.Minute, true, 0},
+		{"a", 31 * time.Minute, false, 29 * time.Minute},
+		{"a", 2 * time.Hour, true, 0},
+		{"a", 2 * time.Hour, true, 0},
+		{"a", 2 * time.Hour, false, 30 * time.Minute},
+	}
+
+	for i, test := range tests {
+		allowed, retryAfter := b.allow(test.key, start.Add(test.elapsed))
+		if allowed != test.allowed || retryAfter != test.retryAfter {
+			t.Errorf("use #%d of \"%s\": expected (%t, %s) - found (%t, %s)",
+				i, test.key, test.allowed, test.retryAfter, allowed, retryAfter)
+		}
+	}
+}
+
+func TestBucket_sweep(t *testing.T) {
+	b := &Bucket{Limit: 2, Period: time.Minute}
+	start := time.Now()
+
+	b.allow("a", start)
+	b.allow("b", start.Add(50*time.Second))
+	b.allow("c", start.Add(70*time.Second))
+
+	if _, ok := b.full["a"]; ok || len(b.full) != 2 {
+		t.Errorf("full buckets not deleted: %v", b.full)
+	}
+}
@@ -0,0 +1,129 @@
+package ratelimit
+
+// Package ratelimit limits how often ptemplate-form-handler does something on behalf of the same key,
+// like an email address, with fixed windows or token buckets. The state of the token buckets can be kept
+// in a file across restarts.
+
+import (
+	"sync"
+	"time"
+)
+
+// usesMutex serializes the uses of all the rate limiters, so AllowAll can check several of them
+// before recording any use.
+var usesMutex sync.Mutex
+
+// Interface is implemented by the rate limiters of this package, Limiter and Bucket.
+type Interface interface {
+	Allow(key string) (bool, time.Duration)
+	check(key string, now time.Time) (bool, time.Duration)
+	take(key string, now time.Time)
+}
+
+// Use represents a use of Key with Limiter. Uses with a nil Limiter are always allowed.
+type Use struct {
+	Limiter Interface
+	Key     string
+}
+
+// Limiter represents a fixed-window rate limiter: each key can be used Limit times every Period,
+// counting from its first use in the window.
+type Limiter struct {
+	Limit  int
+	Period time.Duration
+
+	mutex     sync.Mutex
+	windows   map[string]*window
+	lastSweep time.Time
+}
+
+// window represents the uses of a key in the current period.
+type window struct {
+	start time.Time
+	count int
+}
+
+// Allow records a use of the key provided, and returns whether it's allowed.
+// If it's not, it also returns the time left until the key can be used again.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	return l.allow(key, time.Now())
+}
+
+// allow is Allow at the time provided.
+func (l *Limiter) allow(key string, now time.Time) (bool, time.Duration) {
+	ok, _, wait := allowAll([]Use{{Limiter: l, Key: key}}, now)
+	return ok, wait
+}
+
+// check returns whether a use of the key provided is allowed at the time provided, without recording it.
+// If it's not, it also returns the time left until the key can be used again.
+func (l *Limiter) check(key string, now time.Time) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.windows == nil {
+		l.windows = make(map[string]*window)
+	}
+	l.sweep(now)
+
+	w, ok := l.windows[key]
+	if ok && now.Sub(w.start) < l.Period && w.count >= l.Limit {
+		return false, w.start.Add(l.Period).Sub(now)
+	}
+	return true, 0
+}
+
+// take records a use of the key provided at the time provided.
+func (l *Limiter) take(key string, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= l.Period {
+		w = &window{start: now}
+		l.windows[key] = w
+	}
+	w.count++
+}
+
+// AllowAll records the uses provided, and returns whether all of them are allowed. If any of them is not,
+// none is recorded, and it also returns the index of the first one not allowed and the time left until it is.
+func AllowAll(uses ...Use) (bool, int, time.Duration) {
+	return allowAll(uses, time.Now())
+}
+
+// allowAll is AllowAll at the time provided.
+func allowAll(uses []Use, now time.Time) (bool, int, time.Duration) {
+	usesMutex.Lock()
+	defer usesMutex.Unlock()
+
+	for i, u := range uses {
+		if u.Limiter == nil {
+			continue
+		}
+		if ok, wait := u.Limiter.check(u.Key, now); !ok {
+			return false, i, wait
+		}
+	}
+	for _, u := range uses {
+		if u.Limiter != nil {
+			u.Limiter.take(u.Key, now)
+		}
+	}
+	return true, -1, 0
+}
+
+// sweep deletes the expired windows, at most once every period, so keys used once don't pile up.
+// The mutex must be held.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.Period {
+		return
+	}
+	l.lastSweep = now
+
+	for key, w := range l.windows {
+		if now.Sub(w.start) >= l.Period {
+			delete(l.windows, key)
+		}
+	}
+}
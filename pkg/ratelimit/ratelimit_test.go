@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	l := &Limiter{Limit: 2, Period: time.Hour}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		key        string
+		elapsed    time.Duration
+		allowed    bool
+		retryAfter time.Duration
+	}{
+		{"a", 0, true, 0},
+		{"a", time.Minute, true, 0},
+		{"a", 2 * time.Minute, false, 58 * time.Minute},
+		{"b", 2 * time.Minute, true, 0},
+		{"a", 59 * time.Minute, false, time.Minute},
+		{"a", time.Hour, true, 0},
+		{"b", time.Hour, true, 0},
+		{"b", time.Hour, false, 2 * time.Minute},
+	}
+
+	for i, test := range tests {
+		allowed, retryAfter := l.allow(test.key, start.Add(test.elapsed))
+		if allowed != test.allowed || retryAfter != test.retryAfter {
+			t.Errorf("use #%d of \"%s\": expected (%t, %s) - found (%t, %s)",
+				i, test.key, test.allowed, test.retryAfter, allowed, retryAfter)
+		}
+	}
+}
+
+func TestLimiter_sweep(t *testing.T) {
+	l := &Limiter{Limit: 1, Period: time.Minute}
+	start := time.Now()
+
+	l.allow("a", start)
+	l.allow("b", start.Add(30*time.Second))
+	l.allow("c", start.Add(70*time.Second))
+
+	if _, ok := l.windows["a"]; ok || len(l.windows) != 2 {
+		t.Errorf("expired windows not deleted: %v", l.windows)
+	}
+}
+
+func TestAllowAll(t *testing.T) {
+	l := &Limiter{Limit: 1, Period: time.Hour}
+	b := &Bucket{Limit: 2, Period: time.Hour}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		uses    []Use
+		allowed bool
+		refused int
+	}{
+		{[]Use{{Limiter: b, Key: "ip"}, {Limiter: l, Key: "a"}}, true, -1},
+		{[]Use{{Limiter: b, Key: "ip"}, {Limiter: l, Key: "a"}}, false, 1},
+		{[]Use{{Limiter: b, Key: "ip"}, {Limiter: l, Key: "b"}, {Key: "nil"}}, true, -1},
+		{[]Use{{Limiter: l, Key: "c"}, {Limiter: b, Key: "ip"}}, false, 1},
+		{[]Use{{Limiter: l, Key: "c"}}, true, -1},
+	}
+	for i, test := range tests {
+		allowed, refused, _ := allowAll(test.uses, now)
+		if allowed != test.allowed || refused != test.refused {
+			t.Errorf("uses #%d: expected (%t, %d) - found (%t, %d)", i, test.allowed, test.refused, allowed, refused)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Store represents a set of named Buckets whose state is kept in the JSON file at Path, so they are not reset
+// when ptemplate-form-handler restarts. If Path is empty, the buckets are only kept in memory.
+type Store struct {
+	Path string
+
+	mutex   sync.Mutex
+	buckets map[string]*Bucket
+}
+
+// storedBucket represents the state of a Bucket in the file of a Store. The state is only restored
+// if the bucket has still the same Limit and Period.
+type storedBucket struct {
+	Limit  int                  `json:"limit"`
+	Period time.Duration        `json:"period"`
+	Full   map[string]time.Time `json:"full"`
+}
+
+// Add adds the bucket provided to the store with the name provided, replacing the one with the same name.
+func (s *Store) Add(name string, b *Bucket) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.buckets == nil {
+		s.buckets = make(map[string]*Bucket)
+	}
+	s.buckets[name] = b
+}
+
+// Load restores the state of the buckets of the store from its file. It does nothing if the file doesn't exist.
+func (s *Store) Load() error {
+	return s.load(time.Now())
+}
+
+// load is Load at the time provided.
+func (s *Store) load(now time.Time) error {
+	if s.Path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading rate limits: %w", err)
+	}
+	var stored map[string]storedBucket
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return fmt.Errorf("error parsing rate limits: %w", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for name, sb := range stored {
+		if b, ok := s.buckets[name]; ok && b.Limit == sb.Limit && b.Period == sb.Period {
+			b.restore(sb.Full, now)
+		}
+	}
+	return nil
+}
+
+// Save writes the state of the buckets of the store to its file. It does nothing if the store has no Path.
+// The file is written to a temporary file that is then renamed, so it's never left half-written.
+func (s *Store) Save() error {
+	return s.save(time.Now())
+}
+
+// save is Save at the time provided.
+func (s *Store) save(now time.Time) error {
+	if s.Path == "" {
+		return nil
+	}
+
+	s.mutex.Lock()
+	stored := make(map[string]storedBucket, len(s.buckets))
+	for name, b := range s.buckets {
+		stored[name] = storedBucket{Limit: b.Limit, Period: b.Period, Full: b.state(now)}
+	}
+	s.mutex.Unlock()
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("error encoding rate limits: %w", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), "."+filepath.Base(s.Path)+"-*")
+	if err != nil {
+		return fmt.Errorf("error creating rate limits file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err = tmp.Write(data); err != nil {
+		return fmt.Errorf("error writing rate limits: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("error closing rate limits file: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), s.Path); err != nil {
+		return fmt.Errorf("error saving rate limits: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ratelimit")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rate-limits.json")
+	now := time.Now()
+
+	// A missing file is not an error
+	s := &Store{Path: path}
+	ip, email := &Bucket{Limit: 1, Period: time.Hour}, &Bucket{Limit: 2, Period: time.Hour}
+	s.Add("ip", ip)
+	s.Add("email", email)
+	if err := s.load(now); err != nil {
+		t.Fatalf("error loading missing file: %s", err)
+	}
+
+	ip.allow("192.0.2.1", now)
+	email.allow("john@example.com", now)
+	if err := s.save(now.Add(time.Minute)); err != nil {
+		t.Fatalf("error saving: %s", err)
+	}
+
+	// The state is restored after restarting, unless the limits changed
+	s = &Store{Path: path}
+	ip, email = &Bucket{Limit: 1, Period: time.Hour}, &Bucket{Limit: 3, Period: time.Hour}
+	s.Add("ip", ip)
+	s.Add("email", email)
+	if err := s.load(now.Add(2 * time.Minute)); err != nil {
+		t.Fatalf("error loading: %s", err)
+	}
+	if ok, retryAfter := ip.allow("192.0.2.1", now.Add(2*time.Minute)); ok || retryAfter != 58*time.Minute {
+		t.Errorf("bucket not restored: expected (false, 58m0s) - found (%t, %s)", ok, retryAfter)
+	}
+	if ok, _ := ip.allow("192.0.2.2", now.Add(2*time.Minute)); !ok {
+		t.Error("unknown key not allowed after restoring")
+	}
+	if len(email.full) != 0 {
+		t.Errorf("bucket with different limits restored: %v", email.full)
+	}
+
+	// Without path, nothing is saved
+	if err := (&Store{}).Save(); err != nil {
+		t.Errorf("error saving without path: %s", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatalf("error writing file: %s", err)
+	}
+	if err := s.Load(); err == nil {
+		t.Error("no error loading an invalid file")
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"unicode"
 )
 
-// SanitizeMsg will remove illegal characters from the "msg" field of api.Request
+// SanitizeMsg will remove illegal characters from the "msg" field of api.Request, and from any multiline field
 func SanitizeMsg(msg string) string {
 	return strings.Map(func(r rune) rune {
 		if unicode.IsPrint(r) || r == '\n' {
@@ -5,7 +5,7 @@ import (
 	"unicode"
 )
 
-// SanitizeName will remove illegal characters from the "name" field of api.Request
+// SanitizeName will remove illegal characters from the "name" field of api.Request, and from any single-line field
 func SanitizeName(name string) string {
 	return strings.Map(func(r rune) rune {
 		if unicode.IsPrint(r) {
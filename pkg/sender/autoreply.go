@@ -0,0 +1,88 @@
+package sender
+
+import (
+	"errors"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"github.com/nethruster/ptemplate-form-handler/pkg/ratelimit"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+)
+
+// ErrRateLimited is returned when an acknowledgement is not sent because too many have been sent.
+var ErrRateLimited = errors.New("too many acknowledgements sent")
+
+// defaultAutoReplyTemplates are the templates of the acknowledgements used if no other is provided.
+// They don't reference any field, so they can be used with any schema, and they don't include the values
+// of the form, so the acknowledgements cannot be used to send arbitrary content to arbitrary addresses.
+var defaultAutoReplyTemplates = &Templates{
+	Subject: texttemplate.Must(texttemplate.New("subject").Parse(
+		"We have received your message to {{.Site}}")),
+	Text: texttemplate.Must(texttemplate.New("text").Parse(
+		"Hello,\n\n" +
+			"Thank you for contacting {{.Site}}. We have received your message and we will answer it as soon as possible.\n")),
+	HTML: htmltemplate.Must(htmltemplate.New("html").Parse(
+		"<html><body><p>Hello,</p>" +
+			"<p>Thank you for contacting {{.Site}}. We have received your message and we will answer it as soon as possible.</p>" +
+			"</body></html>")),
+}
+
+// AutoReply represents a type that sends an acknowledgement of receipt to the submitter of a form via SMTP.
+//
+// The acknowledgements are sent with the account of Mail, and built with Templates. The nil templates are replaced
+// by default ones. The limiters, if not nil, limit how many acknowledgements each address receives (Limiter),
+// how many are sent for the forms of each client IP address (IPLimiter) and how many are sent in total
+// (GlobalLimiter), so the form cannot be used to flood arbitrary addresses. The files of the form are never sent back.
+type AutoReply struct {
+	Mail          *Mail
+	Templates     *Templates
+	Limiter       *ratelimit.Limiter
+	IPLimiter     *ratelimit.Limiter
+	GlobalLimiter *ratelimit.Limiter
+}
+
+// Send will send an acknowledgement of the form provided to its submitter. Forms without email are ignored.
+// If too many acknowledgements have been sent according to any of the limiters, it returns ErrRateLimited.
+func (ar *AutoReply) Send(f *form.Form) error {
+	to := f.Email()
+	if to == "" {
+		return nil
+	}
+
+	var uses []ratelimit.Use
+	if ar.Limiter != nil {
+		uses = append(uses, ratelimit.Use{Limiter: ar.Limiter, Key: strings.ToLower(to)})
+	}
+	if ar.IPLimiter != nil && f.ClientIP != "" {
+		uses = append(uses, ratelimit.Use{Limiter: ar.IPLimiter, Key: f.ClientIP})
+	}
+	if ar.GlobalLimiter != nil {
+		uses = append(uses, ratelimit.Use{Limiter: ar.GlobalLimiter})
+	}
+	if ok, _, _ := ratelimit.AllowAll(uses...); !ok {
+		return ErrRateLimited
+	}
+
+	msg, err := ar.createMessage(f)
+	if err != nil {
+		return err
+	}
+	return ar.Mail.send([]string{to}, msg)
+}
+
+// createMessage will return a byte slice containing the acknowledgement of the form provided.
+func (ar *AutoReply) createMessage(f *form.Form) ([]byte, error) {
+	subject, text, html, err := ar.Templates.or(defaultAutoReplyTemplates).execute(ar.Mail.WebName, f)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &message{
+		From:    ar.Mail.from(),
+		To:      []string{submitterAddress(f)},
+		Subject: subject,
+		Text:    text,
+		HTML:    html,
+	}
+	return m.Bytes(), nil
+}
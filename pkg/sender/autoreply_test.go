@@ -0,0 +1,86 @@
+package sender
+
+import (
+	"github.com/nethruster/ptemplate-form-handler/pkg/ratelimit"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAutoReply_createMessage(t *testing.T) {
+	ar := AutoReply{Mail: &Mail{WebName: "mywebsite.com", Account: Account{Username: "no-reply@mywebsite.com"}, FromName: "My website"}}
+	f := newTestForm("John Smith", "john@example.com", "<b>Hi</b>")
+
+	data, err := ar.createMessage(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	msg := parseMessage(t, data)
+
+	for header, expected := range map[string]string{
+		"From":    "\"My website\" <no-reply@mywebsite.com>",
+		"To":      "\"John Smith\" <john@example.com>",
+		"Subject": "We have received your message to mywebsite.com",
+	} {
+		if value := msg.Header.Get(header); value != expected {
+			t.Errorf("Unexpected %s header.\n-> Expected: \"%s\"\n-> Found: \"%s\"", header, expected, value)
+		}
+	}
+
+	parts := readAlternative(t, msg.Header.Get("Content-Type"), msg.Body)
+	for _, part := range []string{"text/plain", "text/html"} {
+		if !strings.Contains(parts[part], "Thank you for contacting mywebsite.com") {
+			t.Errorf("acknowledgement not found in %s part: %s", part, parts[part])
+		}
+		if strings.Contains(parts[part], "Hi") || strings.Contains(parts[part], "John") {
+			t.Errorf("values of the form found in %s part: %s", part, parts[part])
+		}
+	}
+}
+
+func TestAutoReply_Send_rateLimited(t *testing.T) {
+	// Nothing listens in this address, so sending fails
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	ar := AutoReply{
+		Mail:    &Mail{WebName: "mywebsite.com", Account: Account{Username: "no-reply@mywebsite.com", Hostname: host, Port: port}},
+		Limiter: &ratelimit.Limiter{Limit: 1, Period: time.Hour},
+	}
+
+	if err = ar.Send(newTestForm("John", "john@example.com", "Hi")); err == nil || err == ErrRateLimited {
+		t.Errorf("unexpected result of first acknowledgement: %v", err)
+	}
+	if err = ar.Send(newTestForm("John", "JOHN@example.com", "Hi")); err != ErrRateLimited {
+		t.Errorf("second acknowledgement not rate limited: %v", err)
+	}
+	if err = ar.Send(newTestForm("John", "", "Hi")); err != nil {
+		t.Errorf("unexpected error for form without email: %s", err)
+	}
+
+	ar.Limiter = nil
+	ar.IPLimiter = &ratelimit.Limiter{Limit: 1, Period: time.Hour}
+	ar.GlobalLimiter = &ratelimit.Limiter{Limit: 2, Period: time.Hour}
+	tests := []struct {
+		ip          string
+		mail        string
+		rateLimited bool
+	}{
+		{"192.0.2.1", "john@example.com", false},
+		{"192.0.2.1", "jane@example.com", true},
+		{"192.0.2.2", "jane@example.com", false},
+		{"192.0.2.3", "jack@example.com", true},
+	}
+	for i, test := range tests {
+		f := newTestForm("John", test.mail, "Hi")
+		f.ClientIP = test.ip
+		if err = ar.Send(f); (err == ErrRateLimited) != test.rateLimited {
+			t.Errorf("acknowledgement #%d: unexpected result: %v", i, err)
+		}
+	}
+}
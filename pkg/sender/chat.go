@@ -0,0 +1,73 @@
+package sender
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg/client"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"strings"
+)
+
+// Formats of the chat incoming webhooks supported by Chat.
+const (
+	ChatSlack      = "slack"
+	ChatMattermost = "mattermost"
+	ChatDiscord    = "discord"
+)
+
+// discordMaxLength is the maximum length of a Discord message.
+const discordMaxLength = 2000
+
+// Chat represents a type that send forms to the incoming webhook of a chat service.
+type Chat struct {
+	Format  string
+	WebName string
+	URL     string
+}
+
+// slackPayload represents the body of a Slack or Mattermost incoming webhook.
+type slackPayload struct {
+	Text string `json:"text"`
+}
+
+// discordPayload represents the body of a Discord incoming webhook.
+type discordPayload struct {
+	Content         string `json:"content"`
+	AllowedMentions struct {
+		Parse []string `json:"parse"`
+	} `json:"allowed_mentions"`
+}
+
+// slackEscaper escapes the characters that have a special meaning in Slack and Mattermost messages.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// Send will post the form provided to the chat incoming webhook.
+func (c *Chat) Send(f *form.Form) error {
+	text := createText(c.WebName, f)
+
+	var payload interface{}
+	switch c.Format {
+	case ChatSlack, ChatMattermost:
+		payload = slackPayload{Text: slackEscaper.Replace(text)}
+	case ChatDiscord:
+		if r := []rune(text); len(r) > discordMaxLength {
+			text = string(r[:discordMaxLength-1]) + "…"
+		}
+		// Mentions are disabled so the form cannot ping @everyone
+		p := discordPayload{Content: text}
+		p.AllowedMentions.Parse = []string{}
+		payload = p
+	default:
+		return fmt.Errorf("unknown chat format \"%s\"", c.Format)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error parsing %s JSON: %s", c.Format, err)
+	}
+
+	if _, err = client.PostJSON(c.URL, data); err != nil {
+		return fmt.Errorf("error sending %s message: %s", c.Format, err)
+	}
+	return nil
+}
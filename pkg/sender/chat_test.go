@@ -0,0 +1,41 @@
+package sender
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChat_Send(t *testing.T) {
+	var body map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		_ = json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer srv.Close()
+
+	f := newTestForm("<@here>", "john@example.com", "Hi @everyone")
+	expectedText := "Message from mywebsite.com\nName: <@here>\nEmail: john@example.com\nMessage:\nHi @everyone"
+
+	for _, test := range []struct {
+		format, key, expected string
+	}{
+		{ChatSlack, "text", slackEscaper.Replace(expectedText)},
+		{ChatMattermost, "text", slackEscaper.Replace(expectedText)},
+		{ChatDiscord, "content", expectedText},
+	} {
+		c := Chat{Format: test.format, WebName: "mywebsite.com", URL: srv.URL}
+		if err := c.Send(f); err != nil {
+			t.Errorf("%s: unexpected error: %s", test.format, err)
+			continue
+		}
+		if body[test.key] != test.expected {
+			t.Errorf("%s: unexpected %s:\n-> Expected: %s\n-> Found: %v", test.format, test.key, test.expected, body[test.key])
+		}
+	}
+
+	if mentions, ok := body["allowed_mentions"].(map[string]interface{}); !ok || len(mentions["parse"].([]interface{})) != 0 {
+		t.Errorf("discord mentions not disabled: %v", body["allowed_mentions"])
+	}
+}
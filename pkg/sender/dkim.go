@@ -0,0 +1,249 @@
+package sender
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Canonicalization algorithms of DKIM signatures.
+const (
+	CanonicalizationSimple  = "simple"
+	CanonicalizationRelaxed = "relaxed"
+)
+
+// DefaultDKIMHeaders are the header fields signed by default, if present in the message.
+var DefaultDKIMHeaders = []string{"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID", "MIME-Version", "Content-Type"}
+
+// DKIM represents the settings used to sign messages with DKIM (RFC 6376).
+//
+// Key is an RSA or Ed25519 private key, whose public key is published in the TXT record
+// <Selector>._domainkey.<Domain>. Messages are signed with rsa-sha256 or ed25519-sha256 (RFC 8463) accordingly.
+//
+// HeaderCanonicalization and BodyCanonicalization are CanonicalizationSimple or CanonicalizationRelaxed
+// (the latter if empty). Headers are the header fields signed (DefaultDKIMHeaders if empty).
+type DKIM struct {
+	Domain                 string
+	Selector               string
+	Key                    crypto.Signer
+	HeaderCanonicalization string
+	BodyCanonicalization   string
+	Headers                []string
+}
+
+// LoadDKIMKey reads the PEM encoded private key in the path provided, which can be a PKCS #1 RSA key
+// or a PKCS #8 RSA or Ed25519 key.
+func LoadDKIMKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in \"%s\"", path)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case ed25519.PrivateKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return nil, fmt.Errorf("unsupported PEM block \"%s\"", block.Type)
+}
+
+// Sign returns the message provided with a DKIM-Signature header field prepended.
+// Line breaks of the message are normalized to CRLF, as they are sent.
+func (d *DKIM) Sign(msg []byte) ([]byte, error) {
+	return d.sign(msg, time.Now())
+}
+
+// sign returns the message provided signed at the time provided.
+func (d *DKIM) sign(msg []byte, now time.Time) ([]byte, error) {
+	var algorithm string
+	var opts crypto.SignerOpts
+	switch d.Key.(type) {
+	case *rsa.PrivateKey:
+		algorithm, opts = "rsa-sha256", crypto.SHA256
+	case ed25519.PrivateKey:
+		algorithm, opts = "ed25519-sha256", crypto.Hash(0)
+	default:
+		return nil, fmt.Errorf("unsupported DKIM key type %T", d.Key)
+	}
+
+	headerCanon, bodyCanon := d.HeaderCanonicalization, d.BodyCanonicalization
+	if headerCanon == "" {
+		headerCanon = CanonicalizationRelaxed
+	}
+	if bodyCanon == "" {
+		bodyCanon = CanonicalizationRelaxed
+	}
+	names := d.Headers
+	if len(names) == 0 {
+		names = DefaultDKIMHeaders
+	}
+
+	msg = normalizeLineBreaks(msg)
+	fields, body := splitMessage(msg)
+	bodyHash := sha256.Sum256(canonicalBody(body, bodyCanon))
+	signed, signedNames := selectHeaderFields(fields, names)
+
+	sigField := "DKIM-Signature: v=1; a=" + algorithm + "; c=" + headerCanon + "/" + bodyCanon +
+		"; d=" + d.Domain + "; s=" + d.Selector + "; t=" + strconv.FormatInt(now.Unix(), 10) +
+		"; h=" + strings.Join(signedNames, ":") + "; bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + "; b="
+
+	h := sha256.New()
+	for _, field := range signed {
+		h.Write([]byte(canonicalHeaderField(field, headerCanon)))
+	}
+	// The signature field is hashed without its value nor its trailing CRLF
+	h.Write([]byte(strings.TrimSuffix(canonicalHeaderField(sigField+"\r\n", headerCanon), "\r\n")))
+
+	sig, err := d.Key.Sign(rand.Reader, h.Sum(nil), opts)
+	if err != nil {
+		return nil, fmt.Errorf("error signing message: %w", err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(sigField)
+	// Whitespace in the signature is ignored, so it's folded to keep the lines short
+	encoded := base64.StdEncoding.EncodeToString(sig)
+	for len(encoded) > 72 {
+		buf.WriteString(encoded[:72] + "\r\n ")
+		encoded = encoded[72:]
+	}
+	buf.WriteString(encoded + "\r\n")
+	buf.Write(msg)
+	return buf.Bytes(), nil
+}
+
+// normalizeLineBreaks returns the message provided with all its line breaks as CRLF.
+func normalizeLineBreaks(msg []byte) []byte {
+	msg = bytes.Replace(msg, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(msg, []byte("\n"), []byte("\r\n"), -1)
+}
+
+// splitMessage returns the header fields of the message provided, each with its continuation lines and trailing CRLF,
+// and its body. The message must have CRLF line breaks.
+func splitMessage(msg []byte) (fields []string, body []byte) {
+	header := msg
+	if i := bytes.Index(msg, []byte("\r\n\r\n")); i >= 0 {
+		header, body = msg[:i+2], msg[i+4:]
+	}
+
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) != 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields, body
+}
+
+// selectHeaderFields returns the header fields provided with the names provided and their names.
+// If a name appears several times in the list, its instances are selected from the last one upwards, like DKIM does.
+func selectHeaderFields(fields, names []string) (selected, selectedNames []string) {
+	used := make(map[int]bool)
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(headerFieldName(fields[i]), name) {
+				used[i] = true
+				selected = append(selected, fields[i])
+				selectedNames = append(selectedNames, name)
+				break
+			}
+		}
+	}
+	return selected, selectedNames
+}
+
+// headerFieldName returns the name of the header field provided.
+func headerFieldName(field string) string {
+	if i := strings.IndexByte(field, ':'); i >= 0 {
+		return strings.TrimSpace(field[:i])
+	}
+	return ""
+}
+
+// canonicalHeaderField returns the header field provided, with its trailing CRLF,
+// canonicalized with the algorithm provided.
+func canonicalHeaderField(field, canonicalization string) string {
+	if canonicalization == CanonicalizationSimple {
+		return field
+	}
+
+	name, value := field, ""
+	if i := strings.IndexByte(field, ':'); i >= 0 {
+		name, value = field[:i], field[i+1:]
+	}
+	value = strings.Replace(value, "\r\n", "", -1)
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.Join(strings.Fields(value), " ") + "\r\n"
+}
+
+// canonicalBody returns the body provided, with CRLF line breaks, canonicalized with the algorithm provided.
+func canonicalBody(body []byte, canonicalization string) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	if canonicalization != CanonicalizationSimple {
+		for i := range lines {
+			lines[i] = strings.TrimRight(collapseWhitespace(lines[i]), " ")
+		}
+	}
+
+	// Empty lines at the end are ignored
+	for len(lines) != 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if canonicalization == CanonicalizationSimple {
+			return []byte("\r\n")
+		}
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// collapseWhitespace returns the line provided with each sequence of spaces and tabs replaced by a single space.
+func collapseWhitespace(line string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range line {
+		if r == ' ' || r == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
@@ -0,0 +1,331 @@
+package sender
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Keys of the examples of RFC 8463 appendix A.
+const (
+	rfc8463Ed25519Seed  = "nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A="
+	rfc8463RSAPublicKey = "MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDkHlOQoBTzWRiGs5V6NpP3idY6Wk08a5qhdR6wy5bdOKb2jLQiY/J16JYi0Qvx/byY" +
+		"zCNb3W91y3FutACDfzwQ/BC/e/8uBsCR+yz1Lxj+PL6lHvqMKrM3rG4hstT5QjvHO9PzoxZyVYLzBfO2EeC3Ip3G+2kryOTIKT+l/K4w3QIDAQAB"
+)
+
+// rfc8463Message is the message of the examples of RFC 8463 appendix A.
+const rfc8463Message = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+// rfc8463Signatures are the Ed25519 and RSA signatures of rfc8463Message in RFC 8463 appendix A.
+var rfc8463Signatures = []string{
+	"DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+		" subject : date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+		" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n",
+	"DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=test; t=1528637909; h=from : to : subject :\r\n" +
+		" date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=F45dVWDfMbQDGHJFlXUNB2HKfbCeLRyhDXgFpEL8GwpsRe0IeIixNTe3\r\n" +
+		" DhCVlUrSjV4BwcVcOF6+FF3Zo9Rpo1tFOeS9mPYQTnGdaSGsgeefOsk2Jz\r\n" +
+		" dA+L10TeYt9BgDfQNZtKdN1WO//KgIqXP7OdEFE4LjFYNcUxZQ4FADY+8=\r\n",
+}
+
+// errBodyHash is returned by verifyDKIM when the hash of the body doesn't match.
+var errBodyHash = errors.New("body hash doesn't match")
+
+// regexDKIMSignature matches the value of the b= tag of a DKIM-Signature header field.
+var regexDKIMSignature = regexp.MustCompile(`(;\s*b=)[^;]*`)
+
+// verifyDKIM verifies the DKIM signature at the top of the message provided with the public key provided,
+// following RFC 6376 section 6.1.3. It's checked against the signatures of RFC 8463 in TestDKIM_rfc8463.
+func verifyDKIM(t *testing.T, msg []byte, pub crypto.PublicKey) error {
+	t.Helper()
+	fields, body := splitMessage(msg)
+	if len(fields) == 0 || headerFieldName(fields[0]) != "DKIM-Signature" {
+		t.Fatalf("DKIM-Signature not found in message:\n%s", msg)
+	}
+	sigField := fields[0]
+
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(sigField[strings.IndexByte(sigField, ':')+1:], ";") {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) == 2 {
+			tags[strings.TrimSpace(parts[0])] = strings.Join(strings.Fields(parts[1]), "")
+		}
+	}
+	canon := strings.SplitN(tags["c"], "/", 2)
+	if tags["v"] != "1" || len(canon) != 2 {
+		t.Fatalf("invalid DKIM-Signature: %s", sigField)
+	}
+
+	bodyHash := sha256.Sum256(canonicalBody(body, canon[1]))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return errBodyHash
+	}
+
+	h := sha256.New()
+	signed, _ := selectHeaderFields(fields[1:], strings.Split(tags["h"], ":"))
+	for _, field := range signed {
+		h.Write([]byte(canonicalHeaderField(field, canon[0])))
+	}
+	unsigned := regexDKIMSignature.ReplaceAllString(sigField, "$1")
+	h.Write([]byte(strings.TrimSuffix(canonicalHeaderField(unsigned, canon[0]), "\r\n")))
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatalf("invalid signature: %s", err)
+	}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if tags["a"] != "rsa-sha256" {
+			t.Fatalf("unexpected algorithm %s", tags["a"])
+		}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, h.Sum(nil), sig)
+	case ed25519.PublicKey:
+		if tags["a"] != "ed25519-sha256" {
+			t.Fatalf("unexpected algorithm %s", tags["a"])
+		}
+		if !ed25519.Verify(pub, h.Sum(nil), sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	t.Fatalf("unsupported public key %T", pub)
+	return nil
+}
+
+func TestDKIM_canonicalization(t *testing.T) {
+	// Example of RFC 6376 section 3.4.5
+	msg := []byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n")
+	fields, body := splitMessage(msg)
+	if len(fields) != 2 {
+		t.Fatalf("unexpected header fields: %q", fields)
+	}
+
+	tests := []struct {
+		canonicalization string
+		expectedHeader   string
+		expectedBody     string
+	}{
+		{CanonicalizationRelaxed, "a:X\r\nb:Y Z\r\n", " C\r\nD E\r\n"},
+		{CanonicalizationSimple, "A: X\r\nB : Y\t\r\n\tZ  \r\n", " C \r\nD \t E\r\n"},
+	}
+	for _, test := range tests {
+		header := canonicalHeaderField(fields[0], test.canonicalization) + canonicalHeaderField(fields[1], test.canonicalization)
+		if header != test.expectedHeader {
+			t.Errorf("%s header canonicalization dont match:\n-> Expected: %q\n-> Found: %q",
+				test.canonicalization, test.expectedHeader, header)
+		}
+		if b := string(canonicalBody(body, test.canonicalization)); b != test.expectedBody {
+			t.Errorf("%s body canonicalization dont match:\n-> Expected: %q\n-> Found: %q",
+				test.canonicalization, test.expectedBody, b)
+		}
+	}
+
+	if b := string(canonicalBody(nil, CanonicalizationSimple)); b != "\r\n" {
+		t.Errorf("unexpected simple canonicalization of an empty body: %q", b)
+	}
+	if b := canonicalBody([]byte("\r\n\r\n"), CanonicalizationRelaxed); len(b) != 0 {
+		t.Errorf("unexpected relaxed canonicalization of an empty body: %q", b)
+	}
+}
+
+func TestDKIM_rfc8463(t *testing.T) {
+	seed, _ := base64.StdEncoding.DecodeString(rfc8463Ed25519Seed)
+	edKey := ed25519.NewKeyFromSeed(seed)
+	der, _ := base64.StdEncoding.DecodeString(rfc8463RSAPublicKey)
+	rsaPub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		t.Fatalf("error parsing RSA public key: %s", err)
+	}
+
+	// The signatures of the RFC
+	for i, pub := range []crypto.PublicKey{edKey.Public(), rsaPub} {
+		if err = verifyDKIM(t, []byte(rfc8463Signatures[i]+rfc8463Message), pub); err != nil {
+			t.Errorf("signature #%d of RFC 8463 not verified: %s", i+1, err)
+		}
+	}
+
+	// Signatures of the message made with the key of the RFC, verified with go-msgauth and kept as they are
+	// deterministic with Ed25519
+	tests := []struct {
+		canonicalization string
+		expected         string
+	}{
+		{CanonicalizationRelaxed, "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed; d=football.example.com; s=brisbane; " +
+			"t=1528637909; h=From:Subject:Date:To:Message-ID; bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=; " +
+			"b=ryUG0du9wPlfhkwu51N7Sanr4RualeVn9924d0rOncCe1a7KDgLGiE+W9Ea1HR4nw2YuY1qY\r\n SAsgk/vnEfnADg==\r\n"},
+		{CanonicalizationSimple, "DKIM-Signature: v=1; a=ed25519-sha256; c=simple/simple; d=football.example.com; s=brisbane; " +
+			"t=1528637909; h=From:Subject:Date:To:Message-ID; bh=4bLNXImK9drULnmePzZNEBleUanJCX5PIsDIFoH4KTQ=; " +
+			"b=RBqrCwNvhRrETQ9qJqAGOv7RnjyjsYhM7jnnsLAweGvUR1TskAA5k32gph5Y26XL1baoAYiu\r\n fpXjBevcwUCzBw==\r\n"},
+	}
+	for _, test := range tests {
+		d := &DKIM{
+			Domain:                 "football.example.com",
+			Selector:               "brisbane",
+			Key:                    edKey,
+			HeaderCanonicalization: test.canonicalization,
+			BodyCanonicalization:   test.canonicalization,
+		}
+		signed, err := d.sign([]byte(rfc8463Message), time.Unix(1528637909, 0))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if expected := test.expected + rfc8463Message; string(signed) != expected {
+			t.Errorf("%s signature dont match:\n-> Expected: %q\n-> Found: %q", test.canonicalization, expected, signed)
+		}
+	}
+}
+
+func TestDKIM_Sign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating RSA key: %s", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating Ed25519 key: %s", err)
+	}
+
+	sm := &Mail{
+		WebName:    "mywebsite.com",
+		Recipients: Recipients{To: []string{"test@mywebsite.com"}},
+		Account:    Account{Username: "no-reply@mywebsite.com"},
+		ReplyTo:    true,
+	}
+	msg, err := sm.createMessage(newTestForm("John Doe", "john@example.com", "Hello,\n\n  this is  a test.  \n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, key := range []crypto.Signer{rsaKey, edKey} {
+		for _, canon := range [][2]string{
+			{"", ""},
+			{CanonicalizationSimple, CanonicalizationSimple},
+			{CanonicalizationRelaxed, CanonicalizationSimple},
+			{CanonicalizationSimple, CanonicalizationRelaxed},
+		} {
+			d := &DKIM{
+				Domain:                 "mywebsite.com",
+				Selector:               "forms",
+				Key:                    key,
+				HeaderCanonicalization: canon[0],
+				BodyCanonicalization:   canon[1],
+			}
+			signed, err := d.sign(msg, time.Unix(1528637909, 0))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !bytes.HasSuffix(signed, msg) {
+				t.Fatalf("message modified when signed:\n%s", signed)
+			}
+
+			sigField, _ := splitMessage(signed)
+			for _, tag := range []string{"d=mywebsite.com;", "s=forms;", "t=1528637909;", "h=From:Reply-To:Subject:Date:To:Message-ID:MIME-Version:Content-Type;"} {
+				if !strings.Contains(sigField[0], tag) {
+					t.Errorf("tag %s not found in %s", tag, sigField[0])
+				}
+			}
+			for _, line := range strings.Split(sigField[0], "\r\n") {
+				if len(line) > 998 {
+					t.Errorf("line too long in %s", sigField[0])
+				}
+			}
+
+			if err = verifyDKIM(t, signed, key.Public()); err != nil {
+				t.Errorf("signature with %T and canonicalization %q not verified: %s", key, canon, err)
+			}
+			// Whitespace changes allowed by the relaxed canonicalization
+			if canon[0] != CanonicalizationSimple {
+				relaxed := bytes.Replace(signed, []byte("\r\nSubject: "), []byte("\r\nsubject:\t "), 1)
+				if err = verifyDKIM(t, relaxed, key.Public()); err != nil {
+					t.Errorf("signature with %T and relaxed header not verified: %s", key, err)
+				}
+			}
+			tampered := bytes.Replace(signed, []byte("Message from mywebsite.com"), []byte("Message from evil.com"), 1)
+			if err = verifyDKIM(t, tampered, key.Public()); err == nil {
+				t.Errorf("signature with %T of a tampered message verified", key)
+			}
+		}
+	}
+}
+
+func TestLoadDKIMKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dkim")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("error generating RSA key: %s", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating Ed25519 key: %s", err)
+	}
+	pkcs8RSA, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+	pkcs8Ed, _ := x509.MarshalPKCS8PrivateKey(edKey)
+
+	for name, block := range map[string]*pem.Block{
+		"pkcs1.pem":   {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+		"pkcs8.pem":   {Type: "PRIVATE KEY", Bytes: pkcs8RSA},
+		"ed25519.pem": {Type: "PRIVATE KEY", Bytes: pkcs8Ed},
+		"cert.pem":    {Type: "CERTIFICATE", Bytes: []byte{1, 2, 3}},
+	} {
+		path := filepath.Join(dir, name)
+		if err = ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatalf("error writing key: %s", err)
+		}
+
+		key, err := LoadDKIMKey(path)
+		if name == "cert.pem" {
+			if err == nil {
+				t.Error("no error found for a certificate")
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error loading %s: %s", name, err)
+			continue
+		}
+		if name == "ed25519.pem" && !bytes.Equal(key.(ed25519.PrivateKey), edKey) ||
+			name != "ed25519.pem" && key.(*rsa.PrivateKey).N.Cmp(rsaKey.N) != 0 {
+			t.Errorf("unexpected key loaded from %s", name)
+		}
+	}
+
+	if _, err = LoadDKIMKey(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("no error found for a missing file")
+	}
+}
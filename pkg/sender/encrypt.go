@@ -0,0 +1,37 @@
+package sender
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Encrypter represents a type that encrypts messages for their recipients, like OpenPGP or SMIME.
+type Encrypter interface {
+	// Encrypt returns the MIME entity provided (its header fields and body, with CRLF line breaks)
+	// encrypted as another MIME entity.
+	Encrypt(entity []byte) ([]byte, error)
+}
+
+// encryptMessage returns the message provided with its content encrypted with the Encrypter provided.
+// The content header fields (Content-*) are encrypted with the body, and the rest, like the subject, are kept.
+func encryptMessage(msg []byte, e Encrypter) ([]byte, error) {
+	fields, body := splitMessage(normalizeLineBreaks(msg))
+
+	var header, entity bytes.Buffer
+	for _, field := range fields {
+		if strings.HasPrefix(strings.ToLower(headerFieldName(field)), "content-") {
+			entity.WriteString(field)
+		} else {
+			header.WriteString(field)
+		}
+	}
+	entity.WriteString("\r\n")
+	entity.Write(body)
+
+	encrypted, err := e.Encrypt(entity.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	header.Write(encrypted)
+	return header.Bytes(), nil
+}
@@ -0,0 +1,54 @@
+package sender
+
+import (
+	"bytes"
+	"crypto/x509"
+	"strings"
+	"testing"
+)
+
+func TestMail_Send_encrypted(t *testing.T) {
+	srv, _ := newFakeSMTP(t, false, false)
+	defer srv.Close()
+	cert, key := newSMIMECertificate(t, "test@mywebsite.com")
+
+	sm := &Mail{
+		WebName:    "mywebsite.com",
+		Recipients: Recipients{To: []string{"test@mywebsite.com"}},
+		Account:    srv.account(TLSNone, AuthPlain, nil),
+		Encrypter:  &SMIME{Certificates: []*x509.Certificate{cert}},
+	}
+	if err := sm.Send(newTestForm("John Doe", "john@example.com", "My medical record")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	sessions := srv.Sessions()
+	if countMessages(sessions) != 1 {
+		t.Fatalf("unexpected number of messages: %d", countMessages(sessions))
+	}
+	data := []byte(sessions[0].messages[0].data)
+	if bytes.Contains(data, []byte("medical")) {
+		t.Fatalf("message not encrypted:\n%s", data)
+	}
+
+	// The header is kept, except the content fields
+	msg := parseMessage(t, data)
+	for header, expected := range map[string]string{
+		"From":         fakeSMTPUsername,
+		"To":           "test@mywebsite.com",
+		"Subject":      "Message from mywebsite.com",
+		"MIME-Version": "1.0",
+	} {
+		if value := msg.Header.Get(header); value != expected {
+			t.Errorf("Unexpected %s header.\n-> Expected: \"%s\"\n-> Found: \"%s\"", header, expected, value)
+		}
+	}
+
+	entity := parseMessage(t, decryptSMIME(t, data, cert, key))
+	if len(entity.Header) != 1 {
+		t.Errorf("unexpected header of the encrypted entity: %v", entity.Header)
+	}
+	parts := readAlternative(t, entity.Header.Get("Content-Type"), entity.Body)
+	if !strings.Contains(parts["text/plain"], "My medical record") {
+		t.Errorf("form not found in the encrypted text:\n%s", parts["text/plain"])
+	}
+}
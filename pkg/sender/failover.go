@@ -0,0 +1,103 @@
+package sender
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFailoverCooldown is the time an SMTP account that failed is skipped before being tried again.
+const DefaultFailoverCooldown = time.Minute
+
+// failover tracks the health of the accounts of a Mail, so the ones whose server failed are skipped for a while.
+type failover struct {
+	mutex     sync.Mutex
+	downUntil map[int]time.Time
+}
+
+// accounts returns the indexes of the accounts provided in the order they should be tried at the moment provided:
+// the healthy ones first, and then the ones still in their cooldown, so they are tried anyway if all the others fail.
+func (fo *failover) accounts(n int, now time.Time) []int {
+	fo.mutex.Lock()
+	defer fo.mutex.Unlock()
+
+	healthy, down := make([]int, 0, n), make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		if now.Before(fo.downUntil[i]) {
+			down = append(down, i)
+		} else {
+			healthy = append(healthy, i)
+		}
+	}
+	return append(healthy, down...)
+}
+
+// succeeded records that the account with the index provided is healthy.
+func (fo *failover) succeeded(i int) {
+	fo.mutex.Lock()
+	defer fo.mutex.Unlock()
+	delete(fo.downUntil, i)
+}
+
+// failed records that the account with the index provided failed, so it's skipped until the moment provided.
+func (fo *failover) failed(i int, until time.Time) {
+	fo.mutex.Lock()
+	defer fo.mutex.Unlock()
+	if fo.downUntil == nil {
+		fo.downUntil = make(map[int]time.Time)
+	}
+	fo.downUntil[i] = until
+}
+
+// sendFailover sends the message provided to the addresses provided with the first account of the Mail that works,
+// trying them in order and skipping the ones that failed recently.
+// It stops at the first account that rejects the message permanently, since the others would do the same.
+func (sm *Mail) sendFailover(to []string, msg []byte) error {
+	accounts := make([]*Account, 0, len(sm.Fallbacks)+1)
+	accounts = append(accounts, &sm.Account)
+	for i := range sm.Fallbacks {
+		accounts = append(accounts, &sm.Fallbacks[i])
+	}
+
+	cooldown := sm.Cooldown
+	if cooldown <= 0 {
+		cooldown = DefaultFailoverCooldown
+	}
+
+	errs := make([]string, 0, len(accounts))
+	for _, i := range sm.failover.accounts(len(accounts), time.Now()) {
+		a := accounts[i]
+		var err error
+		if sm.Pool != nil {
+			err = sm.Pool.send(a, sm.fromAddress(), to, msg)
+		} else {
+			err = a.sendMail(sm.fromAddress(), to, msg)
+		}
+		if err == nil {
+			sm.failover.succeeded(i)
+			return nil
+		}
+
+		if len(accounts) == 1 {
+			return err
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", net.JoinHostPort(a.Hostname, a.Port), err))
+		if permanent(err) {
+			break
+		}
+		sm.failover.failed(i, time.Now().Add(cooldown))
+	}
+	return errors.New(strings.Join(errs, "; "))
+}
+
+// permanent checks if the error provided is a permanent rejection of a mail transaction (a 5xx reply),
+// unlike the connection, authentication and temporary errors, which may not happen with another server.
+func permanent(err error) bool {
+	var transErr *transactionError
+	var protoErr *textproto.Error
+	return errors.As(err, &transErr) && errors.As(err, &protoErr) && protoErr.Code >= 500
+}
@@ -0,0 +1,93 @@
+package sender
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMail_send_failover(t *testing.T) {
+	primary, _ := newFakeSMTP(t, false, false)
+	defer primary.Close()
+	secondary, _ := newFakeSMTP(t, false, false)
+	defer secondary.Close()
+
+	sm := &Mail{
+		Account:   primary.account(TLSNone, AuthPlain, nil),
+		Fallbacks: []Account{secondary.account(TLSNone, AuthLogin, nil)},
+		Cooldown:  100 * time.Millisecond,
+	}
+	send := func() error {
+		return sm.send([]string{"b@example.com"}, []byte("Hi\r\n"))
+	}
+
+	// Temporary failure of the primary server
+	primary.SetMailReply("451 try again later")
+	if err := send(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := countMessages(secondary.Sessions()); n != 1 {
+		t.Errorf("message not sent with the fallback account: %d messages", n)
+	}
+
+	// The primary server is skipped during the cooldown
+	if err := send(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := len(primary.Sessions()); n != 1 {
+		t.Errorf("primary server not skipped during the cooldown: %d sessions", n)
+	}
+
+	// The primary server is used again after the cooldown
+	primary.SetMailReply("")
+	time.Sleep(150 * time.Millisecond)
+	if err := send(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := countMessages(primary.Sessions()); n != 1 {
+		t.Errorf("primary server not used after the cooldown: %d messages", n)
+	}
+
+	// Permanent rejections don't fail over
+	if err := sm.send([]string{"rejected@example.com"}, []byte("Hi\r\n")); err == nil {
+		t.Error("no error found for a rejected recipient")
+	}
+	if n := len(secondary.Sessions()); n != 2 {
+		t.Errorf("permanent rejection failed over: %d sessions of the fallback", n)
+	}
+}
+
+func TestMail_send_failoverDown(t *testing.T) {
+	srv, _ := newFakeSMTP(t, false, false)
+	defer srv.Close()
+
+	// An address where nothing is listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+	down := Account{Hostname: host, Port: port, Auth: AuthNone}
+
+	sm := &Mail{Account: down, Fallbacks: []Account{srv.account(TLSNone, AuthPlain, nil)}, Pool: &Pool{}}
+	defer sm.Pool.Close()
+	if err = sm.send([]string{"b@example.com"}, []byte("Hi\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := countMessages(srv.Sessions()); n != 1 {
+		t.Errorf("message not sent with the fallback account: %d messages", n)
+	}
+
+	// All the accounts are tried when all of them are failing
+	srv.SetMailReply("421 shutting down")
+	err = sm.send([]string{"b@example.com"}, []byte("Hi\r\n"))
+	if err == nil || !strings.Contains(err.Error(), port) || !strings.Contains(err.Error(), "421") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	srv.SetMailReply("")
+	if err = sm.send([]string{"b@example.com"}, []byte("Hi\r\n")); err != nil {
+		t.Errorf("unexpected error with all the accounts in cooldown: %s", err)
+	}
+}
@@ -0,0 +1,116 @@
+package sender
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maildirCounter is used to make unique the names of the files delivered to a Maildir.
+var maildirCounter uint64
+
+// regexMboxFrom matches the lines that must be escaped in a mbox file (mboxrd format).
+var regexMboxFrom = regexp.MustCompile("(?m)^(>*From )")
+
+// Maildir represents a type that delivers forms as messages in a local Maildir.
+// The messages are from the submitter of the form, so they don't need a "Reply-To" header.
+type Maildir struct {
+	WebName   string
+	Path      string
+	Templates *Templates
+}
+
+// Send will deliver the form provided to the Maildir.
+// The message is written in the "tmp" directory and then moved to the "new" directory, as Maildir requires.
+func (md *Maildir) Send(f *form.Form) error {
+	msg, err := createMessage(submitter(f), nil, md.WebName, false, md.Templates, f)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(md.Path, dir), 0700); err != nil {
+			return fmt.Errorf("error creating maildir: %s", err)
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	name := strconv.FormatInt(time.Now().Unix(), 10) + "." +
+		"P" + strconv.Itoa(os.Getpid()) + "Q" + strconv.FormatUint(atomic.AddUint64(&maildirCounter, 1), 10) + "." +
+		hostname
+	tmpPath := filepath.Join(md.Path, "tmp", name)
+
+	if err = ioutil.WriteFile(tmpPath, msg, 0600); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error writing message to maildir: %s", err)
+	}
+
+	if err = os.Rename(tmpPath, filepath.Join(md.Path, "new", name)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error delivering message to maildir: %s", err)
+	}
+	return nil
+}
+
+// Mbox represents a type that appends forms as messages to a local mbox file.
+// The messages are from the submitter of the form, so they don't need a "Reply-To" header.
+type Mbox struct {
+	WebName   string
+	Path      string
+	Templates *Templates
+
+	mutex sync.Mutex
+}
+
+// Send will append the form provided to the mbox file, creating it if it doesn't exist.
+func (mb *Mbox) Send(f *form.Form) error {
+	from := submitter(f)
+	msg, err := createMessage(from, nil, mb.WebName, false, mb.Templates, f)
+	if err != nil {
+		return err
+	}
+	msg = bytes.Replace(msg, []byte("\r\n"), []byte("\n"), -1)
+
+	var buf bytes.Buffer
+	buf.WriteString("From " + from + " " + time.Now().UTC().Format(time.ANSIC) + "\n")
+	buf.Write(regexMboxFrom.ReplaceAll(msg, []byte(">$1")))
+	buf.WriteString("\n")
+
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	file, err := os.OpenFile(mb.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening mbox: %s", err)
+	}
+	defer file.Close()
+
+	if _, err = file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("error writing message to mbox: %s", err)
+	}
+
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("error closing mbox: %s", err)
+	}
+	return nil
+}
+
+// submitter returns the address used as sender of the messages that contain the form provided.
+// It's the email of the submitter, if the form has one.
+func submitter(f *form.Form) string {
+	if mail := f.Email(); mail != "" {
+		return mail
+	}
+	return "MAILER-DAEMON"
+}
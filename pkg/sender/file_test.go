@@ -0,0 +1,81 @@
+package sender
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaildir_Send(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	md := Maildir{WebName: "mywebsite.com", Path: dir}
+	f := newTestForm("John", "john@example.com", "Hi")
+	if err = md.Send(f); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one message in maildir: %v, %s", files, err)
+	}
+	if tmpFiles, _ := ioutil.ReadDir(filepath.Join(dir, "tmp")); len(tmpFiles) != 0 {
+		t.Errorf("messages left in tmp: %v", tmpFiles)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "new", files[0].Name()))
+	if err != nil {
+		t.Fatalf("error reading message: %s", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("error parsing message: %s", err)
+	}
+	if from, subject := msg.Header.Get("From"), msg.Header.Get("Subject"); from != "john@example.com" || subject != "Message from mywebsite.com" {
+		t.Errorf("unexpected message: from %s, subject %s", from, subject)
+	}
+}
+
+func TestMbox_Send(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbox")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mb := Mbox{WebName: "mywebsite.com", Path: filepath.Join(dir, "mbox")}
+	for _, msg := range []string{"First message", "Second message"} {
+		if err = mb.Send(newTestForm("John", "john@example.com", msg)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(mb.Path)
+	if err != nil {
+		t.Fatalf("error reading mbox: %s", err)
+	}
+	mbox := string(data)
+
+	if n := strings.Count(mbox, "\nFrom ") + 1; !strings.HasPrefix(mbox, "From john@example.com ") || n != 2 {
+		t.Errorf("expected 2 messages in mbox, found %d:\n%s", n, mbox)
+	}
+	if strings.Contains(mbox, "\r") {
+		t.Error("mbox contains CR characters")
+	}
+}
+
+func TestMbox_escape(t *testing.T) {
+	input := "From: john@example.com\nFrom here\n>From there\nNot From here"
+	expected := "From: john@example.com\n>From here\n>>From there\nNot From here"
+	if result := string(regexMboxFrom.ReplaceAll([]byte(input), []byte(">$1"))); result != expected {
+		t.Errorf("Unexpected escaping:\n-> Expected: %s\n-> Found: %s", expected, result)
+	}
+}
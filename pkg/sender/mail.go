@@ -2,57 +2,189 @@ package sender
 
 import (
 	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
 	"html"
-	"net/smtp"
+	"net/mail"
 	"strings"
+	"time"
 )
 
-// Mail represents a type that send forms via SMTP
+// Mail represents a type that send forms via SMTP, with the SMTP account it embeds.
+//
+// The messages are sent from From (Username if empty), with FromName as display name if it's not empty.
+// If ReplyTo is true, replies to the messages are addressed to the submitter of the form.
+//
+// The messages are sent to the recipients of the first of the Routes that matches the form,
+// or to Recipients if none matches.
+//
+// If Pool is not nil, the messages are sent with its connections. Otherwise, a new connection is opened for each one.
+//
+// If the server of the account fails to connect, authenticate or accept a message temporarily,
+// the Fallbacks are tried in order. Accounts that fail are skipped for Cooldown (DefaultFailoverCooldown if zero),
+// unless all the others fail too. The messages are always sent from the same address.
+//
+// If Encrypter is not nil, the content of the messages (the body and the attachments) is encrypted with it,
+// keeping the header. If DKIM is not nil, the messages are signed with it, after being encrypted.
 type Mail struct {
-	WebName         string
-	RecaptchaSecret string
-	Mailto          string
-	Username        string
-	Password        string
-	Hostname        string
-	Port            string
+	WebName    string
+	Recipients Recipients
+	Routes     []Route
+	Account
+	From      string
+	Fallbacks []Account
+	Cooldown  time.Duration
+	Pool      *Pool
+	FromName  string
+	ReplyTo   bool
+	Templates *Templates
+	DKIM      *DKIM
+	Encrypter Encrypter
+
+	failover failover
+}
+
+// Recipients represents the addresses a message is sent to. The addresses can have a display name.
+// Bcc recipients receive the message, but they are not included in its header.
+type Recipients struct {
+	To  []string
+	Cc  []string
+	Bcc []string
+}
+
+// Route represents a rule that selects the recipients of the forms whose field Field has the value Value,
+// compared case-insensitively.
+type Route struct {
+	Field      string
+	Value      string
+	Recipients Recipients
 }
 
 // Send will send the form provided via SMTP
-func (sm *Mail) Send(name, mail, msg string) error {
-	err := smtp.SendMail(
-		sm.Hostname+":"+sm.Port,
-		smtp.PlainAuth("", sm.Username, sm.Password, sm.Hostname),
-		sm.Username,
-		[]string{sm.Mailto},
-		sm.createMessage(name, mail, msg),
-	)
+func (sm *Mail) Send(f *form.Form) error {
+	rcpt := sm.recipients(f)
+	msg, err := createMessage(sm.from(), rcpt, sm.WebName, sm.ReplyTo, sm.Templates, f)
 	if err != nil {
+		return err
+	}
+	if sm.Encrypter != nil {
+		if msg, err = encryptMessage(msg, sm.Encrypter); err != nil {
+			return fmt.Errorf("error encrypting mail: %w", err)
+		}
+	}
+	return sm.send(rcpt.all(), msg)
+}
+
+// recipients returns the recipients of the form provided, according to the routes.
+func (sm *Mail) recipients(f *form.Form) *Recipients {
+	for i := range sm.Routes {
+		if strings.EqualFold(f.Get(sm.Routes[i].Field), sm.Routes[i].Value) {
+			return &sm.Routes[i].Recipients
+		}
+	}
+	return &sm.Recipients
+}
+
+// all returns the addresses of all the recipients, without display names, as the SMTP envelope requires.
+func (r *Recipients) all() []string {
+	all := make([]string, 0, len(r.To)+len(r.Cc)+len(r.Bcc))
+	for _, list := range [][]string{r.To, r.Cc, r.Bcc} {
+		for _, address := range list {
+			if addr, err := mail.ParseAddress(address); err == nil {
+				address = addr.Address
+			}
+			all = append(all, address)
+		}
+	}
+	return all
+}
+
+// send will send the message provided to the addresses provided via SMTP.
+func (sm *Mail) send(to []string, msg []byte) error {
+	if sm.DKIM != nil {
+		var err error
+		if msg, err = sm.DKIM.Sign(msg); err != nil {
+			return err
+		}
+	}
+	if err := sm.sendFailover(to, msg); err != nil {
 		return fmt.Errorf("error sending mail: %s", err)
 	}
 	return nil
 }
 
+// from returns the address the messages are sent from, with its display name.
+func (sm *Mail) from() string {
+	if sm.FromName == "" {
+		return sm.fromAddress()
+	}
+	return (&mail.Address{Name: sm.FromName, Address: sm.fromAddress()}).String()
+}
+
+// fromAddress returns the address the messages are sent from, which is used in the SMTP envelope too.
+func (sm *Mail) fromAddress() string {
+	if sm.From != "" {
+		return sm.From
+	}
+	return sm.Username
+}
+
+// Message returns the message that Send would send for the form provided, before encrypting and signing it.
+func (sm *Mail) Message(f *form.Form) ([]byte, error) {
+	return sm.createMessage(f)
+}
+
 // createMessage will return a byte slice containing a styled message from the form provided.
-func (sm *Mail) createMessage(name, mail, msg string) []byte {
-	return []byte(fmt.Sprintf(
-		"From: %s\r\n"+
-			"To: %s\r\n"+
-			"Subject: Message from %s\r\n"+
-			"Content-Type: text/html; charset=UTF-8\r\n"+
-			"\r\n"+
-			"<html><body>"+
-			"<b>Name</b>: %s<br>"+
-			"<b>Email</b>: %s<br>"+
-			"<b>Message</b>: %s"+
-			"</body></html>\r\n",
-		sm.Username,
-		sm.Mailto,
-		sm.WebName,
-		html.EscapeString(name),
-		html.EscapeString(mail),
-		lfToBr(html.EscapeString(msg)),
-	))
+func (sm *Mail) createMessage(f *form.Form) ([]byte, error) {
+	return createMessage(sm.from(), sm.recipients(f), sm.WebName, sm.ReplyTo, sm.Templates, f)
+}
+
+// createMessage will return a byte slice containing a message from the form provided,
+// addressed from and to the addresses provided. The recipients can be nil, in which case the "To" header is omitted.
+// The message has a plain text and a styled HTML version of the form, built with the templates provided
+// (which can be nil), and the files of the form attached.
+// If replyTo is true, the "Reply-To" header is set to the address of the submitter.
+// The extra header fields of the form are added to the header.
+func createMessage(from string, rcpt *Recipients, webName string, replyTo bool, t *Templates, f *form.Form) ([]byte, error) {
+	subject, text, html, err := t.execute(webName, f)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &message{
+		From:    from,
+		Subject: subject,
+		Text:    text,
+		HTML:    html,
+		Files:   f.Files,
+		Extra:   f.Headers,
+	}
+	if rcpt != nil {
+		m.To = rcpt.To
+		m.Cc = rcpt.Cc
+	}
+	if replyTo {
+		m.ReplyTo = submitterAddress(f)
+	}
+	return m.Bytes(), nil
+}
+
+// submitterAddress returns the address of the submitter of the form provided, with their name as display name.
+// It returns an empty string if the form has no email.
+func submitterAddress(f *form.Form) string {
+	email := f.Email()
+	if email == "" {
+		return ""
+	}
+	return (&mail.Address{Name: f.Name(), Address: email}).String()
+}
+
+// createHTML will return a styled HTML representation of the form provided. It's the default HTML body.
+func createHTML(f *form.Form) string {
+	rows := make([]string, len(f.Values))
+	for i, v := range f.Values {
+		rows[i] = "<b>" + html.EscapeString(v.Label) + "</b>: " + lfToBr(html.EscapeString(v.Display()))
+	}
+	return "<html><body>" + strings.Join(rows, "<br>") + "</body></html>"
 }
 
 // lfToBr will replace the End-of-Line characters ("\r\n" and "\n") for the HTML tag "<br>" (without quotes).
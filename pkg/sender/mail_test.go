@@ -1,6 +1,27 @@
 package sender
 
-import "testing"
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+// newTestForm returns a form of the default schema with the values provided.
+func newTestForm(name, mail, msg string) *form.Form {
+	return &form.Form{Values: []form.Value{
+		{Name: "name", Label: "Name", Type: form.TypeText, Value: name},
+		{Name: "mail", Label: "Email", Type: form.TypeEmail, Value: mail},
+		{Name: "msg", Label: "Message", Type: form.TypeMultiline, Value: msg},
+	}}
+}
 
 func TestMail_lfToBr(t *testing.T) {
 	input := "This is a test with \nUnix line breaks and \r\nWindows line breaks"
@@ -13,27 +34,282 @@ func TestMail_lfToBr(t *testing.T) {
 
 func TestMail_createMessage(t *testing.T) {
 	testMail := Mail{
-		WebName:             "mywebsite.com",
-		RecaptchaSecret: "",
-		Mailto:          "test@mywebsite.com",
-		Username:        "test@mywebsite.com",
-		Password:        "1234567890",
-		Hostname:        "mail.mywebsite.com",
-		Port:            "587",
+		WebName:    "mywebsite.com",
+		Recipients: Recipients{To: []string{"test@mywebsite.com"}},
+		Account: Account{
+			Username: "test@mywebsite.com",
+			Password: "1234567890",
+			Hostname: "mail.mywebsite.com",
+			Port:     "587",
+		},
 	}
 
 	inputName := "This is an <script src=\"hack.js\"></script>unsafe name"
 	inputMail := "-123ABCabc!#$%&'*+/=?^_`{|}.~@-456DEFdef_.~.GHIghi"
 	inputMsg := "<b>You've win $2000.</b>\nThis is totally not an scam and unsafe message.\n<a href=\"hack.js\">Click here to get hacked</a>"
-	expectedResult := "From: test@mywebsite.com\r\n" +
-		"To: test@mywebsite.com\r\n" +
-		"Subject: Message from mywebsite.com\r\n" +
-		"Content-Type: text/html; charset=UTF-8\r\n" +
-		"\r\n" +
-		"<html><body><b>Name</b>: This is an &lt;script src=&#34;hack.js&#34;&gt;&lt;/script&gt;unsafe name<br><b>Email</b>: -123ABCabc!#$%&amp;&#39;*+/=?^_`{|}.~@-456DEFdef_.~.GHIghi<br><b>Message</b>: &lt;b&gt;You&#39;ve win $2000.&lt;/b&gt;<br>This is totally not an scam and unsafe message.<br>&lt;a href=&#34;hack.js&#34;&gt;Click here to get hacked&lt;/a&gt;</body></html>\r\n"
-
-	result := string(testMail.createMessage(inputName, inputMail, inputMsg))
-	if result != expectedResult {
-		t.Errorf("Error creating message.\n-> Expected message: \"%s\"\n-> Message found: \"%s\"", expectedResult, result)
+	expectedText := "Message from mywebsite.com\r\n" +
+		"Name: " + inputName + "\r\n" +
+		"Email: " + inputMail + "\r\n" +
+		"Message:\r\n" + strings.Replace(inputMsg, "\n", "\r\n", -1)
+	expectedHTML := "<html><body><b>Name</b>: This is an &lt;script src=&#34;hack.js&#34;&gt;&lt;/script&gt;unsafe name<br><b>Email</b>: -123ABCabc!#$%&amp;&#39;*+/=?^_`{|}.~@-456DEFdef_.~.GHIghi<br><b>Message</b>: &lt;b&gt;You&#39;ve win $2000.&lt;/b&gt;<br>This is totally not an scam and unsafe message.<br>&lt;a href=&#34;hack.js&#34;&gt;Click here to get hacked&lt;/a&gt;</body></html>"
+
+	data, err := testMail.createMessage(newTestForm(inputName, inputMail, inputMsg))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	msg := parseMessage(t, data)
+	for header, expected := range map[string]string{
+		"From":         "test@mywebsite.com",
+		"To":           "test@mywebsite.com",
+		"Subject":      "Message from mywebsite.com",
+		"MIME-Version": "1.0",
+	} {
+		if value := msg.Header.Get(header); value != expected {
+			t.Errorf("Unexpected %s header.\n-> Expected: \"%s\"\n-> Found: \"%s\"", header, expected, value)
+		}
+	}
+	if _, err := msg.Header.Date(); err != nil {
+		t.Errorf("invalid Date header: %s", err)
+	}
+	if id := msg.Header.Get("Message-ID"); !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@mywebsite.com>") {
+		t.Errorf("invalid Message-ID header: %s", id)
+	}
+
+	parts := readAlternative(t, msg.Header.Get("Content-Type"), msg.Body)
+	if parts["text/plain"] != expectedText {
+		t.Errorf("Error creating text part.\n-> Expected: \"%s\"\n-> Found: \"%s\"", expectedText, parts["text/plain"])
+	}
+	if parts["text/html"] != expectedHTML {
+		t.Errorf("Error creating HTML part.\n-> Expected: \"%s\"\n-> Found: \"%s\"", expectedHTML, parts["text/html"])
+	}
+}
+
+func TestMail_createMessage_encoding(t *testing.T) {
+	webName := "Café Ñandú"
+	data, err := createMessage("no-reply@example.com", nil, webName, false, nil, newTestForm("José", "jose@example.com", "¡Hola!"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	msg := parseMessage(t, data)
+
+	if raw := msg.Header.Get("Subject"); !strings.HasPrefix(raw, "=?UTF-8?q?") {
+		t.Errorf("subject not RFC 2047 encoded: %s", raw)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Message from "+webName {
+		t.Errorf("unexpected subject: %s (%v)", subject, err)
+	}
+
+	if parts := readAlternative(t, msg.Header.Get("Content-Type"), msg.Body); !strings.Contains(parts["text/plain"], "Name: José") {
+		t.Errorf("unexpected text part: %s", parts["text/plain"])
+	}
+}
+
+func TestMail_Message_headers(t *testing.T) {
+	testMail := Mail{
+		WebName:    "mywebsite.com",
+		Recipients: Recipients{To: []string{"test@mywebsite.com"}},
+		Account:    Account{Username: "no-reply@mywebsite.com"},
+	}
+	f := newTestForm("John", "john@example.com", "Hi")
+	f.Headers = map[string]string{
+		"x-spam-flag":   "YES",
+		"X-Spam-Status": "Yes, score=6.0\r\nBcc: victim@example.com",
+	}
+
+	data, err := testMail.Message(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	msg := parseMessage(t, data)
+	for header, expected := range map[string]string{
+		"X-Spam-Flag":   "YES",
+		"X-Spam-Status": "Yes, score=6.0Bcc: victim@example.com",
+		"Bcc":           "",
+	} {
+		if value := msg.Header.Get(header); value != expected {
+			t.Errorf("Unexpected %s header.\n-> Expected: \"%s\"\n-> Found: \"%s\"", header, expected, value)
+		}
+	}
+	if i, j := bytes.Index(data, []byte("X-Spam-Flag")), bytes.Index(data, []byte("X-Spam-Status")); i < 0 || j < i {
+		t.Errorf("extra headers not sorted:\n%s", data)
+	}
+}
+
+func TestMail_createMessage_replyTo(t *testing.T) {
+	testMail := Mail{
+		WebName:    "mywebsite.com",
+		Recipients: Recipients{To: []string{"test@mywebsite.com"}},
+		Account:    Account{Username: "no-reply@mywebsite.com"},
+		FromName:   "Formulario de contacto",
+		ReplyTo:    true,
+	}
+
+	tests := []struct {
+		name, mail      string
+		expectedReplyTo string
+	}{
+		{"John Smith", "john@example.com", "\"John Smith\" <john@example.com>"},
+		{"José \"Pepe\" Núñez", "jose@example.com", "=?utf-8?b?Sm9zw6kgIlBlcGUiIE7DusOxZXo=?= <jose@example.com>"},
+		{"", "anonymous@example.com", "anonymous@example.com"},
+		{"John Smith", "", ""},
+	}
+
+	for _, test := range tests {
+		data, err := testMail.createMessage(newTestForm(test.name, test.mail, "Hi"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		msg := parseMessage(t, data)
+
+		if from := msg.Header.Get("From"); from != "\"Formulario de contacto\" <no-reply@mywebsite.com>" {
+			t.Errorf("unexpected From header: %s", from)
+		}
+		if replyTo := msg.Header.Get("Reply-To"); replyTo != test.expectedReplyTo {
+			t.Errorf("Unexpected Reply-To header.\n-> Expected: %s\n-> Found: %s", test.expectedReplyTo, replyTo)
+		}
+		if test.mail == "" {
+			continue
+		}
+
+		addr, err := msg.Header.AddressList("Reply-To")
+		if err != nil || len(addr) != 1 || addr[0].Name != test.name || addr[0].Address != test.mail {
+			t.Errorf("unexpected Reply-To address: %v (%v)", addr, err)
+		}
+	}
+}
+
+func TestMail_createMessage_files(t *testing.T) {
+	f := newTestForm("John", "john@example.com", "See attached")
+	f.Files = []form.File{
+		{Field: "cv", Filename: "cv.pdf", ContentType: "application/pdf", Data: bytes.Repeat([]byte("%PDF-1.4 "), 20)},
+		{Field: "photo", Filename: "my photo.png", ContentType: "image/png", Data: []byte("\x89PNG")},
+	}
+
+	data, err := createMessage("john@example.com", nil, "mywebsite.com", false, nil, f)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	msg := parseMessage(t, data)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("unexpected content type: %s (%v)", msg.Header.Get("Content-Type"), err)
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("error reading body part: %s", err)
+	}
+	if parts := readAlternative(t, part.Header.Get("Content-Type"), part); parts["text/html"] == "" || parts["text/plain"] == "" {
+		t.Errorf("unexpected body parts: %v", parts)
+	}
+
+	for _, file := range f.Files {
+		part, err = mr.NextPart()
+		if err != nil {
+			t.Fatalf("error reading part of file %s: %s", file.Filename, err)
+		}
+		if part.FileName() != file.Filename {
+			t.Errorf("unexpected filename: expected %s - found %s", file.Filename, part.FileName())
+		}
+		data, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
+		if err != nil {
+			t.Errorf("error decoding file %s: %s", file.Filename, err)
+		} else if !bytes.Equal(data, file.Data) {
+			t.Errorf("unexpected content of file %s: %q", file.Filename, data)
+		}
+	}
+
+	if _, err = mr.NextPart(); err != io.EOF {
+		t.Errorf("unexpected extra part: %v", err)
+	}
+}
+
+// parseMessage parses the message provided, failing the test if it's invalid.
+func parseMessage(t *testing.T, data []byte) *mail.Message {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("error parsing message: %s", err)
+	}
+	return msg
+}
+
+// readAlternative returns the decoded parts of the multipart/alternative body provided, by media type.
+func readAlternative(t *testing.T, contentType string, body io.Reader) map[string]string {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("unexpected content type: %s (%v)", contentType, err)
+	}
+
+	parts := make(map[string]string)
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		// The multipart reader decodes quoted-printable parts
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatalf("error reading part: %s", err)
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatalf("error reading part: %s", err)
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		parts[partType] = string(data)
+	}
+}
+
+func TestMail_recipients(t *testing.T) {
+	testMail := Mail{
+		WebName: "mywebsite.com",
+		Account: Account{Username: "no-reply@mywebsite.com"},
+		Recipients: Recipients{
+			To:  []string{"Support <support@mywebsite.com>"},
+			Bcc: []string{"archive@mywebsite.com"},
+		},
+		Routes: []Route{
+			{Field: "name", Value: "sales", Recipients: Recipients{
+				To: []string{"sales@mywebsite.com", "boss@mywebsite.com"},
+				Cc: []string{"Señor Jefe <ceo@mywebsite.com>"},
+			}},
+			{Field: "name", Value: "press", Recipients: Recipients{To: []string{"press@mywebsite.com"}}},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		envelope   string
+		expectedTo string
+		expectedCc string
+	}{
+		{"Sales", "[sales@mywebsite.com boss@mywebsite.com ceo@mywebsite.com]",
+			"sales@mywebsite.com, boss@mywebsite.com", "=?utf-8?q?Se=C3=B1or_Jefe?= <ceo@mywebsite.com>"},
+		{"press", "[press@mywebsite.com]", "press@mywebsite.com", ""},
+		{"John", "[support@mywebsite.com archive@mywebsite.com]", "\"Support\" <support@mywebsite.com>", ""},
+	}
+
+	for _, test := range tests {
+		f := newTestForm(test.name, "john@example.com", "Hi")
+		if envelope := fmt.Sprint(testMail.recipients(f).all()); envelope != test.envelope {
+			t.Errorf("%s: unexpected envelope recipients.\n-> Expected: %s\n-> Found: %s", test.name, test.envelope, envelope)
+		}
+
+		data, err := testMail.createMessage(f)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		msg := parseMessage(t, data)
+		if to, cc := msg.Header.Get("To"), msg.Header.Get("Cc"); to != test.expectedTo || cc != test.expectedCc {
+			t.Errorf("%s: unexpected recipients.\n-> Expected: To %s, Cc %s\n-> Found: To %s, Cc %s",
+				test.name, test.expectedTo, test.expectedCc, to, cc)
+		}
+		if bcc := msg.Header.Get("Bcc"); bcc != "" {
+			t.Errorf("%s: Bcc header found: %s", test.name, bcc)
+		}
 	}
 }
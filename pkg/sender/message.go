@@ -0,0 +1,180 @@
+package sender
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// messageCounter is used to make unique the Message-ID of the messages built.
+var messageCounter uint64
+
+// message represents an email message.
+//
+// Its body is a multipart/alternative with a plain text and an HTML version, both quoted-printable encoded.
+// If it has files, the body is a multipart/mixed with the multipart/alternative followed by the files attached.
+type message struct {
+	From    string
+	To      []string
+	Cc      []string
+	ReplyTo string
+	Subject string
+	Text    string
+	HTML    string
+	Files   []form.File
+	// Date is the date of the message. If zero, the current time is used.
+	Date time.Time
+	// Extra are additional header fields, written in alphabetical order.
+	Extra map[string]string
+}
+
+// Bytes returns the message in the Internet Message Format (RFC 5322), with CRLF line breaks.
+func (m *message) Bytes() []byte {
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	contentType, body := m.body()
+
+	var buf bytes.Buffer
+	writeHeader(&buf, "From", formatAddress(m.From))
+	if len(m.To) != 0 {
+		writeHeader(&buf, "To", formatAddressList(m.To))
+	}
+	if len(m.Cc) != 0 {
+		writeHeader(&buf, "Cc", formatAddressList(m.Cc))
+	}
+	if m.ReplyTo != "" {
+		writeHeader(&buf, "Reply-To", formatAddress(m.ReplyTo))
+	}
+	writeHeader(&buf, "Subject", mime.QEncoding.Encode("UTF-8", m.Subject))
+	writeHeader(&buf, "Date", date.Format(time.RFC1123Z))
+	writeHeader(&buf, "Message-ID", messageID(m.From, date))
+	extra := make(map[string]string, len(m.Extra))
+	names := make([]string, 0, len(m.Extra))
+	for name, value := range m.Extra {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if _, ok := extra[name]; !ok {
+			names = append(names, name)
+		}
+		extra[name] = value
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeHeader(&buf, name, extra[name])
+	}
+	writeHeader(&buf, "MIME-Version", "1.0")
+	writeHeader(&buf, "Content-Type", contentType)
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// body returns the content type and the content of the body of the message.
+func (m *message) body() (string, []byte) {
+	// Writes to a bytes.Buffer never fail
+	var alternative bytes.Buffer
+	aw := multipart.NewWriter(&alternative)
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{{"text/plain; charset=UTF-8", m.Text}, {"text/html; charset=UTF-8", m.HTML}} {
+		pw, _ := aw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		qw := quotedprintable.NewWriter(pw)
+		_, _ = qw.Write([]byte(part.content))
+		_ = qw.Close()
+	}
+	_ = aw.Close()
+	alternativeType := mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": aw.Boundary()})
+
+	if len(m.Files) == 0 {
+		return alternativeType, alternative.Bytes()
+	}
+
+	var mixed bytes.Buffer
+	mw := multipart.NewWriter(&mixed)
+	pw, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {alternativeType}})
+	_, _ = pw.Write(alternative.Bytes())
+
+	for i := range m.Files {
+		file := &m.Files[i]
+		pw, _ = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(file.ContentType, map[string]string{"name": file.Filename})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": file.Filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		_, _ = pw.Write(base64Lines(file.Data))
+	}
+	_ = mw.Close()
+	return mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()}), mixed.Bytes()
+}
+
+// writeHeader writes a header field with the name and value provided to the buffer provided.
+// CR and LF characters are removed from the value, so it cannot inject other header fields.
+func writeHeader(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name + ": " + strings.NewReplacer("\r", "", "\n", "").Replace(value) + "\r\n")
+}
+
+// formatAddress returns the address provided formatted for a header field, with its display name RFC 2047 encoded
+// if needed. Invalid addresses, like "MAILER-DAEMON", are returned as they are.
+func formatAddress(address string) string {
+	addr, err := mail.ParseAddress(address)
+	if err != nil {
+		return address
+	}
+	if addr.Name == "" {
+		return addr.Address
+	}
+	return addr.String()
+}
+
+// formatAddressList returns the addresses provided formatted for a header field, like formatAddress does.
+func formatAddressList(addresses []string) string {
+	list := make([]string, len(addresses))
+	for i := range addresses {
+		list[i] = formatAddress(addresses[i])
+	}
+	return strings.Join(list, ", ")
+}
+
+// messageID returns a unique Message-ID for a message sent from the address provided at the date provided.
+// The domain of the address is used as the right part of the ID, or the hostname if it has none.
+func messageID(from string, date time.Time) string {
+	domain := "localhost"
+	if addr, err := mail.ParseAddress(from); err == nil && strings.Contains(addr.Address, "@") {
+		domain = addr.Address[strings.LastIndex(addr.Address, "@")+1:]
+	} else if hostname, err := os.Hostname(); err == nil {
+		domain = hostname
+	}
+
+	return "<" + strconv.FormatInt(date.UnixNano(), 36) + "." +
+		strconv.Itoa(os.Getpid()) + "." +
+		strconv.FormatUint(atomic.AddUint64(&messageCounter, 1), 36) + "@" + domain + ">"
+}
+
+// base64Lines returns the data provided encoded in base64, in lines of 76 characters as MIME requires.
+func base64Lines(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	var buf bytes.Buffer
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+	return buf.Bytes()
+}
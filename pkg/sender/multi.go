@@ -0,0 +1,162 @@
+package sender
+
+import (
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"strings"
+	"sync"
+)
+
+// Target represents each of the destinations a Multi delivers the forms to.
+// Forms must be delivered to a required target to be considered delivered,
+// while the failure of a best-effort target is tolerated.
+type Target struct {
+	Name     string
+	Sender   Sender
+	Required bool
+}
+
+// Multi represents a type that delivers forms to several targets at once.
+type Multi struct {
+	Targets []Target
+}
+
+// TargetResult represents the outcome of delivering a form to a target.
+type TargetResult struct {
+	Target *Target
+	Err    error
+}
+
+// Result represents the outcome of delivering a form to all the targets of a Multi.
+type Result []TargetResult
+
+// Send will deliver the form provided to all the targets.
+// It returns an error if the delivery to any of the required targets failed, or to all of them.
+func (m *Multi) Send(f *form.Form) error {
+	return m.Deliver(f).Err()
+}
+
+// Deliver will deliver the form provided to all the targets concurrently, and return the outcome of each one
+// in the same order as the targets.
+func (m *Multi) Deliver(f *form.Form) Result {
+	targets := make([]*Target, len(m.Targets))
+	for i := range m.Targets {
+		targets[i] = &m.Targets[i]
+	}
+	return deliver(f, targets)
+}
+
+// DeliverTo will deliver the form provided to the targets with the names provided, like Deliver does.
+// The names that don't match any target are reported as failed required targets.
+func (m *Multi) DeliverTo(f *form.Form, names []string) Result {
+	targets := make([]*Target, len(names))
+	for i, name := range names {
+		targets[i] = m.target(name)
+		if targets[i] == nil {
+			targets[i] = &Target{
+				Name:     name,
+				Sender:   unknownTarget(name),
+				Required: true,
+			}
+		}
+	}
+	return deliver(f, targets)
+}
+
+// Names returns the names of all the targets.
+func (m *Multi) Names() []string {
+	names := make([]string, len(m.Targets))
+	for i := range m.Targets {
+		names[i] = m.Targets[i].Name
+	}
+	return names
+}
+
+// target returns the target with the name provided, or nil if there is none.
+func (m *Multi) target(name string) *Target {
+	for i := range m.Targets {
+		if m.Targets[i].Name == name {
+			return &m.Targets[i]
+		}
+	}
+	return nil
+}
+
+// deliver will deliver the form provided to the targets provided concurrently.
+func deliver(f *form.Form, targets []*Target) Result {
+	res := make(Result, len(targets))
+	var wg sync.WaitGroup
+	wg.Add(len(targets))
+	for i := range targets {
+		go func(i int) {
+			defer wg.Done()
+			res[i] = TargetResult{
+				Target: targets[i],
+				Err:    targets[i].Sender.Send(f),
+			}
+		}(i)
+	}
+	wg.Wait()
+	return res
+}
+
+// unknownTarget is a Sender that always fails because its target doesn't exist.
+type unknownTarget string
+
+func (name unknownTarget) Send(f *form.Form) error {
+	return fmt.Errorf("unknown target \"%s\"", string(name))
+}
+
+// Err returns an error describing the failed targets if the delivery to any of the required targets failed,
+// or to all of them. Otherwise, it returns nil.
+func (res Result) Err() error {
+	allFailed := true
+	requiredFailed := false
+	for _, r := range res {
+		if r.Err == nil {
+			allFailed = false
+		} else if r.Target.Required {
+			requiredFailed = true
+		}
+	}
+	if !requiredFailed && !allFailed {
+		return nil
+	}
+	return res.Errors()
+}
+
+// Errors returns an error describing all the failed targets, regardless of their policy,
+// or nil if there is none.
+func (res Result) Errors() error {
+	errs := make([]string, 0, len(res))
+	for _, r := range res {
+		if r.Err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", r.Target.Name, r.Err))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("error delivering form: %s", strings.Join(errs, "; "))
+}
+
+// Succeeded returns the names of the targets that the form was delivered to.
+func (res Result) Succeeded() []string {
+	return res.names(func(err error) bool { return err == nil })
+}
+
+// Failed returns the names of the targets that the form could not be delivered to.
+func (res Result) Failed() []string {
+	return res.names(func(err error) bool { return err != nil })
+}
+
+// names returns the names of the targets whose error satisfies the function provided.
+func (res Result) names(fn func(err error) bool) []string {
+	names := make([]string, 0, len(res))
+	for _, r := range res {
+		if fn(r.Err) {
+			names = append(names, r.Target.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,46 @@
+package sender
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"testing"
+)
+
+// senderFunc is a Sender implemented by a function.
+type senderFunc func(f *form.Form) error
+
+func (fn senderFunc) Send(f *form.Form) error {
+	return fn(f)
+}
+
+func TestMulti_Deliver(t *testing.T) {
+	ok := senderFunc(func(f *form.Form) error { return nil })
+	fail := senderFunc(func(f *form.Form) error { return errors.New("unavailable") })
+
+	tests := []struct {
+		targets   []Target
+		succeeded string
+		failed    string
+		isErr     bool
+	}{
+		{[]Target{{"a", ok, true}, {"b", ok, false}}, "[a b]", "[]", false},
+		{[]Target{{"a", ok, true}, {"b", fail, false}}, "[a]", "[b]", false},
+		{[]Target{{"a", fail, true}, {"b", ok, false}}, "[b]", "[a]", true},
+		{[]Target{{"a", fail, false}, {"b", fail, false}}, "[]", "[a b]", true},
+	}
+
+	for i, test := range tests {
+		m := Multi{Targets: test.targets}
+		res := m.Deliver(&form.Form{})
+		if succeeded := fmt.Sprint(res.Succeeded()); succeeded != test.succeeded {
+			t.Errorf("test #%d: unexpected succeeded targets: expected %s - found %s", i, test.succeeded, succeeded)
+		}
+		if failed := fmt.Sprint(res.Failed()); failed != test.failed {
+			t.Errorf("test #%d: unexpected failed targets: expected %s - found %s", i, test.failed, failed)
+		}
+		if err := m.Send(&form.Form{}); (err != nil) != test.isErr {
+			t.Errorf("test #%d: unexpected error: %v", i, err)
+		}
+	}
+}
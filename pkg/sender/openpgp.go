@@ -0,0 +1,123 @@
+package sender
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"time"
+)
+
+// pgpArmorStart is the beginning of the first line of the armored OpenPGP blocks.
+var pgpArmorStart = []byte("-----BEGIN PGP ")
+
+// pgpConfig is the configuration used to encrypt the OpenPGP messages.
+var pgpConfig = &packet.Config{DefaultCipher: packet.CipherAES256}
+
+// OpenPGP represents an Encrypter that encrypts messages with OpenPGP (RFC 4880) for the owners of its keys,
+// building PGP/MIME messages (RFC 3156). The content is encrypted with AES-256, unless a key doesn't accept it,
+// and its key with the newest valid encryption key (or subkey) of each public key.
+type OpenPGP struct {
+	keys openpgp.EntityList
+}
+
+// LoadOpenPGPKeys returns an OpenPGP that encrypts messages for the public keys in the path provided,
+// which can be binary or have one or more armored blocks. The self-signatures of the keys are verified,
+// and each of them must have a valid encryption key.
+func LoadOpenPGPKeys(path string) (*OpenPGP, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := readPGPKeys(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public key found in \"%s\"", path)
+	}
+
+	now := time.Now()
+	for _, k := range keys {
+		if _, ok := k.EncryptionKey(now); !ok {
+			return nil, fmt.Errorf("no valid encryption key found in public key %X", k.PrimaryKey.Fingerprint)
+		}
+	}
+	return &OpenPGP{keys: keys}, nil
+}
+
+// readPGPKeys returns the public keys in the data provided, which can be binary or have one or more armored blocks.
+func readPGPKeys(data []byte) (openpgp.EntityList, error) {
+	if !bytes.Contains(data, pgpArmorStart) {
+		return openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+
+	var keys openpgp.EntityList
+	for start := bytes.Index(data, pgpArmorStart); start >= 0; start = bytes.Index(data, pgpArmorStart) {
+		data = data[start:]
+		block := data
+		if end := bytes.Index(data[1:], pgpArmorStart); end >= 0 {
+			block, data = data[:end+1], data[end+1:]
+		} else {
+			data = nil
+		}
+
+		el, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(block))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, el...)
+	}
+	return keys, nil
+}
+
+// Encrypt returns the MIME entity provided encrypted as a multipart/encrypted entity.
+func (o *OpenPGP) Encrypt(entity []byte) ([]byte, error) {
+	if len(o.keys) == 0 {
+		return nil, errors.New("no OpenPGP key")
+	}
+
+	// Writes to a bytes.Buffer never fail, so armoring it doesn't either
+	var armored bytes.Buffer
+	aw, _ := armor.Encode(&armored, "PGP MESSAGE", nil)
+	w, err := openpgp.Encrypt(aw, o.keys, nil, &openpgp.FileHints{IsBinary: true}, pgpConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting message: %w", err)
+	}
+	if _, err = w.Write(entity); err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting message: %w", err)
+	}
+	_ = aw.Close()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	pw, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"application/pgp-encrypted"},
+		"Content-Description": {"PGP/MIME version identification"},
+	})
+	_, _ = pw.Write([]byte("Version: 1\r\n"))
+	pw, _ = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {`application/octet-stream; name="encrypted.asc"`},
+		"Content-Description": {"OpenPGP encrypted message"},
+		"Content-Disposition": {`inline; filename="encrypted.asc"`},
+	})
+	_, _ = pw.Write(normalizeLineBreaks(append(armored.Bytes(), '\n')))
+	_ = mw.Close()
+
+	var buf bytes.Buffer
+	buf.WriteString("Content-Type: " + mime.FormatMediaType("multipart/encrypted", map[string]string{
+		"protocol": "application/pgp-encrypted",
+		"boundary": mw.Boundary(),
+	}) + "\r\n\r\n")
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,231 @@
+package sender
+
+import (
+	"bytes"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Key pairs generated with gpg used in the tests, as "testdata/openpgp-<name>.asc" for the public key
+// and "testdata/openpgp-<name>-secret.asc" for the secret one (without passphrase).
+// alice has an RSA encryption subkey, and bob a Curve25519 one.
+var pgpTestKeys = []string{"alice", "bob"}
+
+// pgpTestKeyPath returns the path of the public key of the test key pair with the name provided,
+// or of the secret key if secret is true.
+func pgpTestKeyPath(name string, secret bool) string {
+	if secret {
+		return filepath.Join("testdata", "openpgp-"+name+"-secret.asc")
+	}
+	return filepath.Join("testdata", "openpgp-"+name+".asc")
+}
+
+// pgpMessage returns the armored OpenPGP message of the multipart/encrypted entity provided (with its header).
+func pgpMessage(t *testing.T, entity []byte) []byte {
+	t.Helper()
+	msg := parseMessage(t, entity)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/encrypted" || params["protocol"] != "application/pgp-encrypted" {
+		t.Fatalf("unexpected content type: %s", msg.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil || part.Header.Get("Content-Type") != "application/pgp-encrypted" {
+		t.Fatalf("unexpected version part: %v", err)
+	}
+	if version, _ := ioutil.ReadAll(part); strings.TrimSpace(string(version)) != "Version: 1" {
+		t.Fatalf("unexpected version: %s", version)
+	}
+	part, err = mr.NextPart()
+	if err != nil {
+		t.Fatalf("error reading encrypted part: %s", err)
+	}
+	armored, _ := ioutil.ReadAll(part)
+	if _, err = mr.NextPart(); err != io.EOF {
+		t.Fatalf("unexpected part after the encrypted one: %v", err)
+	}
+	return armored
+}
+
+// decryptOpenPGP returns the content of the multipart/encrypted entity provided (with its header),
+// decrypted with the secret key of the test key pair with the name provided.
+func decryptOpenPGP(t *testing.T, entity []byte, name string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(pgpTestKeyPath(name, true))
+	if err != nil {
+		t.Fatalf("error reading secret key: %s", err)
+	}
+	keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("invalid secret key: %s", err)
+	}
+
+	block, err := armor.Decode(bytes.NewReader(pgpMessage(t, entity)))
+	if err != nil || block.Type != "PGP MESSAGE" {
+		t.Fatalf("invalid armored message: %v", err)
+	}
+	md, err := openpgp.ReadMessage(block.Body, keys, nil, nil)
+	if err != nil {
+		t.Fatalf("error decrypting message: %s", err)
+	}
+	if !md.IsEncrypted || md.IsSigned {
+		t.Fatalf("unexpected message: encrypted %t, signed %t", md.IsEncrypted, md.IsSigned)
+	}
+	// The integrity of the message is checked once it's read
+	content, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		t.Fatalf("error reading message: %s", err)
+	}
+	return content
+}
+
+// newPGPTestEntity returns a MIME entity of size bytes of content, to be encrypted.
+func newPGPTestEntity(size int) []byte {
+	return []byte("Content-Type: text/plain; charset=utf-8\r\n\r\nThis is confidential." + strings.Repeat("x", size) + "\r\n")
+}
+
+// loadPGPTestKeys returns an OpenPGP that encrypts for all the test key pairs.
+func loadPGPTestKeys(t *testing.T) *OpenPGP {
+	t.Helper()
+	o := &OpenPGP{}
+	for _, name := range pgpTestKeys {
+		k, err := LoadOpenPGPKeys(pgpTestKeyPath(name, false))
+		if err != nil {
+			t.Fatalf("error loading key %s: %s", name, err)
+		}
+		o.keys = append(o.keys, k.keys...)
+	}
+	return o
+}
+
+func TestOpenPGP_Encrypt(t *testing.T) {
+	o := loadPGPTestKeys(t)
+
+	for _, size := range []int{10, 1000, 20000} {
+		entity := newPGPTestEntity(size)
+		encrypted, err := o.Encrypt(entity)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if bytes.Contains(encrypted, []byte("confidential")) {
+			t.Fatal("content not encrypted")
+		}
+		if bytes.Contains(bytes.Replace(encrypted, []byte("\r\n"), nil, -1), []byte("\n")) {
+			t.Fatal("line breaks not normalized to CRLF")
+		}
+		for _, name := range pgpTestKeys {
+			if decrypted := decryptOpenPGP(t, encrypted, name); !bytes.Equal(decrypted, entity) {
+				t.Errorf("unexpected content of %d bytes decrypted with the key of %s", size, name)
+			}
+		}
+	}
+
+	if _, err := (&OpenPGP{}).Encrypt([]byte("\r\nHi")); err == nil {
+		t.Error("no error found without keys")
+	}
+}
+
+func TestOpenPGP_Encrypt_gpg(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not installed")
+	}
+	o := loadPGPTestKeys(t)
+	entity := newPGPTestEntity(1000)
+	encrypted, err := o.Encrypt(entity)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, name := range pgpTestKeys {
+		home, err := ioutil.TempDir("", "gnupg")
+		if err != nil {
+			t.Fatalf("error creating temporary directory: %s", err)
+		}
+		defer os.RemoveAll(home)
+		msgPath := filepath.Join(home, "message.asc")
+		if err = ioutil.WriteFile(msgPath, pgpMessage(t, encrypted), 0600); err != nil {
+			t.Fatalf("error writing message: %s", err)
+		}
+
+		if out, err := exec.Command("gpg", "--homedir", home, "--batch", "--import", pgpTestKeyPath(name, true)).CombinedOutput(); err != nil {
+			t.Fatalf("error importing the key of %s: %s\n%s", name, err, out)
+		}
+		var stderr bytes.Buffer
+		cmd := exec.Command("gpg", "--homedir", home, "--batch", "--decrypt", msgPath)
+		cmd.Stderr = &stderr
+		decrypted, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("error decrypting with gpg and the key of %s: %s\n%s", name, err, stderr.Bytes())
+		}
+		if !bytes.Equal(decrypted, entity) {
+			t.Errorf("unexpected content decrypted by gpg with the key of %s:\n-> Expected: %q\n-> Found: %q", name, entity, decrypted)
+		}
+	}
+}
+
+func TestLoadOpenPGPKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openpgp")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	alice, _ := ioutil.ReadFile(pgpTestKeyPath("alice", false))
+	bob, _ := ioutil.ReadFile(pgpTestKeyPath("bob", false))
+	block, err := armor.Decode(bytes.NewReader(alice))
+	if err != nil {
+		t.Fatalf("invalid armored key: %s", err)
+	}
+	binary, _ := ioutil.ReadAll(block.Body)
+	emptyBlock := "-----BEGIN PGP PUBLIC KEY BLOCK-----\n\n-----END PGP PUBLIC KEY BLOCK-----\n"
+
+	for name, test := range map[string]struct {
+		data     []byte
+		expected int
+	}{
+		"armored.asc": {alice, 1},
+		"binary.gpg":  {binary, 1},
+		"blocks.asc":  {append(append([]byte{}, alice...), bob...), 2},
+		"empty.asc":   {[]byte(emptyBlock), 0},
+		"invalid.asc": {[]byte("not a key"), 0},
+	} {
+		path := filepath.Join(dir, name)
+		if err = ioutil.WriteFile(path, test.data, 0600); err != nil {
+			t.Fatalf("error writing keys: %s", err)
+		}
+
+		o, err := LoadOpenPGPKeys(path)
+		if test.expected == 0 {
+			if err == nil {
+				t.Errorf("no error found loading %s", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error loading %s: %s", name, err)
+			continue
+		}
+		if len(o.keys) != test.expected {
+			t.Errorf("unexpected number of keys loaded from %s: %d", name, len(o.keys))
+		}
+	}
+
+	// Keys without a valid encryption key: a signing key, and a key whose subkey binding signature is forged
+	for _, path := range []string{pgpTestKeyPath("carol", false), filepath.Join("testdata", "openpgp-bob-forged.gpg")} {
+		if _, err = LoadOpenPGPKeys(path); err == nil {
+			t.Errorf("no error found loading %s", path)
+		}
+	}
+	if _, err = LoadOpenPGPKeys(filepath.Join(dir, "missing.asc")); err == nil {
+		t.Error("no error found for a missing file")
+	}
+}
@@ -0,0 +1,316 @@
+package sender
+
+import (
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// Default settings of the pools of SMTP connections.
+const (
+	DefaultPoolMaxConns    = 4
+	DefaultPoolMaxMessages = 100
+	DefaultPoolIdleTimeout = 30 * time.Second
+)
+
+// Pool represents a pool of authenticated connections to SMTP servers, which are reused to send several messages.
+// It can be shared by several accounts, and its zero value is ready to use.
+//
+// MaxConns limits the connections open at the same time to each server (host and port), in use or idle,
+// so senders wait for a connection to be available instead of opening more. If the idle connections
+// to the server are of other accounts, one of them is closed to make room. Connections are closed after sending
+// MaxMessages messages or after being idle for IdleTimeout, by a goroutine that runs while the pool has idle
+// connections. Zero values are replaced by the default ones.
+//
+// Idle connections are checked with RSET before being reused, so the ones dropped by the server
+// are replaced transparently by new ones.
+type Pool struct {
+	MaxConns    int
+	MaxMessages int
+	IdleTimeout time.Duration
+
+	mutex     sync.Mutex
+	available *sync.Cond
+	idle      map[Account][]*pooledConn
+	open      map[string]int
+	closed    bool
+	reaping   bool
+	stop      chan struct{}
+	reaper    sync.WaitGroup
+}
+
+// pooledConn represents a connection of a Pool.
+type pooledConn struct {
+	client   *smtp.Client
+	server   string
+	messages int
+	lastUsed time.Time
+}
+
+// send sends the message provided from the address provided to the addresses provided
+// with a connection of the pool to the server of the account provided.
+func (p *Pool) send(a *Account, from string, to []string, msg []byte) error {
+	c, err := p.get(a)
+	if err != nil {
+		return err
+	}
+
+	if err = transaction(c.client, from, to, msg); err != nil {
+		// The connection can still be used if the server rejected the transaction and it can be reset
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) && c.client.Reset() == nil {
+			p.put(a, c)
+		} else {
+			p.discard(c, false)
+		}
+		return &transactionError{err}
+	}
+
+	c.messages++
+	p.put(a, c)
+	return nil
+}
+
+// get returns an idle connection to the server of the account provided, or a new one if there is none.
+// If MaxConns connections to the server are open, it closes an idle one of another account,
+// or waits until one is available.
+func (p *Pool) get(a *Account) (*pooledConn, error) {
+	server := net.JoinHostPort(a.Hostname, a.Port)
+
+	p.mutex.Lock()
+	for {
+		if c := p.popIdle(*a); c != nil {
+			p.mutex.Unlock()
+			if time.Since(c.lastUsed) > p.idleTimeout() {
+				p.discard(c, true)
+			} else if err := c.client.Reset(); err != nil {
+				// The server has dropped the connection
+				p.discard(c, false)
+			} else {
+				return c, nil
+			}
+			p.mutex.Lock()
+			continue
+		}
+
+		if p.open[server] < p.maxConns() {
+			if p.open == nil {
+				p.open = make(map[string]int)
+			}
+			p.open[server]++
+			p.mutex.Unlock()
+
+			client, err := a.dial()
+			if err != nil {
+				p.release(server)
+				return nil, err
+			}
+			return &pooledConn{client: client, server: server}, nil
+		}
+
+		if c := p.popIdleServer(server); c != nil {
+			p.mutex.Unlock()
+			p.discard(c, true)
+			p.mutex.Lock()
+			continue
+		}
+		p.cond().Wait()
+	}
+}
+
+// popIdle removes and returns the most recently used idle connection of the account provided,
+// or nil if there is none. The mutex must be held.
+func (p *Pool) popIdle(a Account) *pooledConn {
+	conns := p.idle[a]
+	if len(conns) == 0 {
+		return nil
+	}
+	c := conns[len(conns)-1]
+	if len(conns) == 1 {
+		delete(p.idle, a)
+	} else {
+		p.idle[a] = conns[:len(conns)-1]
+	}
+	return c
+}
+
+// popIdleServer removes and returns the least recently used idle connection to the server provided
+// of any account, or nil if there is none. The mutex must be held.
+func (p *Pool) popIdleServer(server string) *pooledConn {
+	var (
+		oldest  *pooledConn
+		account Account
+	)
+	for a, conns := range p.idle {
+		if c := conns[0]; c.server == server && (oldest == nil || c.lastUsed.Before(oldest.lastUsed)) {
+			oldest, account = c, a
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+	if conns := p.idle[account]; len(conns) == 1 {
+		delete(p.idle, account)
+	} else {
+		p.idle[account] = conns[1:]
+	}
+	return oldest
+}
+
+// put returns the connection provided to the server of the account provided to the pool,
+// or closes it if it has sent too many messages or the pool is closed.
+func (p *Pool) put(a *Account, c *pooledConn) {
+	maxMessages := p.MaxMessages
+	if maxMessages <= 0 {
+		maxMessages = DefaultPoolMaxMessages
+	}
+
+	p.mutex.Lock()
+	if p.closed || c.messages >= maxMessages {
+		p.mutex.Unlock()
+		p.discard(c, true)
+		return
+	}
+	if p.idle == nil {
+		p.idle = make(map[Account][]*pooledConn)
+	}
+	c.lastUsed = time.Now()
+	p.idle[*a] = append(p.idle[*a], c)
+	p.cond().Broadcast()
+	if !p.reaping {
+		p.reaping = true
+		if p.stop == nil {
+			p.stop = make(chan struct{})
+		}
+		p.reaper.Add(1)
+		go p.reap(p.idleTimeout())
+	}
+	p.mutex.Unlock()
+}
+
+// discard closes the connection provided, which is not idle, quitting the session first if quit is true,
+// and makes room for another connection to its server.
+func (p *Pool) discard(c *pooledConn, quit bool) {
+	if quit {
+		_ = c.client.Quit()
+	}
+	c.client.Close()
+	p.release(c.server)
+}
+
+// release makes room for another connection to the server provided, after one has been closed.
+func (p *Pool) release(server string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.open[server]--; p.open[server] <= 0 {
+		delete(p.open, server)
+	}
+	p.cond().Broadcast()
+}
+
+// cond returns the condition that is signaled when a connection is returned to the pool or closed.
+// The mutex must be held.
+func (p *Pool) cond() *sync.Cond {
+	if p.available == nil {
+		p.available = sync.NewCond(&p.mutex)
+	}
+	return p.available
+}
+
+// reap closes the idle connections once they have been idle for the idle timeout, waiting the time provided
+// before the first check. It returns when the pool has no idle connections left or it's closed.
+func (p *Pool) reap(wait time.Duration) {
+	defer p.reaper.Done()
+
+	for wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-p.stop:
+			timer.Stop()
+			return
+		}
+
+		var expired []*pooledConn
+		expired, wait = p.removeExpired(time.Now())
+		for _, c := range expired {
+			p.discard(c, true)
+		}
+	}
+}
+
+// removeExpired removes and returns the idle connections that have been idle for the idle timeout
+// at the time provided. It also returns the time left until the next one expires,
+// or zero if there are no idle connections left, in which case the pool is not being reaped anymore.
+func (p *Pool) removeExpired(now time.Time) ([]*pooledConn, time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	timeout := p.idleTimeout()
+	var expired []*pooledConn
+	var next time.Duration
+	for a, conns := range p.idle {
+		kept := conns[:0]
+		for _, c := range conns {
+			left := c.lastUsed.Add(timeout).Sub(now)
+			if left <= 0 {
+				expired = append(expired, c)
+				continue
+			}
+			kept = append(kept, c)
+			if next == 0 || left < next {
+				next = left
+			}
+		}
+		if len(kept) == 0 {
+			delete(p.idle, a)
+		} else {
+			p.idle[a] = kept
+		}
+	}
+
+	if next == 0 {
+		p.reaping = false
+	}
+	return expired, next
+}
+
+// maxConns returns the maximum number of connections open at the same time to each server.
+func (p *Pool) maxConns() int {
+	if p.MaxConns <= 0 {
+		return DefaultPoolMaxConns
+	}
+	return p.MaxConns
+}
+
+// idleTimeout returns the time connections can be idle before being closed.
+func (p *Pool) idleTimeout() time.Duration {
+	if p.IdleTimeout <= 0 {
+		return DefaultPoolIdleTimeout
+	}
+	return p.IdleTimeout
+}
+
+// Close closes the idle connections of the pool, and waits for the goroutine that closes them once they time out
+// to return. The connections in use are closed once they are returned.
+func (p *Pool) Close() {
+	p.mutex.Lock()
+	idle := p.idle
+	p.idle = nil
+	if !p.closed && p.stop != nil {
+		close(p.stop)
+	}
+	p.closed = true
+	p.mutex.Unlock()
+
+	p.reaper.Wait()
+	for _, conns := range idle {
+		for _, c := range conns {
+			p.discard(c, true)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package sender
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countMessages returns the number of messages received in the sessions provided.
+func countMessages(sessions []fakeSession) int {
+	n := 0
+	for _, sess := range sessions {
+		n += len(sess.messages)
+	}
+	return n
+}
+
+func TestPool_send(t *testing.T) {
+	srv, _ := newFakeSMTP(t, false, false)
+	defer srv.Close()
+	a := srv.account(TLSNone, AuthPlain, nil)
+	p := &Pool{}
+	defer p.Close()
+
+	for i := 0; i < 5; i++ {
+		if err := p.send(&a, "a@example.com", []string{"b@example.com"}, []byte("Hi\r\n")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := p.send(&a, "a@example.com", []string{"rejected@example.com"}, []byte("Hi\r\n")); err == nil {
+		t.Error("no error found for a rejected recipient")
+	}
+	if err := p.send(&a, "a@example.com", []string{"b@example.com"}, []byte("Hi\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	sessions := srv.Sessions()
+	if len(sessions) != 1 || len(sessions[0].messages) != 6 || !sessions[0].authenticated {
+		t.Errorf("connection not reused: %d sessions with %d messages", len(sessions), countMessages(sessions))
+	}
+}
+
+func TestPool_send_recycle(t *testing.T) {
+	srv, _ := newFakeSMTP(t, false, false)
+	defer srv.Close()
+	a := srv.account(TLSNone, AuthPlain, nil)
+
+	p := &Pool{MaxMessages: 2}
+	for i := 0; i < 5; i++ {
+		if err := p.send(&a, "a@example.com", []string{"b@example.com"}, []byte("Hi\r\n")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if sessions := srv.Sessions(); len(sessions) != 3 || countMessages(sessions) != 5 {
+		t.Errorf("expected 3 sessions with 5 messages, found %d with %d", len(sessions), countMessages(sessions))
+	}
+	p.Close()
+
+	p = &Pool{IdleTimeout: 10 * time.Millisecond}
+	defer p.Close()
+	for i := 0; i < 2; i++ {
+		if err := p.send(&a, "a@example.com", []string{"b@example.com"}, []byte("Hi\r\n")); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+	if sessions := srv.Sessions(); len(sessions) != 5 {
+		t.Errorf("idle connection not recycled: %d sessions", len(sessions))
+	}
+}
+
+func TestPool_reap(t *testing.T) {
+	srv, _ := newFakeSMTP(t, false, false)
+	defer srv.Close()
+	a := srv.account(TLSNone, AuthPlain, nil)
+	p := &Pool{IdleTimeout: 20 * time.Millisecond}
+	defer p.Close()
+
+	if err := p.send(&a, "a@example.com", []string{"b@example.com"}, []byte("Hi\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	p.mutex.Lock()
+	idle, reaping := len(p.idle), p.reaping
+	p.mutex.Unlock()
+	if idle != 0 || reaping {
+		t.Errorf("idle connection not closed without being reused: %d idle servers (reaping: %t)", idle, reaping)
+	}
+
+	// The pool is reaped again once it has idle connections
+	if err := p.send(&a, "a@example.com", []string{"b@example.com"}, []byte("Hi\r\n")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	p.mutex.Lock()
+	reaping = p.reaping
+	p.mutex.Unlock()
+	if !reaping {
+		t.Error("pool with idle connections not being reaped")
+	}
+
+	// Closing the pool stops the reaper right away
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Millisecond):
+		t.Error("pool not closed before the idle timeout")
+	}
+}
+
+func TestPool_send_dropped(t *testing.T) {
+	srv, _ := newFakeSMTP(t, false, false)
+	defer srv.Close()
+	a := srv.account(TLSNone, AuthPlain, nil)
+	p := &Pool{}
+	defer p.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := p.send(&a, "a@example.com", []string{"b@example.com"}, []byte("Hi\r\n")); err != nil {
+			t.Fatalf("unexpected error after %d drops: %s", i, err)
+		}
+		srv.Drop()
+	}
+	if sessions := srv.Sessions(); len(sessions) != 2 || countMessages(sessions) != 2 {
+		t.Errorf("expected 2 sessions with 2 messages, found %d with %d", len(sessions), countMessages(sessions))
+	}
+}
+
+func TestPool_send_concurrent(t *testing.T) {
+	srv, _ := newFakeSMTP(t, false, false)
+	defer srv.Close()
+	a := srv.account(TLSNone, AuthPlain, nil)
+	p := &Pool{MaxConns: 2}
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := p.send(&a, "a@example.com", []string{"b@example.com"}, []byte("Hi\r\n")); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if sessions := srv.Sessions(); len(sessions) > 2 || countMessages(sessions) != 20 {
+		t.Errorf("expected up to 2 sessions with 20 messages, found %d with %d", len(sessions), countMessages(sessions))
+	}
+}
+
+func TestPool_send_accounts(t *testing.T) {
+	srv, _ := newFakeSMTP(t, false, false)
+	defer srv.Close()
+	a := srv.account(TLSNone, AuthPlain, nil)
+	b := a
+	b.HELO = "other.example.com"
+	p := &Pool{MaxConns: 1}
+	defer p.Close()
+
+	// The idle connection of each account counts against the connections to the server of the other one
+	for i, account := range []*Account{&a, &b, &a} {
+		if err := p.send(account, "a@example.com", []string{"b@example.com"}, []byte("Hi\r\n")); err != nil {
+			t.Fatalf("message #%d: unexpected error: %s", i, err)
+		}
+		p.mutex.Lock()
+		open, idle := p.open[net.JoinHostPort(a.Hostname, a.Port)], len(p.idle)
+		p.mutex.Unlock()
+		if open != 1 || idle != 1 {
+			t.Errorf("message #%d: unexpected connections: %d open, %d idle accounts", i, open, idle)
+		}
+	}
+	if sessions := srv.Sessions(); len(sessions) != 3 || countMessages(sessions) != 3 {
+		t.Errorf("expected 3 sessions with 3 messages, found %d with %d", len(sessions), countMessages(sessions))
+	}
+}
@@ -0,0 +1,14 @@
+package sender
+
+// Package sender contains the backends that ptemplate-form-handler can use to deliver the forms it receives.
+
+import "github.com/nethruster/ptemplate-form-handler/pkg/form"
+
+// Sender represents a backend that delivers forms.
+type Sender interface {
+	// Send will deliver the form provided.
+	Send(f *form.Form) error
+}
+
+// spamTag is the tag prepended to the subject of the forms tagged as spam.
+const spamTag = "[SPAM] "
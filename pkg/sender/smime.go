@@ -0,0 +1,77 @@
+package sender
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"go.mozilla.org/pkcs7"
+	"io/ioutil"
+	"sync"
+)
+
+// pkcs7Mutex serializes the encryptions with pkcs7, which takes the content encryption algorithm
+// from a package variable.
+var pkcs7Mutex sync.Mutex
+
+// SMIME represents an Encrypter that encrypts messages with S/MIME (RFC 8551) for the owners of its certificates,
+// which must have RSA keys. The content is encrypted with AES-256-CBC, and its key with RSAES-PKCS1-v1_5
+// for each certificate.
+type SMIME struct {
+	Certificates []*x509.Certificate
+}
+
+// LoadSMIMECertificates returns an SMIME that encrypts messages for the PEM encoded certificates
+// in the path provided.
+func LoadSMIMECertificates(path string) (*SMIME, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SMIME{}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing certificate: %w", err)
+		}
+		if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+			return nil, fmt.Errorf("certificate of \"%s\" doesn't have an RSA key", cert.Subject.CommonName)
+		}
+		s.Certificates = append(s.Certificates, cert)
+	}
+	if len(s.Certificates) == 0 {
+		return nil, fmt.Errorf("no certificate found in \"%s\"", path)
+	}
+	return s, nil
+}
+
+// Encrypt returns the MIME entity provided encrypted as an application/pkcs7-mime entity.
+func (s *SMIME) Encrypt(entity []byte) ([]byte, error) {
+	if len(s.Certificates) == 0 {
+		return nil, errors.New("no S/MIME certificate")
+	}
+
+	// pkcs7 encrypts the content with DES-CBC by default, which is broken, so AES-256-CBC is set right before
+	// encrypting, in case something else has changed it. It's not set when the package is initialized, so importing
+	// this package doesn't change the behavior of pkcs7 for the rest of the program.
+	pkcs7Mutex.Lock()
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES256CBC
+	der, err := pkcs7.Encrypt(entity, s.Certificates)
+	pkcs7Mutex.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting S/MIME message: %w", err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=smime.p7m\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"Content-Disposition: attachment; filename=smime.p7m\r\n\r\n")
+	buf.Write(base64Lines(der))
+	return buf.Bytes(), nil
+}
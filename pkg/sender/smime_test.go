@@ -0,0 +1,215 @@
+package sender
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"go.mozilla.org/pkcs7"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// oidAES256CBC is the DER encoded object identifier of AES-256-CBC (2.16.840.1.101.3.4.1.42).
+var oidAES256CBC = []byte{0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x01, 0x2a}
+
+// newSMIMECertificate returns a self-signed certificate with a new RSA key, and the key.
+func newSMIMECertificate(t *testing.T, name string) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: name},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageKeyEncipherment,
+		EmailAddresses: []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("error parsing certificate: %s", err)
+	}
+	return cert, key
+}
+
+// smimeEnvelope returns the DER encoded PKCS #7 envelope of the application/pkcs7-mime entity provided
+// (with its header).
+func smimeEnvelope(t *testing.T, entity []byte) []byte {
+	t.Helper()
+	msg := parseMessage(t, entity)
+	if ct := msg.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/pkcs7-mime; smime-type=enveloped-data") {
+		t.Fatalf("unexpected content type: %s", ct)
+	}
+	encoded, _ := ioutil.ReadAll(msg.Body)
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(encoded)), ""))
+	if err != nil {
+		t.Fatalf("invalid base64 content: %s", err)
+	}
+	return der
+}
+
+// decryptSMIME returns the content of the application/pkcs7-mime entity provided (with its header),
+// decrypted with the certificate and key provided.
+func decryptSMIME(t *testing.T, entity []byte, cert *x509.Certificate, key *rsa.PrivateKey) []byte {
+	t.Helper()
+	p7, err := pkcs7.Parse(smimeEnvelope(t, entity))
+	if err != nil {
+		t.Fatalf("invalid S/MIME message: %s", err)
+	}
+	content, err := p7.Decrypt(cert, key)
+	if err != nil {
+		t.Fatalf("error decrypting S/MIME message for %s: %s", cert.Subject.CommonName, err)
+	}
+	return content
+}
+
+// loadSMIMETestKey returns the certificate and the key generated with openssl used in the tests,
+// at "testdata/smime-alice.pem" and "testdata/smime-alice-key.pem".
+func loadSMIMETestKey(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	s, err := LoadSMIMECertificates(filepath.Join("testdata", "smime-alice.pem"))
+	if err != nil {
+		t.Fatalf("error loading certificate: %s", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "smime-alice-key.pem"))
+	if err != nil {
+		t.Fatalf("error reading key: %s", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("key not found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("invalid key: %s", err)
+	}
+	return s.Certificates[0], key.(*rsa.PrivateKey)
+}
+
+func TestSMIME_Encrypt(t *testing.T) {
+	cert1, key1 := loadSMIMETestKey(t)
+	cert2, key2 := newSMIMECertificate(t, "bob@example.com")
+	s := &SMIME{Certificates: []*x509.Certificate{cert1, cert2}}
+
+	// The content is encrypted with AES-256-CBC even if the default algorithm of pkcs7 is changed
+	defer func(algorithm int) { pkcs7.ContentEncryptionAlgorithm = algorithm }(pkcs7.ContentEncryptionAlgorithm)
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmDESCBC
+
+	entity := []byte("Content-Type: text/plain; charset=utf-8\r\n\r\nThis is confidential.\r\n")
+	encrypted, err := s.Encrypt(entity)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if bytes.Contains(encrypted, []byte("confidential")) {
+		t.Fatal("content not encrypted")
+	}
+	if !bytes.Contains(smimeEnvelope(t, encrypted), oidAES256CBC) {
+		t.Error("content not encrypted with AES-256-CBC")
+	}
+	if decrypted := decryptSMIME(t, encrypted, cert1, key1); !bytes.Equal(decrypted, entity) {
+		t.Errorf("unexpected content decrypted by the first recipient:\n-> Expected: %q\n-> Found: %q", entity, decrypted)
+	}
+	if decrypted := decryptSMIME(t, encrypted, cert2, key2); !bytes.Equal(decrypted, entity) {
+		t.Errorf("unexpected content decrypted by the second recipient:\n-> Expected: %q\n-> Found: %q", entity, decrypted)
+	}
+
+	if _, err = (&SMIME{}).Encrypt(entity); err == nil {
+		t.Error("no error found without certificates")
+	}
+}
+
+func TestSMIME_Encrypt_openssl(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not installed")
+	}
+	cert, _ := loadSMIMETestKey(t)
+	entity := []byte("Content-Type: text/plain; charset=utf-8\r\n\r\nThis is confidential.\r\n")
+	encrypted, err := (&SMIME{Certificates: []*x509.Certificate{cert}}).Encrypt(entity)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "smime")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	msgPath := filepath.Join(dir, "message.eml")
+	if err = ioutil.WriteFile(msgPath, encrypted, 0600); err != nil {
+		t.Fatalf("error writing message: %s", err)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("openssl", "smime", "-decrypt", "-binary", "-in", msgPath,
+		"-recip", filepath.Join("testdata", "smime-alice.pem"), "-inkey", filepath.Join("testdata", "smime-alice-key.pem"))
+	cmd.Stderr = &stderr
+	decrypted, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("error decrypting with openssl: %s\n%s", err, stderr.Bytes())
+	}
+	if !bytes.Equal(decrypted, entity) {
+		t.Errorf("unexpected content decrypted by openssl:\n-> Expected: %q\n-> Found: %q", entity, decrypted)
+	}
+}
+
+func TestLoadSMIMECertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smime")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert1, _ := loadSMIMETestKey(t)
+	cert2, _ := newSMIMECertificate(t, "bob@example.com")
+	ecdsa, _ := ioutil.ReadFile(filepath.Join("testdata", "smime-ecdsa.pem"))
+
+	for name, test := range map[string]struct {
+		data     []byte
+		expected int
+	}{
+		"valid.pem": {
+			append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert1.Raw}),
+				pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert2.Raw})...),
+			2,
+		},
+		"ecdsa.pem": {ecdsa, 0},
+		"empty.pem": {[]byte("not a certificate"), 0},
+	} {
+		path := filepath.Join(dir, name)
+		if err = ioutil.WriteFile(path, test.data, 0600); err != nil {
+			t.Fatalf("error writing certificates: %s", err)
+		}
+
+		s, err := LoadSMIMECertificates(path)
+		if test.expected == 0 {
+			if err == nil {
+				t.Errorf("no error found loading %s", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error loading %s: %s", name, err)
+			continue
+		}
+		if len(s.Certificates) != test.expected {
+			t.Errorf("unexpected number of certificates loaded from %s: %d", name, len(s.Certificates))
+		}
+	}
+}
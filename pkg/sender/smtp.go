@@ -0,0 +1,303 @@
+package sender
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// TLS modes of the connections to SMTP servers.
+const (
+	// TLSOpportunistic upgrades the connection with STARTTLS if the server supports it.
+	TLSOpportunistic = "opportunistic"
+	// TLSStartTLS upgrades the connection with STARTTLS, failing if the server doesn't support it.
+	TLSStartTLS = "starttls"
+	// TLSImplicit uses TLS from the beginning of the connection, like the servers listening in port 465 expect.
+	TLSImplicit = "implicit"
+	// TLSNone never uses TLS.
+	TLSNone = "none"
+)
+
+// Authentication mechanisms of SMTP accounts.
+const (
+	AuthPlain   = "plain"
+	AuthLogin   = "login"
+	AuthCRAMMD5 = "cram-md5"
+	AuthXOAUTH2 = "xoauth2"
+	AuthNone    = "none"
+)
+
+// Default timeouts of the connections to SMTP servers.
+const (
+	DefaultDialTimeout    = 30 * time.Second
+	DefaultCommandTimeout = time.Minute
+)
+
+// Account represents an SMTP account and the settings of the connection to its server.
+//
+// TLS is one of the TLS modes (TLSOpportunistic if empty). The certificate of the server is verified against RootCAs
+// (the system pool if nil) for ServerName (Hostname if empty), unless InsecureSkipVerify is true.
+//
+// Auth is one of the authentication mechanisms (AuthPlain if empty). For AuthXOAUTH2, Password is the access token.
+// Plain, login and XOAUTH2 credentials are only sent over TLS, or to localhost.
+//
+// HELO is the name the client introduces itself with ("localhost" if empty).
+// DialTimeout limits the time to connect, and CommandTimeout the time each read or write can take.
+type Account struct {
+	Hostname           string
+	Port               string
+	Username           string
+	Password           string
+	TLS                string
+	RootCAs            *x509.CertPool
+	ServerName         string
+	InsecureSkipVerify bool
+	Auth               string
+	HELO               string
+	DialTimeout        time.Duration
+	CommandTimeout     time.Duration
+}
+
+// sendMail sends the message provided from the address provided to the addresses provided,
+// connecting to the server of the account.
+func (a *Account) sendMail(from string, to []string, msg []byte) error {
+	c, err := a.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err = transaction(c, from, to, msg); err != nil {
+		return &transactionError{err}
+	}
+	return c.Quit()
+}
+
+// dial returns a client connected and authenticated to the server of the account.
+func (a *Account) dial() (*smtp.Client, error) {
+	addr := net.JoinHostPort(a.Hostname, a.Port)
+	dialer := &net.Dialer{Timeout: a.DialTimeout}
+	if dialer.Timeout == 0 {
+		dialer.Timeout = DefaultDialTimeout
+	}
+
+	tcpConn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", addr, err)
+	}
+
+	timeout := a.CommandTimeout
+	if timeout == 0 {
+		timeout = DefaultCommandTimeout
+	}
+	var conn net.Conn = &deadlineConn{Conn: tcpConn, timeout: timeout}
+
+	// The TLS connection must not be wrapped, so the client knows that it's encrypted
+	if a.TLS == TLSImplicit {
+		tlsConn := tls.Client(conn, a.tlsConfig())
+		if err = tlsConn.Handshake(); err != nil {
+			tcpConn.Close()
+			return nil, fmt.Errorf("error in TLS handshake with %s: %w", addr, err)
+		}
+		conn = tlsConn
+	}
+
+	c, err := smtp.NewClient(conn, a.Hostname)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error starting SMTP session with %s: %w", addr, err)
+	}
+
+	if err = a.handshake(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// handshake introduces the client provided to the server, upgrades the connection to TLS and authenticates,
+// according to the settings of the account.
+func (a *Account) handshake(c *smtp.Client) error {
+	helo := a.HELO
+	if helo == "" {
+		helo = "localhost"
+	}
+	if err := c.Hello(helo); err != nil {
+		return fmt.Errorf("error in HELO: %w", err)
+	}
+
+	switch a.TLS {
+	case "", TLSOpportunistic, TLSStartTLS:
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			if a.TLS == TLSStartTLS {
+				return errors.New("server doesn't support STARTTLS")
+			}
+			break
+		}
+		if err := c.StartTLS(a.tlsConfig()); err != nil {
+			return fmt.Errorf("error in STARTTLS: %w", err)
+		}
+	}
+
+	auth := a.auth()
+	if auth == nil {
+		return nil
+	}
+	if err := c.Auth(auth); err != nil {
+		return fmt.Errorf("error authenticating: %w", err)
+	}
+	return nil
+}
+
+// tlsConfig returns the TLS settings of the connections to the server of the account.
+func (a *Account) tlsConfig() *tls.Config {
+	serverName := a.ServerName
+	if serverName == "" {
+		serverName = a.Hostname
+	}
+	return &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            a.RootCAs,
+		InsecureSkipVerify: a.InsecureSkipVerify,
+	}
+}
+
+// auth returns the authentication of the account, or nil if it doesn't authenticate.
+func (a *Account) auth() smtp.Auth {
+	switch a.Auth {
+	case AuthNone:
+		return nil
+	case AuthLogin:
+		return &loginAuth{username: a.Username, password: a.Password, host: a.Hostname}
+	case AuthCRAMMD5:
+		return smtp.CRAMMD5Auth(a.Username, a.Password)
+	case AuthXOAUTH2:
+		return &xoauth2Auth{username: a.Username, token: a.Password, host: a.Hostname}
+	default:
+		return smtp.PlainAuth("", a.Username, a.Password, a.Hostname)
+	}
+}
+
+// transaction sends the message provided from the address provided to the addresses provided
+// using the client provided, which must be ready to start a mail transaction.
+func transaction(c *smtp.Client, from string, to []string, msg []byte) error {
+	if err := c.Mail(from); err != nil {
+		return fmt.Errorf("error in MAIL FROM: %w", err)
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return fmt.Errorf("error in RCPT TO <%s>: %w", addr, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("error in DATA: %w", err)
+	}
+	if _, err = w.Write(msg); err != nil {
+		return fmt.Errorf("error writing message: %w", err)
+	}
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("error sending message: %w", err)
+	}
+	return nil
+}
+
+// transactionError represents an error in a mail transaction, once the client was connected and authenticated.
+type transactionError struct {
+	err error
+}
+
+// Error returns the description of the error.
+func (e *transactionError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *transactionError) Unwrap() error {
+	return e.err
+}
+
+// deadlineConn represents a connection whose reads and writes fail if they take longer than a timeout.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// Read reads from the connection, waiting up to the timeout.
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// Write writes to the connection, waiting up to the timeout.
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// loginAuth implements the LOGIN authentication mechanism, which is not standard but widely used.
+type loginAuth struct {
+	username, password, host string
+}
+
+// Start begins the authentication with the server.
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkCredentialsSafe(server, a.host); err != nil {
+		return "", nil, err
+	}
+	return "LOGIN", nil, nil
+}
+
+// Next answers the challenges of the server, which ask for the username and then the password.
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch string(fromServer) {
+	case "Username:", "User Name\x00":
+		return []byte(a.username), nil
+	case "Password:", "Password\x00":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge: %q", fromServer)
+}
+
+// xoauth2Auth implements the XOAUTH2 authentication mechanism, used with OAuth 2.0 access tokens.
+type xoauth2Auth struct {
+	username, token, host string
+}
+
+// Start begins the authentication with the server, sending the username and the access token.
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := checkCredentialsSafe(server, a.host); err != nil {
+		return "", nil, err
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next answers the challenge of the server, which only happens when the authentication failed
+// and contains the details of the error. An empty response is expected to get the final error.
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// checkCredentialsSafe checks if credentials can be sent in clear to the server provided, which is the case
+// if the connection uses TLS or the server is localhost, like smtp.PlainAuth does.
+func checkCredentialsSafe(server *smtp.ServerInfo, host string) error {
+	if server.TLS || host == "localhost" || host == "127.0.0.1" || host == "::1" {
+		return nil
+	}
+	return errors.New("unencrypted connection")
+}
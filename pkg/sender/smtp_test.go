@@ -0,0 +1,441 @@
+package sender
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	fakeSMTPUsername = "john"
+	fakeSMTPPassword = "secret"
+)
+
+// fakeSMTP represents an SMTP server used in tests. It accepts the credentials fakeSMTPUsername and fakeSMTPPassword
+// with any authentication mechanism, rejects the recipients whose address starts with "rejected",
+// and records the sessions it serves. If mailReply is not empty, it's the reply to every MAIL command.
+type fakeSMTP struct {
+	listener    net.Listener
+	tlsConfig   *tls.Config
+	implicitTLS bool
+	startTLS    bool
+
+	mutex     sync.Mutex
+	sessions  []*fakeSession
+	conns     []net.Conn
+	mailReply string
+}
+
+// fakeSession represents an SMTP session served by fakeSMTP.
+type fakeSession struct {
+	helo          string
+	tls           bool
+	auth          string
+	authenticated bool
+	messages      []fakeMessage
+}
+
+// fakeMessage represents a message received by fakeSMTP.
+type fakeMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// newFakeSMTP starts a fakeSMTP with a self-signed certificate for 127.0.0.1,
+// and returns it with a pool that trusts that certificate.
+func newFakeSMTP(t *testing.T, implicitTLS, startTLS bool) (*fakeSMTP, *x509.CertPool) {
+	t.Helper()
+	cert, pool := newTestCertificate(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+
+	s := &fakeSMTP{
+		listener:    l,
+		tlsConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		implicitTLS: implicitTLS,
+		startTLS:    startTLS,
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, pool
+}
+
+// account returns an account of the server with the settings provided.
+func (s *fakeSMTP) account(tlsMode, auth string, pool *x509.CertPool) Account {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return Account{
+		Hostname: host,
+		Port:     port,
+		Username: fakeSMTPUsername,
+		Password: fakeSMTPPassword,
+		TLS:      tlsMode,
+		RootCAs:  pool,
+		Auth:     auth,
+	}
+}
+
+// Close stops the server.
+func (s *fakeSMTP) Close() {
+	s.listener.Close()
+}
+
+// SetMailReply sets the reply to the MAIL commands, or restores the normal one if it's empty.
+func (s *fakeSMTP) SetMailReply(reply string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.mailReply = reply
+}
+
+// Drop closes the connections open, like a server that times out idle sessions.
+func (s *fakeSMTP) Drop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+// Sessions returns the sessions served so far.
+func (s *fakeSMTP) Sessions() []fakeSession {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sessions := make([]fakeSession, len(s.sessions))
+	for i := range s.sessions {
+		sessions[i] = *s.sessions[i]
+	}
+	return sessions
+}
+
+// serve serves an SMTP session in the connection provided.
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	sess := &fakeSession{}
+	s.mutex.Lock()
+	s.sessions = append(s.sessions, sess)
+	s.conns = append(s.conns, conn)
+	s.mutex.Unlock()
+
+	// update records a change of the session
+	update := func(f func()) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		f()
+	}
+
+	if s.implicitTLS {
+		conn = tls.Server(conn, s.tlsConfig)
+		update(func() { sess.tls = true })
+	}
+	tp := textproto.NewConn(conn)
+	_ = tp.PrintfLine("220 fake ESMTP")
+
+	var msg fakeMessage
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			_ = tp.PrintfLine("500 empty command")
+			continue
+		}
+
+		switch cmd := strings.ToUpper(fields[0]); cmd {
+		case "EHLO", "HELO":
+			update(func() { sess.helo = strings.Join(fields[1:], " ") })
+			_ = tp.PrintfLine("250-fake")
+			if s.startTLS && !sess.tls {
+				_ = tp.PrintfLine("250-STARTTLS")
+			}
+			_ = tp.PrintfLine("250 AUTH PLAIN LOGIN CRAM-MD5 XOAUTH2")
+		case "STARTTLS":
+			_ = tp.PrintfLine("220 go ahead")
+			conn = tls.Server(conn, s.tlsConfig)
+			tp = textproto.NewConn(conn)
+			update(func() { sess.tls = true })
+		case "AUTH":
+			ok := s.authenticate(tp, fields[1:])
+			update(func() {
+				sess.auth = strings.ToLower(fields[1])
+				sess.authenticated = ok
+			})
+			if !ok {
+				_ = tp.PrintfLine("535 authentication failed")
+				continue
+			}
+			_ = tp.PrintfLine("235 authenticated")
+		case "MAIL":
+			s.mutex.Lock()
+			reply := s.mailReply
+			s.mutex.Unlock()
+			if reply != "" {
+				_ = tp.PrintfLine("%s", reply)
+				continue
+			}
+			msg = fakeMessage{from: between(line, "<", ">")}
+			_ = tp.PrintfLine("250 ok")
+		case "RCPT":
+			addr := between(line, "<", ">")
+			if strings.HasPrefix(addr, "rejected") {
+				_ = tp.PrintfLine("550 mailbox unavailable")
+				continue
+			}
+			msg.to = append(msg.to, addr)
+			_ = tp.PrintfLine("250 ok")
+		case "DATA":
+			_ = tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			update(func() { sess.messages = append(sess.messages, msg) })
+			_ = tp.PrintfLine("250 queued")
+		case "RSET", "NOOP":
+			_ = tp.PrintfLine("250 ok")
+		case "QUIT":
+			_ = tp.PrintfLine("221 bye")
+			return
+		default:
+			_ = tp.PrintfLine("502 %s not implemented", cmd)
+		}
+	}
+}
+
+// authenticate runs the AUTH command with the arguments provided, and returns whether the credentials are valid.
+func (s *fakeSMTP) authenticate(tp *textproto.Conn, args []string) bool {
+	// readResponse returns the initial response of the client, or asks for it
+	readResponse := func(challenge string) string {
+		if challenge == "" && len(args) > 1 {
+			data, _ := base64.StdEncoding.DecodeString(args[1])
+			return string(data)
+		}
+		_ = tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(challenge)))
+		line, _ := tp.ReadLine()
+		data, _ := base64.StdEncoding.DecodeString(line)
+		return string(data)
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "PLAIN":
+		return readResponse("") == "\x00"+fakeSMTPUsername+"\x00"+fakeSMTPPassword
+	case "LOGIN":
+		return readResponse("Username:") == fakeSMTPUsername && readResponse("Password:") == fakeSMTPPassword
+	case "CRAM-MD5":
+		challenge := "<1234.5678@fake>"
+		mac := hmac.New(md5.New, []byte(fakeSMTPPassword))
+		mac.Write([]byte(challenge))
+		return readResponse(challenge) == fakeSMTPUsername+" "+hex.EncodeToString(mac.Sum(nil))
+	case "XOAUTH2":
+		return readResponse("") == "user="+fakeSMTPUsername+"\x01auth=Bearer "+fakeSMTPPassword+"\x01\x01"
+	}
+	return false
+}
+
+// between returns the part of the string provided between the first occurrence of start and the next one of end.
+func between(s, start, end string) string {
+	i := strings.Index(s, start)
+	if i < 0 {
+		return ""
+	}
+	s = s[i+len(start):]
+	if j := strings.Index(s, end); j >= 0 {
+		return s[:j]
+	}
+	return s
+}
+
+// newTestCertificate returns a self-signed certificate for 127.0.0.1 and a pool that trusts it.
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake SMTP"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("error parsing certificate: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestAccount_sendMail(t *testing.T) {
+	tests := []struct {
+		name        string
+		implicitTLS bool
+		startTLS    bool
+		tlsMode     string
+		auth        string
+		expectedTLS bool
+	}{
+		{"implicit TLS with plain auth", true, false, TLSImplicit, AuthPlain, true},
+		{"STARTTLS with login auth", false, true, TLSStartTLS, AuthLogin, true},
+		{"opportunistic STARTTLS with XOAUTH2", false, true, "", AuthXOAUTH2, true},
+		{"opportunistic without STARTTLS with CRAM-MD5", false, false, TLSOpportunistic, AuthCRAMMD5, false},
+		{"no TLS with plain auth to localhost", false, true, TLSNone, AuthPlain, false},
+		{"no TLS without auth", false, false, TLSNone, AuthNone, false},
+	}
+
+	for _, test := range tests {
+		srv, pool := newFakeSMTP(t, test.implicitTLS, test.startTLS)
+		a := srv.account(test.tlsMode, test.auth, pool)
+		a.HELO = "forms.example.com"
+
+		err := a.sendMail("no-reply@example.com", []string{"a@example.com", "b@example.com"}, []byte("Subject: Hi\r\n\r\nHello\r\n"))
+		srv.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+
+		sessions := srv.Sessions()
+		if len(sessions) != 1 || len(sessions[0].messages) != 1 {
+			t.Errorf("%s: expected one session with one message, found %+v", test.name, sessions)
+			continue
+		}
+		sess, msg := sessions[0], sessions[0].messages[0]
+		if sess.helo != "forms.example.com" || sess.tls != test.expectedTLS {
+			t.Errorf("%s: unexpected session: HELO %s, TLS %t", test.name, sess.helo, sess.tls)
+		}
+		if expectedAuth := test.auth; expectedAuth != AuthNone && (sess.auth != expectedAuth || !sess.authenticated) {
+			t.Errorf("%s: not authenticated with %s: %+v", test.name, expectedAuth, sess)
+		}
+		if test.auth == AuthNone && sess.auth != "" {
+			t.Errorf("%s: unexpected authentication with %s", test.name, sess.auth)
+		}
+		// ReadDotBytes converts line breaks to LF
+		if msg.from != "no-reply@example.com" || strings.Join(msg.to, ",") != "a@example.com,b@example.com" ||
+			msg.data != "Subject: Hi\n\nHello\n" {
+			t.Errorf("%s: unexpected message: %+v", test.name, msg)
+		}
+	}
+}
+
+func TestAccount_sendMail_errors(t *testing.T) {
+	noTLS, _ := newFakeSMTP(t, false, false)
+	defer noTLS.Close()
+	a := noTLS.account(TLSStartTLS, AuthPlain, nil)
+	if err := a.sendMail("a@example.com", []string{"b@example.com"}, nil); err == nil {
+		t.Error("no error found when STARTTLS is required but not supported")
+	}
+
+	implicit, pool := newFakeSMTP(t, true, false)
+	defer implicit.Close()
+	a = implicit.account(TLSImplicit, AuthPlain, nil)
+	if err := a.sendMail("a@example.com", []string{"b@example.com"}, nil); err == nil {
+		t.Error("no error found for an untrusted certificate")
+	}
+	a = implicit.account(TLSImplicit, AuthPlain, nil)
+	a.InsecureSkipVerify = true
+	if err := a.sendMail("a@example.com", []string{"b@example.com"}, []byte("Hi\r\n")); err != nil {
+		t.Errorf("unexpected error skipping verification: %s", err)
+	}
+	a = implicit.account(TLSImplicit, AuthPlain, pool)
+	a.ServerName = "mail.example.com"
+	if err := a.sendMail("a@example.com", []string{"b@example.com"}, nil); err == nil {
+		t.Error("no error found for a certificate of another server name")
+	}
+	a = implicit.account(TLSImplicit, AuthLogin, pool)
+	a.Password = "wrong"
+	if err := a.sendMail("a@example.com", []string{"b@example.com"}, nil); err == nil {
+		t.Error("no error found for wrong credentials")
+	}
+
+	// A server that never greets
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	a = Account{Hostname: host, Port: port, Auth: AuthNone, CommandTimeout: 100 * time.Millisecond}
+	start := time.Now()
+	if err = a.sendMail("a@example.com", []string{"b@example.com"}, nil); err == nil || time.Since(start) > 900*time.Millisecond {
+		t.Errorf("command timeout not applied: %v after %s", err, time.Since(start))
+	}
+}
+
+func TestMail_Send_from(t *testing.T) {
+	srv, _ := newFakeSMTP(t, false, false)
+	defer srv.Close()
+
+	a := srv.account(TLSNone, AuthNone, nil)
+	a.Username, a.Password = "", ""
+	sm := &Mail{
+		WebName:    "mywebsite.com",
+		Recipients: Recipients{To: []string{"a@example.com"}},
+		Account:    a,
+		From:       "forms@mywebsite.com",
+		FromName:   "My website",
+	}
+	if err := sm.Send(newTestForm("John", "john@example.com", "Hi")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	sessions := srv.Sessions()
+	if len(sessions) != 1 || len(sessions[0].messages) != 1 {
+		t.Fatalf("expected one session with one message, found %+v", sessions)
+	}
+	msg := sessions[0].messages[0]
+	if msg.from != "forms@mywebsite.com" {
+		t.Errorf("unexpected MAIL FROM:\n-> Expected: forms@mywebsite.com\n-> Found: %s", msg.from)
+	}
+	if !strings.Contains(msg.data, "From: \"My website\" <forms@mywebsite.com>\n") {
+		t.Errorf("unexpected From header in message:\n%s", msg.data)
+	}
+}
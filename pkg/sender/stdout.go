@@ -0,0 +1,54 @@
+package sender
+
+import (
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Stdout represents a type that writes forms to the standard output. It's intended for development.
+type Stdout struct {
+	WebName string
+	// Writer is where the forms are written. If nil, os.Stdout is used.
+	Writer io.Writer
+
+	mutex sync.Mutex
+}
+
+// Send will write the form provided.
+func (so *Stdout) Send(f *form.Form) error {
+	w := so.Writer
+	if w == nil {
+		w = os.Stdout
+	}
+
+	so.mutex.Lock()
+	defer so.mutex.Unlock()
+
+	if _, err := io.WriteString(w, createText(so.WebName, f)+"\n"); err != nil {
+		return fmt.Errorf("error writing form: %s", err)
+	}
+	return nil
+}
+
+// createText will return a plain text representation of the form provided.
+// Multiline values start in the line after their label, and forms tagged as spam start with spamTag.
+func createText(webName string, f *form.Form) string {
+	var b strings.Builder
+	if f.Spam {
+		b.WriteString(spamTag)
+	}
+	b.WriteString("Message from " + webName)
+	for _, v := range f.Values {
+		b.WriteString("\n" + v.Label + ":")
+		if v.Type == form.TypeMultiline {
+			b.WriteString("\n" + strings.Replace(v.Value, "\r\n", "\n", -1))
+		} else {
+			b.WriteString(" " + v.Display())
+		}
+	}
+	return b.String()
+}
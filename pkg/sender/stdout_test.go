@@ -0,0 +1,19 @@
+package sender
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStdout_Send(t *testing.T) {
+	var buf bytes.Buffer
+	so := Stdout{WebName: "mywebsite.com", Writer: &buf}
+	if err := so.Send(newTestForm("John", "john@example.com", "Hi\r\nthere")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := "Message from mywebsite.com\nName: John\nEmail: john@example.com\nMessage:\nHi\nthere\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected output:\n-> Expected: \"%s\"\n-> Found: \"%s\"", expected, buf.String())
+	}
+}
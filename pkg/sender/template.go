@@ -0,0 +1,161 @@
+package sender
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	htmltemplate "html/template"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Templates represents the templates used to build the subject and the bodies of the messages that contain forms.
+// The subject and the text body are text/template templates, and the HTML body is a html/template template.
+// Nil templates are replaced by the default ones.
+//
+// The templates are executed with a TemplateData. Referencing a missing key, like a field not declared
+// in the schema of the site, is an error.
+type Templates struct {
+	Subject *texttemplate.Template
+	Text    *texttemplate.Template
+	HTML    *htmltemplate.Template
+}
+
+// TemplateData represents the data the templates are executed with.
+type TemplateData struct {
+	// Site is the name of the site.
+	Site string
+	// Fields are the values of the form by field name.
+	Fields map[string]string
+	// Values are the values of the form, in the order of the schema.
+	Values []form.Value
+	// Files are the files uploaded with the form.
+	Files []form.File
+	// Timestamp is the time the form was submitted.
+	Timestamp time.Time
+	// ClientIP is the IP address of the submitter.
+	ClientIP string
+	// RequestID is the ID of the request the form was submitted with.
+	RequestID string
+	// Spam tells if the form was tagged as spam.
+	Spam bool
+}
+
+// LoadTemplates parses the template files in the paths provided. Empty paths are left as nil templates.
+func LoadTemplates(subjectPath, textPath, htmlPath string) (*Templates, error) {
+	t := &Templates{}
+	var err error
+	if subjectPath != "" {
+		if t.Subject, err = texttemplate.New(filepath.Base(subjectPath)).Option("missingkey=error").ParseFiles(subjectPath); err != nil {
+			return nil, fmt.Errorf("error parsing subject template: %w", err)
+		}
+	}
+	if textPath != "" {
+		if t.Text, err = texttemplate.New(filepath.Base(textPath)).Option("missingkey=error").ParseFiles(textPath); err != nil {
+			return nil, fmt.Errorf("error parsing text template: %w", err)
+		}
+	}
+	if htmlPath != "" {
+		if t.HTML, err = htmltemplate.New(filepath.Base(htmlPath)).Option("missingkey=error").ParseFiles(htmlPath); err != nil {
+			return nil, fmt.Errorf("error parsing HTML template: %w", err)
+		}
+	}
+	return t, nil
+}
+
+// Check executes the templates with a sample form of the schema provided,
+// so the errors that don't depend on the values of the form are found before any form is received.
+func (t *Templates) Check(webName string, s form.Schema) error {
+	f := &form.Form{
+		Values:    make([]form.Value, len(s)),
+		Submitted: time.Now(),
+		ClientIP:  "192.0.2.1",
+		RequestID: "0123456789abcdef",
+	}
+	for i := range s {
+		f.Values[i] = form.Value{Name: s[i].Name, Label: s[i].Label, Type: s[i].Type, Value: s[i].Name}
+	}
+
+	_, _, _, err := t.execute(webName, f)
+	return err
+}
+
+// or returns the templates, with the nil ones replaced by the ones provided.
+func (t *Templates) or(defaults *Templates) *Templates {
+	if t == nil {
+		return defaults
+	}
+
+	merged := *t
+	if merged.Subject == nil {
+		merged.Subject = defaults.Subject
+	}
+	if merged.Text == nil {
+		merged.Text = defaults.Text
+	}
+	if merged.HTML == nil {
+		merged.HTML = defaults.HTML
+	}
+	return &merged
+}
+
+// execute returns the subject, the text body and the HTML body of the message that contains the form provided.
+// The templates can be nil, in which case the default ones are used.
+func (t *Templates) execute(webName string, f *form.Form) (subject, text, html string, err error) {
+	if t == nil {
+		t = &Templates{}
+	}
+	data := newTemplateData(webName, f)
+
+	subject = "Message from " + webName
+	if t.Subject != nil {
+		var buf bytes.Buffer
+		if err = t.Subject.Execute(&buf, data); err != nil {
+			return "", "", "", fmt.Errorf("error executing subject template: %w", err)
+		}
+		// The subject is a single line
+		subject = strings.Join(strings.Fields(buf.String()), " ")
+	}
+	if f.Spam {
+		subject = spamTag + subject
+	}
+
+	text = createText(webName, f)
+	if t.Text != nil {
+		var buf bytes.Buffer
+		if err = t.Text.Execute(&buf, data); err != nil {
+			return "", "", "", fmt.Errorf("error executing text template: %w", err)
+		}
+		text = buf.String()
+	}
+
+	html = createHTML(f)
+	if t.HTML != nil {
+		var buf bytes.Buffer
+		if err = t.HTML.Execute(&buf, data); err != nil {
+			return "", "", "", fmt.Errorf("error executing HTML template: %w", err)
+		}
+		html = buf.String()
+	}
+	return subject, text, html, nil
+}
+
+// newTemplateData returns the data the templates are executed with for the form provided.
+func newTemplateData(webName string, f *form.Form) *TemplateData {
+	fields := make(map[string]string, len(f.Values))
+	for _, v := range f.Values {
+		fields[v.Name] = v.Value
+	}
+	return &TemplateData{
+		Site:      webName,
+		Fields:    fields,
+		Values:    f.Values,
+		Files:     f.Files,
+		Timestamp: f.Submitted,
+		ClientIP:  f.ClientIP,
+		RequestID: f.RequestID,
+		Spam:      f.Spam,
+	}
+}
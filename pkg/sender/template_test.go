@@ -0,0 +1,132 @@
+package sender
+
+import (
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	texttemplate "text/template"
+	"time"
+)
+
+// writeTemplates writes the templates provided to a temporary directory and returns their paths.
+func writeTemplates(t *testing.T, dir string, templates map[string]string) map[string]string {
+	t.Helper()
+	paths := make(map[string]string, len(templates))
+	for name, content := range templates {
+		paths[name] = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(paths[name], []byte(content), 0600); err != nil {
+			t.Fatalf("error writing template %s: %s", name, err)
+		}
+	}
+	return paths
+}
+
+func TestTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	paths := writeTemplates(t, dir, map[string]string{
+		"subject.txt": "[{{.Site}}]\n{{.Fields.name}} says hi\n",
+		"body.txt":    "{{range .Values}}{{.Label}} = {{.Display}}\n{{end}}{{.ClientIP}} {{.RequestID}} {{.Timestamp.Year}}",
+		"body.html":   "<p>{{.Fields.msg}}</p>",
+	})
+	templates, err := LoadTemplates(paths["subject.txt"], paths["body.txt"], paths["body.html"])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err = templates.Check("mywebsite.com", form.DefaultSchema); err != nil {
+		t.Errorf("unexpected error checking templates: %s", err)
+	}
+
+	f := newTestForm("John", "john@example.com", "<b>Hi</b>")
+	f.Submitted = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	f.ClientIP = "203.0.113.7"
+	f.RequestID = "abc123"
+
+	subject, text, html, err := templates.execute("mywebsite.com", f)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := "[mywebsite.com] John says hi"; subject != expected {
+		t.Errorf("Unexpected subject:\n-> Expected: %s\n-> Found: %s", expected, subject)
+	}
+	if expected := "Name = John\nEmail = john@example.com\nMessage = <b>Hi</b>\n203.0.113.7 abc123 2020"; text != expected {
+		t.Errorf("Unexpected text:\n-> Expected: %s\n-> Found: %s", expected, text)
+	}
+	if expected := "<p>&lt;b&gt;Hi&lt;/b&gt;</p>"; html != expected {
+		t.Errorf("Unexpected HTML:\n-> Expected: %s\n-> Found: %s", expected, html)
+	}
+}
+
+func TestTemplates_default(t *testing.T) {
+	f := newTestForm("John", "john@example.com", "Hi")
+	subject, text, html, err := (*Templates)(nil).execute("mywebsite.com", f)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if subject != "Message from mywebsite.com" || text != createText("mywebsite.com", f) || html != createHTML(f) {
+		t.Errorf("unexpected default message: %s\n%s\n%s", subject, text, html)
+	}
+}
+
+func TestTemplates_spam(t *testing.T) {
+	f := newTestForm("John", "john@example.com", "Hi")
+	f.Spam = true
+	templates := &Templates{Subject: texttemplate.Must(texttemplate.New("subject").Parse("{{.Fields.name}} says hi"))}
+
+	for _, test := range []struct {
+		templates *Templates
+		expected  string
+	}{
+		{nil, "[SPAM] Message from mywebsite.com"},
+		{templates, "[SPAM] John says hi"},
+	} {
+		subject, text, _, err := test.templates.execute("mywebsite.com", f)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if subject != test.expected {
+			t.Errorf("Unexpected subject:\n-> Expected: %s\n-> Found: %s", test.expected, subject)
+		}
+		if test.templates == nil && !strings.HasPrefix(text, "[SPAM] Message from mywebsite.com\n") {
+			t.Errorf("default text not tagged:\n%s", text)
+		}
+	}
+}
+
+func TestTemplates_invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	paths := writeTemplates(t, dir, map[string]string{
+		"syntax.txt":  "{{.Site",
+		"missing.txt": "{{.Fields.phone}}",
+		"unknown.txt": "{{.Unknown}}",
+	})
+
+	if _, err = LoadTemplates(paths["syntax.txt"], "", ""); err == nil {
+		t.Error("no error found for template with invalid syntax")
+	}
+	if _, err = LoadTemplates("", filepath.Join(dir, "nonexistent.txt"), ""); err == nil {
+		t.Error("no error found for nonexistent template")
+	}
+
+	for _, name := range []string{"missing.txt", "unknown.txt"} {
+		templates, err := LoadTemplates("", paths[name], "")
+		if err != nil {
+			t.Fatalf("unexpected error loading %s: %s", name, err)
+		}
+		if err = templates.Check("mywebsite.com", form.DefaultSchema); err == nil || !strings.Contains(err.Error(), "text template") {
+			t.Errorf("unexpected result checking %s: %v", name, err)
+		}
+	}
+}
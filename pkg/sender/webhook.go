@@ -0,0 +1,42 @@
+package sender
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg"
+	"github.com/nethruster/ptemplate-form-handler/pkg/client"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+)
+
+// Webhook represents a type that send forms as a JSON POST request to a URL.
+type Webhook struct {
+	WebName string
+	URL     string
+	Headers map[string]string
+}
+
+// webhookPayload represents the JSON body of the requests made by Webhook. The values of the fields of the form
+// are kept in their own object, so they cannot be mistaken for the rest of the members.
+type webhookPayload struct {
+	Site   string            `json:"site"`
+	Fields map[string]string `json:"fields"`
+	Spam   bool              `json:"spam,omitempty"`
+}
+
+// Send will send the form provided to the webhook URL.
+func (wh *Webhook) Send(f *form.Form) error {
+	payload := webhookPayload{Site: wh.WebName, Fields: make(map[string]string, len(f.Values)), Spam: f.Spam}
+	for _, v := range f.Values {
+		payload.Fields[v.Name] = v.Value
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error parsing webhook JSON: %s", err)
+	}
+
+	if _, err = client.Post(wh.URL, pkg.MimeJSON, wh.Headers, data); err != nil {
+		return fmt.Errorf("error sending webhook: %s", err)
+	}
+	return nil
+}
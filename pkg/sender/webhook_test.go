@@ -0,0 +1,67 @@
+package sender
+
+import (
+	"github.com/nethruster/ptemplate-form-handler/pkg"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhook_Send(t *testing.T) {
+	var (
+		body   []byte
+		header http.Header
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	wh := Webhook{
+		WebName: "mywebsite.com",
+		URL:     srv.URL,
+		Headers: map[string]string{"Authorization": "Bearer 1234567890"},
+	}
+	if err := wh.Send(newTestForm("John", "john@example.com", "Hi\nthere")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if contentType := header.Get(pkg.MimeContentType); contentType != pkg.MimeJSON {
+		t.Errorf("Content-Type is not JSON: %s", contentType)
+	}
+	if auth := header.Get("Authorization"); auth != "Bearer 1234567890" {
+		t.Errorf("Authorization header not sent: %s", auth)
+	}
+
+	expected := `{"site":"mywebsite.com","fields":{"mail":"john@example.com","msg":"Hi\nthere","name":"John"}}`
+	if string(body) != expected {
+		t.Errorf("Unexpected body:\n-> Expected: %s\n-> Found: %s", expected, body)
+	}
+
+	// A field named like a member of the payload doesn't replace it
+	f := newTestForm("John", "john@example.com", "Hi")
+	f.Values = append(f.Values, form.Value{Name: "spam", Value: "false"})
+	f.Spam = true
+	if err := wh.Send(f); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected = `{"site":"mywebsite.com","fields":{"mail":"john@example.com","msg":"Hi","name":"John","spam":"false"},"spam":true}`
+	if string(body) != expected {
+		t.Errorf("Unexpected body of a spam form:\n-> Expected: %s\n-> Found: %s", expected, body)
+	}
+}
+
+func TestWebhook_Send_error(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	wh := Webhook{WebName: "mywebsite.com", URL: srv.URL}
+	if err := wh.Send(&form.Form{}); err == nil {
+		t.Error("no error returned when webhook failed")
+	}
+}
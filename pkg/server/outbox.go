@@ -0,0 +1,135 @@
+package server
+
+import (
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"github.com/nethruster/ptemplate-form-handler/pkg/queue"
+	"github.com/nethruster/ptemplate-form-handler/pkg/sender"
+	"strings"
+	"time"
+)
+
+// queuePollInterval is how often the queue is checked for items due for delivery.
+const queuePollInterval = 10 * time.Second
+
+// deliver will deliver the form provided to all the senders of the site provided.
+//
+// If the queue is enabled, the form is stored in it before the delivery is attempted, in flight so runQueue doesn't
+// retry it meanwhile, and kept there to be retried later by runQueue for the senders it cannot be delivered to. The delivery policy of the senders still applies:
+// if only best-effort senders fail, the form is delivered. If a required sender fails, the form is reported as
+// queued and no error is returned, unless it cannot be kept in the queue (e.g. it has no attempts left).
+// In that case, the error of the delivery is returned, as if the queue was disabled.
+func deliver(site string, m *sender.Multi, f *form.Form) (queued bool, err error) {
+	var it *queue.Item
+	if conf.Queue != nil {
+		if it, err = queue.NewItem(site, m.Names(), f); err == nil {
+			err = conf.Queue.Add(it)
+		}
+		if err != nil {
+			Log.Errorf("Error adding form to the queue, delivering without it: %s", err)
+			it = nil
+		}
+	}
+
+	res := m.Deliver(f)
+	logResult(site, res)
+
+	if it == nil {
+		return false, res.Err()
+	}
+
+	failed := res.Failed()
+	if len(failed) == 0 {
+		if err = conf.Queue.Remove(it.ID); err != nil {
+			Log.Errorf("Error removing delivered form %s from the queue: %s", it.ID, err)
+		}
+		return false, nil
+	}
+
+	pending := failQueueItem(it, failed, res.Errors())
+	if err = res.Err(); err == nil {
+		return false, nil
+	}
+	if !pending {
+		return false, err
+	}
+	return true, nil
+}
+
+// runQueue will retry the delivery of the items of the queue that are due, until the stop channel is closed.
+func runQueue(stop <-chan struct{}) {
+	ticker := time.NewTicker(queuePollInterval)
+	defer ticker.Stop()
+
+	for {
+		retryQueue()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// retryQueue will retry the delivery of the items of the queue that are due.
+func retryQueue() {
+	items, err := conf.Queue.Due()
+	if err != nil {
+		Log.Errorf("Error reading queue: %s", err)
+		return
+	}
+
+	for _, it := range items {
+		Log.Debugf("Retrying delivery of queued form %s (attempt #%d)", it.ID, it.Attempts+1)
+
+		site := conf.Site(it.Site)
+		if site == nil {
+			failQueueItem(it, it.Targets, errUnknownSite)
+			continue
+		}
+
+		res := site.Sender.DeliverTo(it.Form, it.Targets)
+		logResult(it.Site, res)
+
+		if failed := res.Failed(); len(failed) != 0 {
+			failQueueItem(it, failed, res.Errors())
+			continue
+		}
+
+		if err = conf.Queue.Remove(it.ID); err != nil {
+			Log.Errorf("Error removing delivered form %s from the queue: %s", it.ID, err)
+		}
+	}
+}
+
+// failQueueItem records in the queue a failed delivery of the item provided to the targets provided.
+// It returns whether the delivery of the item will be retried.
+func failQueueItem(it *queue.Item, targets []string, err error) bool {
+	dead, qErr := conf.Queue.Fail(it, targets, err)
+	if qErr == queue.ErrNotFound {
+		Log.Infof("Form %s is no longer queued, so its failed delivery is not recorded", it.ID)
+		return false
+	}
+	if qErr != nil {
+		Log.Errorf("Error updating queued form %s: %s", it.ID, qErr)
+		return false
+	}
+
+	if dead {
+		Log.Errorf("Form %s moved to dead queue after %d attempts: %s", it.ID, it.Attempts, err)
+		return false
+	}
+	Log.Infof("Form %s queued for [%s], next attempt at %s", it.ID, strings.Join(targets, ", "), it.NextAttempt.Format(time.RFC3339))
+	return true
+}
+
+// logResult logs the outcome of delivering a form of the site provided.
+func logResult(site string, res sender.Result) {
+	Log.Infof("Form of site %s delivered to [%s], failed for [%s]", site,
+		strings.Join(res.Succeeded(), ", "), strings.Join(res.Failed(), ", "))
+	for _, tr := range res {
+		if tr.Err != nil {
+			Log.Errorf("Sender %s failed: %s", tr.Target.Name, tr.Err)
+		}
+	}
+}
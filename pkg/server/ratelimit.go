@@ -0,0 +1,81 @@
+package server
+
+import (
+	"github.com/nethruster/ptemplate-form-handler/pkg/config"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"github.com/nethruster/ptemplate-form-handler/pkg/ratelimit"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rateLimitSaveInterval is how often the rate limits are saved to their store.
+const rateLimitSaveInterval = time.Minute
+
+// runRateLimits will save the rate limits to their store periodically, until the stop channel is closed.
+func runRateLimits(stop <-chan struct{}) {
+	ticker := time.NewTicker(rateLimitSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			saveRateLimits()
+		}
+	}
+}
+
+// saveRateLimits will save the rate limits to their store.
+func saveRateLimits() {
+	if err := conf.RateLimits.Save(); err != nil {
+		Log.Errorf("Error saving rate limits: %s", err)
+	}
+}
+
+// allow records a use of the rate limits of the site provided by the client with the IP address provided,
+// and by each email address of the form provided. No use is recorded unless all of them are allowed.
+// If any of them is not, it responds with 429 Too Many Requests, a Retry-After header and a JSON api.Response,
+// and returns false.
+func allow(w http.ResponseWriter, requestID string, site *config.Site, ip string, f *form.Form) bool {
+	var uses []ratelimit.Use
+	var names []string
+	if site.IPLimit != nil {
+		uses = append(uses, ratelimit.Use{Limiter: site.IPLimit, Key: ip})
+		names = append(names, "per IP")
+	}
+	if site.EmailLimit != nil {
+		for _, address := range emails(f) {
+			uses = append(uses, ratelimit.Use{Limiter: site.EmailLimit, Key: address})
+			names = append(names, "per email")
+		}
+	}
+	if site.GlobalLimit != nil {
+		uses = append(uses, ratelimit.Use{Limiter: site.GlobalLimit})
+		names = append(names, "global")
+	}
+
+	ok, refused, retryAfter := ratelimit.AllowAll(uses...)
+	if ok {
+		return true
+	}
+
+	Log.Infof("Request %s rate limited by the %s limit (retry after %s)", requestID, names[refused], retryAfter)
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	statusWriter(w, http.StatusTooManyRequests, false, errTooManyRequests.Error())
+	return false
+}
+
+// emails returns the email addresses of the form provided, in lower case so they are limited regardless of it.
+func emails(f *form.Form) []string {
+	var addresses []string
+	for _, v := range f.Values {
+		if v.Type == form.TypeEmail && v.Value != "" {
+			addresses = append(addresses, strings.ToLower(v.Value))
+		}
+	}
+	return addresses
+}
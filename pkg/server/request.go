@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/api"
+	"github.com/nethruster/ptemplate-form-handler/pkg"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// maxMemory is the maximum size of a multipart request body that is kept in memory while parsing it.
+const maxMemory = 1 << 20
+
+// submission represents the content of a request, regardless of the encoding it was sent with.
+// Only multipart requests can have files.
+//
+// recaptcha is the value of the api.FieldRecaptcha field, which is not included in values. The captcha responses
+// sent in other fields are in values until they are taken with captchaResponse, once the site is known.
+type submission struct {
+	site      string
+	recaptcha string
+	values    map[string][]string
+	files     map[string][]*form.File
+}
+
+// parseRequest returns the content of the request provided.
+// If it fails, it also returns the HTTP status code that describes the failure.
+//
+// The request body can be JSON (see api.Request), form-urlencoded or multipart.
+// In the last two cases, the form fields are named like the JSON members.
+func parseRequest(r *http.Request) (*submission, int, error) {
+	contentType, _, err := mime.ParseMediaType(r.Header.Get(pkg.MimeContentType))
+	if err != nil {
+		contentType = r.Header.Get(pkg.MimeContentType)
+	}
+
+	switch contentType {
+	case pkg.MimeJSON:
+		return parseJSON(r)
+	case pkg.MimeFormURLEncoded:
+		if err = r.ParseForm(); err != nil {
+			return nil, bodyErrorStatus(err), fmt.Errorf("malformed form: %w", err)
+		}
+	case pkg.MimeMultipartForm:
+		if err = r.ParseMultipartForm(maxMemory); err != nil {
+			return nil, bodyErrorStatus(err), fmt.Errorf("malformed form: %w", err)
+		}
+		defer r.MultipartForm.RemoveAll()
+	default:
+		return nil, http.StatusUnsupportedMediaType, fmt.Errorf("content-type %s not supported", contentType)
+	}
+
+	values := make(map[string][]string, len(r.PostForm))
+	for k, v := range r.PostForm {
+		values[k] = v
+	}
+	s := &submission{
+		site:      first(values[api.FieldSite]),
+		recaptcha: first(values[api.FieldRecaptcha]),
+		values:    values,
+	}
+	delete(values, api.FieldSite)
+	delete(values, api.FieldRecaptcha)
+
+	if r.MultipartForm != nil {
+		if s.files, err = readFiles(r.MultipartForm.File); err != nil {
+			return nil, statusUnknownError, err
+		}
+	}
+	return s, 0, nil
+}
+
+// captchaResponse returns the captcha response sent in the field provided, removing it from the values.
+// It returns an empty string if the field is empty, like the one of sites without captcha.
+func (s *submission) captchaResponse(field string) string {
+	switch field {
+	case "":
+		return ""
+	case api.FieldRecaptcha:
+		return s.recaptcha
+	}
+	response := first(s.values[field])
+	delete(s.values, field)
+	return response
+}
+
+// readFiles returns the content of the files of a multipart form.
+func readFiles(headers map[string][]*multipart.FileHeader) (map[string][]*form.File, error) {
+	files := make(map[string][]*form.File, len(headers))
+	for field, list := range headers {
+		for _, fh := range list {
+			data, err := readFile(fh)
+			if err != nil {
+				return nil, fmt.Errorf("unknown error while reading file \"%s\": %w", fh.Filename, err)
+			}
+			files[field] = append(files[field], &form.File{
+				Filename: fh.Filename,
+				Data:     data,
+			})
+		}
+	}
+	return files, nil
+}
+
+// readFile returns the content of a file of a multipart form.
+func readFile(fh *multipart.FileHeader) ([]byte, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// parseJSON returns the content of the request provided, whose body must be a JSON api.Request.
+func parseJSON(r *http.Request) (*submission, int, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		if status := bodyErrorStatus(err); status == http.StatusRequestEntityTooLarge {
+			return nil, status, errRequestTooLarge
+		}
+		return nil, statusUnknownError, fmt.Errorf("unknown error while reading request body: %w", err)
+	}
+
+	var r2 api.Request
+	if err = json.Unmarshal(body, &r2); err != nil {
+		return nil, http.StatusBadRequest, errors.New("malformed JSON")
+	}
+
+	values, err := form.FromJSON(r2.Fields)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	return &submission{
+		site:      r2.Site,
+		recaptcha: r2.Recaptcha,
+		values:    values,
+	}, 0, nil
+}
+
+// bodyErrorStatus returns the HTTP status code that describes the error provided, returned while reading
+// a request body. The body is limited with http.MaxBytesReader, whose error can only be identified by its message.
+func bodyErrorStatus(err error) int {
+	if strings.Contains(err.Error(), "request body too large") {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// first returns the first element of the list provided, or an empty string if it's empty.
+func first(list []string) string {
+	if len(list) == 0 {
+		return ""
+	}
+	return list[0]
+}
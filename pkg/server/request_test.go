@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseRequest(t *testing.T) {
+	var multipartBody bytes.Buffer
+	mw := multipart.NewWriter(&multipartBody)
+	for _, kv := range [][2]string{{"site", "blog"}, {"g-recaptcha-response", "token"}, {"name", "John"}, {"msg", "Hi"}} {
+		_ = mw.WriteField(kv[0], kv[1])
+	}
+	_ = mw.Close()
+
+	tests := []struct {
+		contentType string
+		body        string
+	}{
+		{pkg.MimeJSON, `{"site": "blog", "g-recaptcha-response": "token", "name": "John", "msg": "Hi"}`},
+		{pkg.MimeJSON + "; charset=utf-8", `{"site": "blog", "g-recaptcha-response": "token", "name": "John", "msg": "Hi"}`},
+		{pkg.MimeFormURLEncoded, url.Values{"site": {"blog"}, "g-recaptcha-response": {"token"}, "name": {"John"}, "msg": {"Hi"}}.Encode()},
+		{mw.FormDataContentType(), multipartBody.String()},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+		r.Header.Set(pkg.MimeContentType, test.contentType)
+
+		sub, _, err := parseRequest(r)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.contentType, err)
+			continue
+		}
+		if sub.site != "blog" || sub.recaptcha != "token" {
+			t.Errorf("%s: unexpected site (%s) or recaptcha (%s)", test.contentType, sub.site, sub.recaptcha)
+		}
+		if values := fmt.Sprint(sub.values); values != "map[msg:[Hi] name:[John]]" {
+			t.Errorf("%s: unexpected values: %s", test.contentType, values)
+		}
+	}
+}
+
+func TestParseRequest_invalid(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		statusCode  int
+	}{
+		{pkg.MimeJSON, `{"name": "John"`, http.StatusBadRequest},
+		{pkg.MimeJSON, `{"name": {"first": "John"}}`, http.StatusBadRequest},
+		{"text/plain", "name=John", http.StatusUnsupportedMediaType},
+		{"", "name=John", http.StatusUnsupportedMediaType},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+		r.Header.Set(pkg.MimeContentType, test.contentType)
+
+		if _, statusCode, err := parseRequest(r); err == nil || statusCode != test.statusCode {
+			t.Errorf("%s %s: unexpected result: status %d, error %v", test.contentType, test.body, statusCode, err)
+		}
+	}
+}
+
+func TestParseRequest_files(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("name", "John")
+	for _, name := range []string{"a.txt", "b.txt"} {
+		fw, _ := mw.CreateFormFile("attachments", name)
+		_, _ = fw.Write([]byte("content of " + name))
+	}
+	_ = mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/", &body)
+	r.Header.Set(pkg.MimeContentType, mw.FormDataContentType())
+
+	sub, _, err := parseRequest(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if values := fmt.Sprint(sub.values); values != "map[name:[John]]" {
+		t.Errorf("unexpected values: %s", values)
+	}
+
+	files := sub.files["attachments"]
+	if len(files) != 2 {
+		t.Fatalf("unexpected number of files: %d", len(files))
+	}
+	for i, name := range []string{"a.txt", "b.txt"} {
+		if files[i].Filename != name || string(files[i].Data) != "content of "+name {
+			t.Errorf("unexpected file #%d: %s (%s)", i, files[i].Filename, files[i].Data)
+		}
+	}
+}
+
+func TestParseRequest_tooLarge(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("attachments", "big.bin")
+	_, _ = fw.Write(make([]byte, 4096))
+	_ = mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/", &body)
+	r.Header.Set(pkg.MimeContentType, mw.FormDataContentType())
+	r.Body = http.MaxBytesReader(httptest.NewRecorder(), r.Body, 1024)
+
+	if _, statusCode, err := parseRequest(r); err == nil || statusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("unexpected result: status %d, error %v", statusCode, err)
+	}
+}
+
+func TestSubmission_captchaResponse(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+	}{
+		{pkg.MimeJSON, `{"h-captcha-response": "token", "name": "John"}`},
+		{pkg.MimeFormURLEncoded, url.Values{"h-captcha-response": {"token"}, "name": {"John"}}.Encode()},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+		r.Header.Set(pkg.MimeContentType, test.contentType)
+
+		sub, _, err := parseRequest(r)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.contentType, err)
+			continue
+		}
+		if response := sub.captchaResponse("g-recaptcha-response"); response != "" {
+			t.Errorf("%s: unexpected response in the default field: %s", test.contentType, response)
+		}
+		if response := sub.captchaResponse("h-captcha-response"); response != "token" {
+			t.Errorf("%s: unexpected response: %s", test.contentType, response)
+		}
+		if values := fmt.Sprint(sub.values); values != "map[name:[John]]" {
+			t.Errorf("%s: captcha response not removed from the values: %s", test.contentType, values)
+		}
+		if response := sub.captchaResponse(""); response != "" {
+			t.Errorf("%s: unexpected response without field: %s", test.contentType, response)
+		}
+	}
+}
@@ -4,26 +4,50 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/Miguel-Dorta/logolang"
 	"github.com/nethruster/ptemplate-form-handler/api"
 	"github.com/nethruster/ptemplate-form-handler/pkg"
+	"github.com/nethruster/ptemplate-form-handler/pkg/captcha"
 	"github.com/nethruster/ptemplate-form-handler/pkg/config"
-	"github.com/nethruster/ptemplate-form-handler/pkg/recaptcha"
-	"github.com/nethruster/ptemplate-form-handler/pkg/sanitation"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
 	"github.com/nethruster/ptemplate-form-handler/pkg/sender"
-	"io/ioutil"
+	"github.com/nethruster/ptemplate-form-handler/pkg/spam"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 )
 
-const statusUnknownError = 502
+const (
+	statusUnknownError = 502
+
+	// sitesPath is the path prefix used to select a site by its ID (/sites/<id>).
+	sitesPath = "/sites/"
+
+	// tokenPath is the path of the token endpoint, also used after the ID of a site (/sites/<id>/token).
+	tokenPath = "/token"
+)
 
 var (
 	Log *logolang.Logger
-	s *sender.Mail
+	conf *config.Config
+
+	// CaptchaURL is the URL of the siteverify API the captcha responses of all the sites are verified by,
+	// instead of the ones of the captcha providers, if it's not empty. It's used in the development mode.
+	CaptchaURL string
+
+	errUnknownSite     = errors.New("unknown site")
+	errNoTokens        = errors.New("site without tokens")
+	errRequestTooLarge = errors.New("request too large")
+	errTooManyRequests = errors.New("too many requests")
 )
 
 // Run will start a HTTP server in the port provided using the config file path provided.
@@ -32,26 +56,65 @@ var (
 func Run(configFile, port string) {
 	// Load config
 	var err error
-	s, err = config.LoadConfig(configFile)
+	conf, err = config.LoadConfig(configFile)
 	if err != nil {
 		Log.Criticalf("error loading config file from path \"%s\": %s", configFile, err)
 		os.Exit(1)
 	}
 
+	Log.Infof("Loaded %d site(s)", len(conf.Sites))
+
+	if CaptchaURL != "" {
+		for _, site := range conf.Sites {
+			site.Captcha = captcha.WithEndpoint(site.Captcha, captcha.Endpoint{URL: CaptchaURL})
+		}
+		Log.Infof("Captcha responses are verified by %s", CaptchaURL)
+	}
+
+	stopQueue := make(chan struct{})
+	if conf.Queue != nil {
+		if err = conf.Queue.Init(); err != nil {
+			Log.Criticalf("error initializing queue in \"%s\": %s", conf.Queue.Dir, err)
+			os.Exit(1)
+		}
+		go runQueue(stopQueue)
+		Log.Infof("Queue enabled in %s", conf.Queue.Dir)
+	}
+
+	stopRateLimits := make(chan struct{})
+	if conf.RateLimits != nil && conf.RateLimits.Path != "" {
+		if err = conf.RateLimits.Load(); err != nil {
+			Log.Errorf("Error loading rate limits, starting without them: %s", err)
+		}
+		go runRateLimits(stopRateLimits)
+		Log.Infof("Rate limits saved in %s", conf.RateLimits.Path)
+	}
+
 	http.HandleFunc("/", handle)
 	srv := http.Server{Addr: ":" + port}
 
+	shutdown := make(chan struct{})
 	go func() {
+		defer close(shutdown)
+
 		quit := make(chan os.Signal, 1)
 		signal.Notify(quit, os.Interrupt)
 		<-quit // Block until quit signal is received
 
 		Log.Info("Shutting down")
+		close(stopQueue)
+		close(stopRateLimits)
 
 		if err := srv.Shutdown(context.Background()); err != nil {
 			Log.Criticalf("error while shutting down: %s", err)
 			os.Exit(1)
 		}
+		if conf.SMTPPool != nil {
+			conf.SMTPPool.Close()
+		}
+		if conf.RateLimits != nil {
+			saveRateLimits()
+		}
 	}()
 
 	Log.Infof("Listening to port %s", port)
@@ -60,26 +123,53 @@ func Run(configFile, port string) {
 		Log.Criticalf("Unexpected error which closed the server: %s", err)
 		os.Exit(1)
 	}
+	<-shutdown
 }
 
 // handle is the function executed for each HTTP request received by ptemplate-form-handler.
 //
 // It will:
 //
-// - Check if the HTTP method used is POST
+// - Check if the HTTP method used is POST, or serve a token if it's a GET request to the token endpoint.
+//
+// - Check if the Content-Type header is JSON, form-urlencoded or multipart.
 //
-// - Check if the Content-Type header is the MIME JSON.
+// - Check if the request body is valid and not too large.
 //
-// - Check if the request body is valid.
+// - Select the site the form belongs to.
 //
-// - Check if the email provided is valid.
+// - Check if the request falls into the traps of the site. If it does, it's a bot, so the form is dropped
+// but the request is answered as if it had succeeded.
 //
-// - Check if the request have passed the ReCaptcha verification.
+// - Check if the fields of the form are valid according to the schema of the site.
 //
-// - Send the message
+// - Check the per IP, per email and global rate limits of the site, answering with 429 Too Many Requests
+// if any of them is exceeded. The uses are only counted if all of them are allowed.
+//
+// - Check if the request have passed the captcha verification of the site.
+//
+// - Score how likely the form is spam, if the site has a spam filter, and reject it or tag it as spam
+// depending on its score. The rules that fired are logged in the debug log.
+//
+// - Send the message to all the senders of the site, failing if any required sender fails.
+// If the queue is enabled, the failed senders are retried later, and the message is accepted and queued
+// if a required sender fails, as long as it can be kept in the queue.
+//
+// - Send an acknowledgement to the submitter in the background, if the site has an autoreply,
+// the form was not tagged as spam and it was delivered instead of queued.
+//
+// Once the site is known, requests made by browsers are redirected to the success or error page of the site,
+// if it has them, unless they are rate limited. Otherwise, the response is a JSON api.Response.
 func handle(w http.ResponseWriter, r *http.Request) {
 	// Request ID for logging purposes
-	Log.Debug("Request received")
+	requestID := newRequestID()
+	w.Header().Set("X-Request-ID", requestID)
+	Log.Debugf("Request %s received", requestID)
+
+	if r.Method == http.MethodGet && (r.URL.Path == tokenPath || strings.HasSuffix(r.URL.Path, tokenPath) && strings.HasPrefix(r.URL.Path, sitesPath)) {
+		handleToken(w, r)
+		return
+	}
 
 	if method := r.Method; method != http.MethodPost {
 		Log.Errorf("Invalid method: %s", method)
@@ -87,48 +177,294 @@ func handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if contentType := r.Header.Get(pkg.MimeContentType); contentType != pkg.MimeJSON {
-		Log.Errorf("Invalid content type: %s", contentType)
-		statusWriter(w, http.StatusBadRequest, false, fmt.Sprintf("content-type %s not supported", contentType))
+	maxSize := conf.MaxRequestSize()
+	if r.ContentLength > maxSize {
+		Log.Errorf("Request too large: %d bytes", r.ContentLength)
+		statusWriter(w, http.StatusRequestEntityTooLarge, false, errRequestTooLarge.Error())
 		return
 	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
 
-	body, err := ioutil.ReadAll(r.Body)
+	sub, statusCode, err := parseRequest(r)
 	if err != nil {
-		Log.Errorf("Error while reading body: %s", err)
-		statusWriter(w, statusUnknownError, false, fmt.Sprintf("unknown error while reading request body: %s", err.Error()))
+		Log.Errorf("Invalid request: %s", err)
+		statusWriter(w, statusCode, false, err.Error())
 		return
 	}
 
-	var r2 api.Request
-	if err = json.Unmarshal(body, &r2); err != nil {
-		Log.Errorf("Malformed JSON: %s", err)
-		statusWriter(w, http.StatusBadRequest, false, "malformed JSON")
+	site := selectSite(r, sub.site)
+	if site == nil {
+		Log.Errorf("Unknown site (path: %s, host: %s, site: %s)", r.URL.Path, r.Host, sub.site)
+		statusWriter(w, http.StatusNotFound, false, errUnknownSite.Error())
 		return
 	}
+	Log.Debugf("Site selected: %s", site.ID)
+	captchaResponse := sub.captchaResponse(site.CaptchaField)
+	ip := clientIP(r)
 
-	if !sanitation.IsValidMail(r2.Mail) {
-		Log.Error("Invalid email")
-		statusWriter(w, http.StatusBadRequest, false, "invalid email")
+	// The token of the traps is released unless the form is accepted or rejected as spam,
+	// so forms that fail for other reasons can be submitted again
+	keepToken := false
+	if site.Traps != nil {
+		if err = site.Traps.Check(site.ID, sub.values, time.Now()); err != nil {
+			Log.Infof("Request %s dropped by the traps: %s", requestID, err)
+			respond(w, r, site, http.StatusOK, "")
+			return
+		}
+		defer func() {
+			if !keepToken {
+				site.Traps.Release(site.ID, sub.values)
+			}
+		}()
+	}
+
+	f, err := site.Schema.Parse(sub.values, sub.files)
+	if err != nil {
+		Log.Errorf("Invalid form: %s", err)
+		statusCode = http.StatusBadRequest
+		if errors.Is(err, form.ErrTooLarge) {
+			statusCode = http.StatusRequestEntityTooLarge
+		} else if errors.Is(err, form.ErrTypeNotAllowed) {
+			statusCode = http.StatusUnsupportedMediaType
+		}
+		respond(w, r, site, statusCode, err.Error())
 		return
 	}
+	f.Submitted = time.Now().UTC()
+	f.ClientIP = ip
+	f.RequestID = requestID
 
-	if err = recaptcha.CheckRecaptcha(s.RecaptchaSecret, r2.Recaptcha); err != nil {
-		Log.Errorf("Recaptcha verification failed: %s", err)
-		statusWriter(w, http.StatusBadRequest, false, "recaptcha verification failed")
+	if !allow(w, requestID, site, ip, f) {
 		return
 	}
 
-	if err = s.Send(sanitation.SanitizeName(r2.Name), r2.Mail, sanitation.SanitizeMsg(r2.Msg)); err != nil {
-		Log.Errorf("Sender failed: %s", err)
-		statusWriter(w, http.StatusServiceUnavailable, false, "error sending message")
+	if err = site.Captcha.Verify(captchaResponse, f.ClientIP); err != nil {
+		var verr *captcha.VerificationError
+		switch {
+		case !errors.As(err, &verr):
+			Log.Errorf("Error verifying captcha: %s", err)
+			respond(w, r, site, statusUnknownError, "captcha verification unavailable")
+		case verr.Misconfigured():
+			Log.Criticalf("Captcha of site %s misconfigured: %s", site.ID, err)
+			respond(w, r, site, http.StatusInternalServerError, "captcha verification unavailable")
+		default:
+			Log.Errorf("Captcha verification failed: %s (codes: %s)", err, strings.Join(verr.Codes, ", "))
+			respond(w, r, site, http.StatusBadRequest, "captcha verification failed")
+		}
 		return
 	}
 
-	statusWriter(w, http.StatusOK, true, "")
+	if site.Spam != nil {
+		res := site.Spam.Check(f)
+		Log.Debugf("Spam score of request %s: %.1f, %s", requestID, res.Score, res)
+		switch res.Action {
+		case spam.ActionReject:
+			Log.Infof("Request %s rejected as spam with score %.1f", requestID, res.Score)
+			keepToken = true
+			respond(w, r, site, http.StatusBadRequest, "message rejected as spam")
+			return
+		case spam.ActionTag:
+			Log.Infof("Request %s tagged as spam with score %.1f", requestID, res.Score)
+			f.Spam = true
+		}
+	}
+
+	if site.SpamDaemon != nil {
+		// The forms are accepted when the daemon is unavailable, so it doesn't prevent their delivery
+		if v, err := site.SpamDaemon.Check(f); err != nil {
+			Log.Errorf("Error checking request %s with the spam daemon: %s", requestID, err)
+		} else {
+			Log.Debugf("Spam daemon verdict of request %s: %s", requestID, v)
+			if v.Spam {
+				switch site.SpamDaemon.Action {
+				case spam.ActionReject:
+					Log.Infof("Request %s rejected as spam by the spam daemon", requestID)
+					keepToken = true
+					respond(w, r, site, http.StatusBadRequest, "message rejected as spam")
+					return
+				case spam.ActionQuarantine:
+					if err = site.SpamDaemon.Quarantine.Send(f); err != nil {
+						Log.Errorf("Error quarantining request %s: %s", requestID, err)
+						respond(w, r, site, http.StatusServiceUnavailable, "error sending message")
+						return
+					}
+					Log.Infof("Request %s quarantined as spam by the spam daemon", requestID)
+					keepToken = true
+					respond(w, r, site, http.StatusOK, "")
+					return
+				case spam.ActionTag:
+					Log.Infof("Request %s tagged as spam by the spam daemon", requestID)
+					f.Spam = true
+				}
+			}
+		}
+	}
+
+	queued, err := deliver(site.ID, site.Sender, f)
+	if err != nil {
+		respond(w, r, site, http.StatusServiceUnavailable, "error sending message")
+		return
+	}
+	keepToken = true
+	if queued {
+		respond(w, r, site, http.StatusAccepted, "")
+		Log.Debug("Queued")
+		return
+	}
+
+	if site.AutoReply != nil && !f.Spam {
+		go acknowledge(site, f)
+	}
+	respond(w, r, site, http.StatusOK, "")
 	Log.Debug("Success")
 }
 
+// handleToken serves a new token for the traps of the site selected by the GET request provided.
+// The site is selected like in handle, with the path /sites/<id>/token or by the Host header of the request.
+func handleToken(w http.ResponseWriter, r *http.Request) {
+	var site *config.Site
+	if strings.HasPrefix(r.URL.Path, sitesPath) {
+		site = conf.Site(strings.Trim(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, sitesPath), tokenPath), "/"))
+	} else {
+		site = selectSite(r, "")
+	}
+	if site == nil {
+		Log.Errorf("Unknown site for token (path: %s, host: %s)", r.URL.Path, r.Host)
+		statusWriter(w, http.StatusNotFound, false, errUnknownSite.Error())
+		return
+	}
+	if site.Traps == nil || site.Traps.TokenField == "" {
+		Log.Errorf("Token requested for site %s, which doesn't use them", site.ID)
+		statusWriter(w, http.StatusNotFound, false, errNoTokens.Error())
+		return
+	}
+
+	token, err := site.Traps.NewToken(site.ID, time.Now())
+	if err != nil {
+		Log.Errorf("Error issuing token for site %s: %s", site.ID, err)
+		statusWriter(w, http.StatusInternalServerError, false, "error issuing token")
+		return
+	}
+	data, _ := json.Marshal(api.Token{
+		Field: site.Traps.TokenField,
+		Token: token,
+	})
+	w.Header().Set(pkg.MimeContentType, pkg.MimeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := w.Write(data); err != nil {
+		Log.Errorf("error writing response: %s", err)
+	}
+	Log.Debugf("Token served for site %s", site.ID)
+}
+
+// acknowledge sends the acknowledgement of the form provided with the autoreply of the site provided.
+// Failures are only logged, since the form has already been accepted.
+func acknowledge(site *config.Site, f *form.Form) {
+	err := site.AutoReply.Send(f)
+	if errors.Is(err, sender.ErrRateLimited) {
+		Log.Infof("Acknowledgement of request %s not sent: %s", f.RequestID, err)
+		return
+	}
+	if err != nil {
+		Log.Errorf("Error sending acknowledgement of request %s: %s", f.RequestID, err)
+		return
+	}
+	Log.Debugf("Acknowledgement of request %s sent", f.RequestID)
+}
+
+// newRequestID returns a random ID that identifies a request.
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// clientIP returns the IP address of the client that made the request provided.
+//
+// If the request comes from a trusted proxy, the X-Forwarded-For header is read from right to left,
+// and the first address that doesn't belong to a trusted proxy is returned. Addresses added by
+// untrusted hops cannot be spoofed this way, since the header is only trusted up to them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !conf.TrustedProxy(ip) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		hopIP := net.ParseIP(hop)
+		if hopIP == nil {
+			// Malformed hops are not trusted, so the last known address is returned
+			break
+		}
+		host = hop
+		if !conf.TrustedProxy(hopIP) {
+			break
+		}
+	}
+	return host
+}
+
+// selectSite returns the site that a request is addressed to, or nil if it cannot be determined.
+// The site is looked up, in order, by the ID in the request path (/sites/<id>),
+// by the ID provided in the request body and by the Host header of the request.
+// If none of them are present and there is only one site configured, that site is returned.
+func selectSite(r *http.Request, id string) *config.Site {
+	if strings.HasPrefix(r.URL.Path, sitesPath) {
+		return conf.Site(strings.Trim(strings.TrimPrefix(r.URL.Path, sitesPath), "/"))
+	}
+
+	if id != "" {
+		return conf.Site(id)
+	}
+
+	if site := conf.SiteByHost(r.Host); site != nil {
+		return site
+	}
+
+	if len(conf.Sites) == 1 {
+		return conf.Sites[0]
+	}
+	return nil
+}
+
+// respond will write the response to a request for the site provided.
+// Status codes lower than 400 mean success, and higher ones mean failure with the error provided.
+//
+// If the request was made by a browser (its Accept header includes HTML) and the site has a success or error page,
+// it will redirect to that page. The error is passed to the error page in the "error" query parameter.
+// Otherwise, it will write a JSON api.Response with statusWriter.
+func respond(w http.ResponseWriter, r *http.Request, site *config.Site, statusCode int, msg string) {
+	success := statusCode < 400
+
+	page := site.SuccessURL
+	if !success {
+		page = site.ErrorURL
+	}
+	if page == nil || !strings.Contains(r.Header.Get("Accept"), pkg.MimeHTML) {
+		statusWriter(w, statusCode, success, msg)
+		return
+	}
+
+	u := *page
+	if !success {
+		q := u.Query()
+		q.Set("error", msg)
+		u.RawQuery = q.Encode()
+	}
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
 // statusWriter will write a response to the http.ResponseWriter provided.
 // That response will be sent with the status code provided,
 // and its body will consists in a JSON represented by api.Response with the success status and error provided.
@@ -0,0 +1,651 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/Miguel-Dorta/logolang"
+	"github.com/nethruster/ptemplate-form-handler/api"
+	"github.com/nethruster/ptemplate-form-handler/pkg"
+	"github.com/nethruster/ptemplate-form-handler/pkg/captcha"
+	"github.com/nethruster/ptemplate-form-handler/pkg/captcha/captchatest"
+	"github.com/nethruster/ptemplate-form-handler/pkg/config"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"github.com/nethruster/ptemplate-form-handler/pkg/queue"
+	"github.com/nethruster/ptemplate-form-handler/pkg/ratelimit"
+	"github.com/nethruster/ptemplate-form-handler/pkg/sender"
+	"github.com/nethruster/ptemplate-form-handler/pkg/spam"
+	"github.com/nethruster/ptemplate-form-handler/pkg/spam/spamtest"
+	"github.com/nethruster/ptemplate-form-handler/pkg/trap"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSender represents a sender.Sender that keeps the forms sent.
+type recordingSender struct {
+	mutex sync.Mutex
+	forms []*form.Form
+}
+
+func (s *recordingSender) Send(f *form.Form) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.forms = append(s.forms, f)
+	return nil
+}
+
+// blockingSender represents a sender.Sender that blocks the first form sent until release is closed,
+// closing started once it's blocked. It counts the forms sent.
+type blockingSender struct {
+	started chan struct{}
+	release chan struct{}
+	mutex   sync.Mutex
+	sent    int
+}
+
+func (s *blockingSender) Send(*form.Form) error {
+	s.mutex.Lock()
+	s.sent++
+	first := s.sent == 1
+	s.mutex.Unlock()
+
+	if first {
+		close(s.started)
+		<-s.release
+	}
+	return nil
+}
+
+// failingSender represents a sender.Sender that always fails.
+type failingSender struct{}
+
+func (failingSender) Send(*form.Form) error {
+	return errors.New("delivery failed")
+}
+
+func TestHandle_captcha(t *testing.T) {
+	fake := captchatest.NewServer()
+	defer fake.Close()
+	fake.Record()
+	rec := &recordingSender{}
+	Log = logolang.NewLogger()
+	Log.Level = logolang.LevelNoLog
+	_, proxy, _ := net.ParseCIDR("192.0.2.0/24")
+	conf = &config.Config{TrustedProxies: []*net.IPNet{proxy}, Sites: []*config.Site{{
+		ID: "shop",
+		Captcha: captcha.WithEndpoint(&captcha.RecaptchaV3{
+			Secret:    "secret",
+			MinScore:  0.5,
+			Actions:   []string{"contact"},
+			Hostnames: []string{captchatest.DefaultHostname},
+		}, captcha.Endpoint{URL: fake.URL}),
+		CaptchaField: captcha.DefaultField(captcha.ProviderRecaptchaV3),
+		Schema:       form.DefaultSchema,
+		Sender:       &sender.Multi{Targets: []sender.Target{{Name: "recording", Sender: rec, Required: true}}},
+	}}}
+	defer func() { conf = nil }()
+
+	tests := []struct {
+		response string
+		expected int
+	}{
+		{captchatest.ResponsePass + ":contact", http.StatusOK},
+		{captchatest.ResponsePass + ":login", http.StatusBadRequest},
+		{captchatest.ResponsePass, http.StatusBadRequest},
+		{captchatest.ResponseLowScore, http.StatusBadRequest},
+		{captchatest.ResponseFail, http.StatusBadRequest},
+		{captchatest.ResponseExpired, http.StatusBadRequest},
+		{"", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		body := url.Values{
+			"name":                 {"John Doe"},
+			"mail":                 {"john@example.com"},
+			"msg":                  {"Hello"},
+			"g-recaptcha-response": {test.response},
+		}.Encode()
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set(pkg.MimeContentType, pkg.MimeFormURLEncoded)
+		r.Header.Set("X-Forwarded-For", "192.0.2.1")
+		w := httptest.NewRecorder()
+
+		handle(w, r)
+		if w.Code != test.expected {
+			t.Errorf("%s: unexpected status code: expected %d - found %d (%s)", test.response, test.expected, w.Code, w.Body.String())
+		}
+	}
+
+	if len(rec.forms) != 1 {
+		t.Errorf("unexpected number of forms sent: %d", len(rec.forms))
+	}
+	requests := fake.Requests()
+	if len(requests) != len(tests)-1 {
+		t.Errorf("unexpected number of verification requests: %d", len(requests))
+	}
+	for _, req := range requests {
+		if ip := req.Get("remoteip"); ip != "192.0.2.1" {
+			t.Errorf("unexpected remoteip sent: %s", ip)
+		}
+	}
+
+	// Failures not caused by the client
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	site := conf.Sites[0]
+	for _, test := range []struct {
+		verifier captcha.Verifier
+		expected int
+	}{
+		{&captcha.Recaptcha{Endpoint: captcha.Endpoint{URL: fake.URL}}, http.StatusInternalServerError},
+		{&captcha.Recaptcha{Secret: "secret", Endpoint: captcha.Endpoint{URL: closed.URL}}, statusUnknownError},
+	} {
+		site.Captcha = test.verifier
+		body := url.Values{"mail": {"john@example.com"}, "g-recaptcha-response": {captchatest.ResponsePass}}.Encode()
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set(pkg.MimeContentType, pkg.MimeFormURLEncoded)
+		w := httptest.NewRecorder()
+
+		handle(w, r)
+		if w.Code != test.expected {
+			t.Errorf("%+v: unexpected status code: expected %d - found %d", test.verifier, test.expected, w.Code)
+		}
+	}
+	if len(rec.forms) != 1 {
+		t.Errorf("unexpected number of forms sent: %d", len(rec.forms))
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	conf = &config.Config{TrustedProxies: []*net.IPNet{loopback, private}}
+	defer func() { conf = nil }()
+
+	tests := []struct {
+		remoteAddr   string
+		forwardedFor []string
+		expected     string
+	}{
+		{"203.0.113.7:1234", nil, "203.0.113.7"},
+		{"203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"127.0.0.1:1234", nil, "127.0.0.1"},
+		{"127.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"127.0.0.1:1234", []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{"127.0.0.1:1234", []string{"198.51.100.1, 203.0.113.7, 10.1.2.3"}, "203.0.113.7"},
+		{"127.0.0.1:1234", []string{"198.51.100.1", "10.1.2.3"}, "198.51.100.1"},
+		{"127.0.0.1:1234", []string{"10.1.2.4, 10.1.2.3"}, "10.1.2.4"},
+		{"127.0.0.1:1234", []string{"198.51.100.1, garbage"}, "127.0.0.1"},
+		{"[::1]:1234", []string{"198.51.100.1"}, "::1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != nil {
+			r.Header["X-Forwarded-For"] = test.forwardedFor
+		}
+		if ip := clientIP(r); ip != test.expected {
+			t.Errorf("%s %v: unexpected client IP:\n-> Expected: %s\n-> Found: %s", test.remoteAddr, test.forwardedFor, test.expected, ip)
+		}
+	}
+}
+
+func TestRespond(t *testing.T) {
+	successURL, _ := url.Parse("https://example.com/thanks")
+	errorURL, _ := url.Parse("/error?lang=en")
+	site := &config.Site{ID: "blog", SuccessURL: successURL, ErrorURL: errorURL}
+
+	tests := []struct {
+		accept     string
+		statusCode int
+		msg        string
+		expected   int
+		location   string
+	}{
+		{"text/html,application/xhtml+xml", http.StatusOK, "", http.StatusSeeOther, "https://example.com/thanks"},
+		{"text/html,application/xhtml+xml", http.StatusBadRequest, "invalid email", http.StatusSeeOther, "/error?error=invalid+email&lang=en"},
+		{"*/*", http.StatusOK, "", http.StatusOK, ""},
+		{pkg.MimeJSON, http.StatusBadRequest, "invalid email", http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+
+		respond(w, r, site, test.statusCode, test.msg)
+		if w.Code != test.expected {
+			t.Errorf("%s %d: unexpected status code: expected %d - found %d", test.accept, test.statusCode, test.expected, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("%s %d: unexpected location: expected %s - found %s", test.accept, test.statusCode, test.location, location)
+		}
+		if test.location == "" && w.Header().Get(pkg.MimeContentType) != pkg.MimeJSON {
+			t.Errorf("%s %d: response is not JSON", test.accept, test.statusCode)
+		}
+	}
+}
+
+func TestHandle_traps(t *testing.T) {
+	rec := &recordingSender{}
+	Log = logolang.NewLogger()
+	Log.Level = logolang.LevelNoLog
+	traps := &trap.Traps{
+		HoneypotFields: []string{"website"},
+		TokenField:     "form_token",
+		Secret:         []byte("Nq4sV8kPz2xWc7Lm"),
+		MinTime:        3 * time.Second,
+		MaxAge:         time.Hour,
+	}
+	conf = &config.Config{Sites: []*config.Site{
+		{
+			ID:      "shop",
+			Hosts:   []string{"shop.example.com"},
+			Captcha: captcha.None{},
+			Traps:   traps,
+			Schema:  form.DefaultSchema,
+			Sender:  &sender.Multi{Targets: []sender.Target{{Name: "recording", Sender: rec, Required: true}}},
+		},
+		{ID: "blog", Hosts: []string{"blog.example.com"}, Captcha: captcha.None{}, Schema: form.DefaultSchema},
+	}}
+	defer func() { conf = nil }()
+
+	// Token endpoint
+	var token api.Token
+	for _, test := range []struct {
+		path     string
+		host     string
+		expected int
+	}{
+		{"/token", "shop.example.com", http.StatusOK},
+		{"/sites/shop/token", "", http.StatusOK},
+		{"/sites/blog/token", "", http.StatusNotFound},
+		{"/token", "blog.example.com", http.StatusNotFound},
+		{"/sites/wiki/token", "", http.StatusNotFound},
+		{"/token", "", http.StatusNotFound},
+	} {
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+
+		handle(w, r)
+		if w.Code != test.expected {
+			t.Errorf("%s %s: unexpected status code: expected %d - found %d", test.host, test.path, test.expected, w.Code)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil || token.Field != "form_token" || token.Token == "" {
+			t.Errorf("%s %s: unexpected token: %s", test.host, test.path, w.Body.String())
+		}
+		if cache := w.Header().Get("Cache-Control"); cache != "no-store" {
+			t.Errorf("%s %s: unexpected Cache-Control: %s", test.host, test.path, cache)
+		}
+	}
+
+	// Submissions
+	newToken := func(site string, issued time.Time) string {
+		token, err := traps.NewToken(site, issued)
+		if err != nil {
+			t.Fatalf("unexpected error issuing token: %s", err)
+		}
+		return token
+	}
+	used := newToken("shop", time.Now().Add(-time.Minute))
+	tests := []struct {
+		values url.Values
+		sent   bool
+	}{
+		{url.Values{"form_token": {used}}, true},
+		{url.Values{"form_token": {newToken("shop", time.Now().Add(-time.Minute))}, "website": {""}}, true},
+		{url.Values{"form_token": {used}}, false},
+		{url.Values{"form_token": {newToken("shop", time.Now().Add(-time.Minute))}, "website": {"http://spam.example.com"}}, false},
+		{url.Values{}, false},
+		{url.Values{"form_token": {token.Token}}, false},
+		{url.Values{"form_token": {newToken("shop", time.Now().Add(-2*time.Hour))}}, false},
+		{url.Values{"form_token": {newToken("blog", time.Now().Add(-time.Minute))}}, false},
+	}
+	for _, test := range tests {
+		test.values.Set("mail", "john@example.com")
+		r := httptest.NewRequest(http.MethodPost, "/sites/shop", strings.NewReader(test.values.Encode()))
+		r.Header.Set(pkg.MimeContentType, pkg.MimeFormURLEncoded)
+		w := httptest.NewRecorder()
+		sent := len(rec.forms)
+
+		handle(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%v: unexpected status code: expected %d - found %d", test.values, http.StatusOK, w.Code)
+		}
+		if (len(rec.forms) != sent) != test.sent {
+			t.Errorf("%v: unexpected delivery: expected %t", test.values, test.sent)
+		}
+	}
+
+	// The token of an invalid form can be used again once it's fixed
+	values := url.Values{"form_token": {newToken("shop", time.Now().Add(-time.Minute))}, "mail": {"john"}}
+	for _, expected := range []int{http.StatusBadRequest, http.StatusOK} {
+		r := httptest.NewRequest(http.MethodPost, "/sites/shop", strings.NewReader(values.Encode()))
+		r.Header.Set(pkg.MimeContentType, pkg.MimeFormURLEncoded)
+		w := httptest.NewRecorder()
+		sent := len(rec.forms)
+
+		handle(w, r)
+		if w.Code != expected || (expected == http.StatusOK) != (len(rec.forms) != sent) {
+			t.Errorf("%v: unexpected response: expected %d - found %d", values, expected, w.Code)
+		}
+		values.Set("mail", "john@example.com")
+	}
+}
+
+func TestHandle_spam(t *testing.T) {
+	rec := &recordingSender{}
+	var debug bytes.Buffer
+	Log = logolang.NewLoggerWriters(&debug, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	Log.Level = logolang.LevelDebug
+	conf = &config.Config{Sites: []*config.Site{{
+		ID:      "shop",
+		Captcha: captcha.None{},
+		Spam: &spam.Filter{
+			Rules: []spam.Rule{
+				&spam.Links{Max: 1, Score: 2},
+				&spam.Keywords{Words: []string{"casino"}, Score: 3},
+			},
+			TagScore:    3,
+			RejectScore: 6,
+		},
+		Schema: form.DefaultSchema,
+		Sender: &sender.Multi{Targets: []sender.Target{{Name: "recording", Sender: rec, Required: true}}},
+	}}}
+	defer func() { conf = nil }()
+
+	tests := []struct {
+		msg      string
+		expected int
+		spam     bool
+		log      string
+	}{
+		{"Hello", http.StatusOK, false, ": 0.0, no rule fired"},
+		{"Visit the casino", http.StatusOK, true, `: 3.0, keywords +3.0 (found "casino")`},
+		{"Casino: http://a.com http://b.com http://c.com", http.StatusBadRequest, false, ": 7.0, links +4.0 (3 links), keywords +3.0"},
+	}
+	for _, test := range tests {
+		debug.Reset()
+		body := url.Values{"mail": {"john@example.com"}, "msg": {test.msg}}.Encode()
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set(pkg.MimeContentType, pkg.MimeFormURLEncoded)
+		w := httptest.NewRecorder()
+		sent := len(rec.forms)
+
+		handle(w, r)
+		if w.Code != test.expected {
+			t.Errorf("%s: unexpected status code: expected %d - found %d", test.msg, test.expected, w.Code)
+		}
+		if !strings.Contains(debug.String(), test.log) {
+			t.Errorf("%s: rules not found in the debug log:\n-> Expected: %s\n-> Found: %s", test.msg, test.log, debug.String())
+		}
+		if test.expected != http.StatusOK {
+			if len(rec.forms) != sent {
+				t.Errorf("%s: rejected form sent", test.msg)
+			}
+			continue
+		}
+		if len(rec.forms) != sent+1 {
+			t.Errorf("%s: form not sent", test.msg)
+		} else if f := rec.forms[sent]; f.Spam != test.spam {
+			t.Errorf("%s: unexpected spam tag: %t", test.msg, f.Spam)
+		}
+	}
+}
+
+func TestHandle_spamDaemon(t *testing.T) {
+	daemon := spamtest.NewSpamd()
+	defer daemon.Close()
+	rec, quarantine := &recordingSender{}, &recordingSender{}
+	Log = logolang.NewLoggerWriters(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	stage := &spam.Stage{
+		Daemon: &spam.Spamd{Address: daemon.Addr},
+		Mail: &sender.Mail{
+			WebName:    "shop.example.com",
+			Recipients: sender.Recipients{To: []string{"sales@example.com"}},
+			Account:    sender.Account{Username: "no-reply@example.com"},
+		},
+		Quarantine: quarantine,
+	}
+	conf = &config.Config{Sites: []*config.Site{{
+		ID:         "shop",
+		Captcha:    captcha.None{},
+		SpamDaemon: stage,
+		Schema:     form.DefaultSchema,
+		Sender:     &sender.Multi{Targets: []sender.Target{{Name: "recording", Sender: rec, Required: true}}},
+	}}}
+	defer func() { conf = nil }()
+
+	tests := []struct {
+		action      string
+		msg         string
+		expected    int
+		sent        bool
+		spam        bool
+		quarantined bool
+	}{
+		{spam.ActionTag, "Hello", http.StatusOK, true, false, false},
+		{spam.ActionTag, spamtest.GTUBE, http.StatusOK, true, true, false},
+		{spam.ActionHeaders, spamtest.GTUBE, http.StatusOK, true, false, false},
+		{spam.ActionReject, "Hello", http.StatusOK, true, false, false},
+		{spam.ActionReject, spamtest.GTUBE, http.StatusBadRequest, false, false, false},
+		{spam.ActionQuarantine, spamtest.GTUBE, http.StatusOK, false, false, true},
+	}
+	for _, test := range tests {
+		stage.Action = test.action
+		body := url.Values{"mail": {"john@example.com"}, "msg": {test.msg}}.Encode()
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set(pkg.MimeContentType, pkg.MimeFormURLEncoded)
+		w := httptest.NewRecorder()
+		sent, quarantined := len(rec.forms), len(quarantine.forms)
+
+		handle(w, r)
+		if w.Code != test.expected {
+			t.Errorf("%s %s: unexpected status code: expected %d - found %d", test.action, test.msg, test.expected, w.Code)
+		}
+		if (len(quarantine.forms) != quarantined) != test.quarantined {
+			t.Errorf("%s %s: unexpected quarantine: %d forms", test.action, test.msg, len(quarantine.forms)-quarantined)
+		}
+		if (len(rec.forms) != sent) != test.sent {
+			t.Errorf("%s %s: unexpected delivery: %d forms", test.action, test.msg, len(rec.forms)-sent)
+			continue
+		}
+		if !test.sent {
+			continue
+		}
+		f := rec.forms[sent]
+		if f.Spam != test.spam {
+			t.Errorf("%s %s: unexpected spam tag: %t", test.action, test.msg, f.Spam)
+		}
+		flag := ""
+		if test.action == spam.ActionHeaders || test.action == spam.ActionTag {
+			flag = "NO"
+			if test.msg == spamtest.GTUBE {
+				flag = "YES"
+			}
+		}
+		if f.Headers["X-Spam-Flag"] != flag {
+			t.Errorf("%s %s: unexpected headers: %v", test.action, test.msg, f.Headers)
+		}
+	}
+	if n := len(daemon.Messages()); n != len(tests) {
+		t.Errorf("unexpected number of messages checked: expected %d - found %d", len(tests), n)
+	}
+
+	// Forms are delivered when the daemon is unavailable
+	daemon.Close()
+	stage.Action = spam.ActionReject
+	body := url.Values{"mail": {"john@example.com"}, "msg": {spamtest.GTUBE}}.Encode()
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	r.Header.Set(pkg.MimeContentType, pkg.MimeFormURLEncoded)
+	w := httptest.NewRecorder()
+	sent := len(rec.forms)
+	handle(w, r)
+	if w.Code != http.StatusOK || len(rec.forms) != sent+1 {
+		t.Errorf("form not delivered with the spam daemon unavailable: status %d", w.Code)
+	}
+}
+
+func TestHandle_rateLimit(t *testing.T) {
+	rec := &recordingSender{}
+	Log = logolang.NewLoggerWriters(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	conf = &config.Config{Sites: []*config.Site{{
+		ID:          "shop",
+		Captcha:     captcha.None{},
+		IPLimit:     &ratelimit.Bucket{Limit: 2, Period: time.Hour},
+		EmailLimit:  &ratelimit.Bucket{Limit: 1, Period: time.Hour},
+		GlobalLimit: &ratelimit.Bucket{Limit: 3, Period: time.Hour},
+		ErrorURL:    &url.URL{Scheme: "https", Host: "shop.example.com", Path: "/error"},
+		Schema:      form.DefaultSchema,
+		Sender:      &sender.Multi{Targets: []sender.Target{{Name: "recording", Sender: rec, Required: true}}},
+	}}}
+	defer func() { conf = nil }()
+
+	tests := []struct {
+		ip       string
+		mail     string
+		expected int
+	}{
+		{"192.0.2.1", "john@example.com", http.StatusOK},
+		{"192.0.2.1", "JOHN@example.com", http.StatusTooManyRequests},
+		// The use of the per IP limit of the previous request is not counted, since it was refused
+		{"192.0.2.1", "jane@example.com", http.StatusOK},
+		{"192.0.2.1", "jack@example.com", http.StatusTooManyRequests},
+		{"192.0.2.2", "jane@example.com", http.StatusTooManyRequests},
+		{"192.0.2.2", "jack@example.com", http.StatusOK},
+		{"192.0.2.3", "jill@example.com", http.StatusTooManyRequests},
+	}
+	for i, test := range tests {
+		body := url.Values{"mail": {test.mail}, "msg": {"Hello"}}.Encode()
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set(pkg.MimeContentType, pkg.MimeFormURLEncoded)
+		r.Header.Set("Accept", "text/html")
+		r.RemoteAddr = test.ip + ":1234"
+		w := httptest.NewRecorder()
+
+		handle(w, r)
+		if w.Code != test.expected {
+			t.Errorf("request #%d: unexpected status code: expected %d - found %d", i, test.expected, w.Code)
+		}
+		if test.expected != http.StatusTooManyRequests {
+			continue
+		}
+		if retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retryAfter < 1 || retryAfter > 3600 {
+			t.Errorf("request #%d: invalid Retry-After header: %s", i, w.Header().Get("Retry-After"))
+		}
+		var resp api.Response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Success || resp.Err != errTooManyRequests.Error() {
+			t.Errorf("request #%d: unexpected response: %s", i, w.Body)
+		}
+	}
+	if len(rec.forms) != 3 {
+		t.Errorf("unexpected number of forms sent: expected 3 - found %d", len(rec.forms))
+	}
+}
+
+func TestDeliver_queue(t *testing.T) {
+	Log = logolang.NewLogger()
+	Log.Level = logolang.LevelNoLog
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	conf = &config.Config{Queue: &queue.Queue{Dir: dir, MaxAttempts: 3, InitialBackoff: time.Minute, MaxBackoff: time.Hour}}
+	defer func() { conf = nil }()
+	if err = conf.Queue.Init(); err != nil {
+		t.Fatalf("error initializing queue: %s", err)
+	}
+
+	tests := []struct {
+		name        string
+		maxAttempts int
+		targets     []sender.Target
+		queued      bool
+		err         bool
+		pending     int
+	}{
+		{"delivered", 3, []sender.Target{{Name: "ok", Sender: &recordingSender{}, Required: true}}, false, false, 0},
+		{"best effort failed", 3, []sender.Target{
+			{Name: "ok", Sender: &recordingSender{}, Required: true},
+			{Name: "failing", Sender: failingSender{}},
+		}, false, false, 1},
+		{"required failed", 3, []sender.Target{
+			{Name: "ok", Sender: &recordingSender{}},
+			{Name: "failing", Sender: failingSender{}, Required: true},
+		}, true, false, 1},
+		{"required failed without attempts left", 1, []sender.Target{
+			{Name: "failing", Sender: failingSender{}, Required: true},
+		}, false, true, 0},
+	}
+	for _, test := range tests {
+		conf.Queue.MaxAttempts = test.maxAttempts
+		before, _ := conf.Queue.Pending()
+		queued, err := deliver("shop", &sender.Multi{Targets: test.targets}, &form.Form{})
+		if queued != test.queued || (err != nil) != test.err {
+			t.Errorf("%s: unexpected result:\n-> Expected: queued %t, error %t\n-> Found: queued %t, error %v",
+				test.name, test.queued, test.err, queued, err)
+		}
+		after, _ := conf.Queue.Pending()
+		if len(after)-len(before) != test.pending {
+			t.Errorf("%s: unexpected pending items:\n-> Expected: %d\n-> Found: %d", test.name, test.pending, len(after)-len(before))
+		}
+	}
+}
+
+func TestDeliver_queueInFlight(t *testing.T) {
+	Log = logolang.NewLogger()
+	Log.Level = logolang.LevelNoLog
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	q := &queue.Queue{Dir: dir, MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond, MaxBackoff: time.Hour}
+	if err = q.Init(); err != nil {
+		t.Fatalf("error initializing queue: %s", err)
+	}
+
+	slow := &blockingSender{started: make(chan struct{}), release: make(chan struct{})}
+	rec := &recordingSender{}
+	m := &sender.Multi{Targets: []sender.Target{
+		{Name: "slow", Sender: slow, Required: true},
+		{Name: "ok", Sender: rec, Required: true},
+	}}
+	conf = &config.Config{Queue: q, Sites: []*config.Site{{ID: "shop", Sender: m}}}
+	defer func() { conf = nil }()
+
+	// The first delivery outlasts the initial backoff, so the item is due while it's still being delivered
+	done := make(chan error)
+	go func() {
+		_, err := deliver("shop", m, &form.Form{})
+		done <- err
+	}()
+	<-slow.started
+	time.Sleep(5 * q.InitialBackoff)
+	retryQueue()
+	close(slow.release)
+	if err = <-done; err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	retryQueue()
+
+	if slow.sent != 1 || len(rec.forms) != 1 {
+		t.Errorf("unexpected deliveries:\n-> Expected: 1 and 1\n-> Found: %d and %d", slow.sent, len(rec.forms))
+	}
+	if pending, _ := q.Pending(); len(pending) != 0 {
+		t.Errorf("unexpected pending items: %v", pending)
+	}
+}
@@ -0,0 +1,304 @@
+package spam
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg/client"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"github.com/nethruster/ptemplate-form-handler/pkg/sender"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions taken with the forms whose messages are spam according to a spam daemon, besides ActionTag and ActionReject.
+const (
+	ActionHeaders    = "headers"
+	ActionQuarantine = "quarantine"
+)
+
+// Default settings of the spam daemons.
+const (
+	DefaultSpamdAddress  = "127.0.0.1:783"
+	DefaultRspamdURL     = "http://127.0.0.1:11333/checkv2"
+	DefaultDaemonTimeout = 10 * time.Second
+)
+
+// mimeMessage is the content type of the messages sent to rspamd.
+const mimeMessage = "message/rfc822"
+
+// Daemon represents a spam filtering daemon, like SpamAssassin or rspamd.
+type Daemon interface {
+	// Check returns the verdict of the daemon about the message provided, sent by the client with the IP address
+	// clientIP. clientIP is optional.
+	Check(msg []byte, clientIP string) (*Verdict, error)
+}
+
+// Verdict represents the verdict of a spam daemon about a message: whether it's spam, its score,
+// the score a message needs to be spam and the symbols (or tests) of the daemon that matched it.
+//
+// Suspicious messages are not spam, but the daemon asks to mark them, like rspamd does with
+// the actions "add header" and "rewrite subject". Only the header fields of the verdict are added to them.
+type Verdict struct {
+	Spam       bool
+	Suspicious bool
+	Score      float64
+	Threshold  float64
+	Symbols    []string
+}
+
+// Spamd represents a Daemon that checks the messages with SpamAssassin's spamd, using the SPAMC protocol.
+// Address is a TCP address, or the path of a Unix socket if it starts with "/" (DefaultSpamdAddress if empty).
+// User is the user whose preferences are used, if it's not empty.
+// The connection and the check must be done in Timeout (DefaultDaemonTimeout if zero).
+type Spamd struct {
+	Address string
+	User    string
+	Timeout time.Duration
+}
+
+// Rspamd represents a Daemon that checks the messages with the HTTP API of rspamd (DefaultRspamdURL if URL is empty),
+// authenticated with Password if it's not empty. The check must be done in Timeout (DefaultDaemonTimeout if zero).
+type Rspamd struct {
+	URL      string
+	Password string
+	Timeout  time.Duration
+}
+
+// Stage represents the check of the messages of the forms of a site with a spam daemon, before delivering them.
+//
+// The messages are built with Mail, as it would send them. If the Daemon says a message is spam, Action is taken
+// with its form: ActionHeaders only adds the verdict to the header of the messages, ActionTag tags it as spam,
+// ActionQuarantine delivers it to Quarantine instead of the senders of the site, and ActionReject rejects it.
+// The verdict is added to the header of every message with ActionHeaders and ActionTag, and to the header
+// of the suspicious messages with any action.
+type Stage struct {
+	Daemon     Daemon
+	Mail       *sender.Mail
+	Action     string
+	Quarantine sender.Sender
+}
+
+// rspamdResponse represents the body of the responses of the checkv2 endpoint of rspamd.
+type rspamdResponse struct {
+	IsSkipped     bool    `json:"is_skipped"`
+	Score         float64 `json:"score"`
+	RequiredScore float64 `json:"required_score"`
+	Action        string  `json:"action"`
+	Symbols       map[string]struct {
+		Score float64 `json:"score"`
+	} `json:"symbols"`
+}
+
+// Check returns the verdict of the daemon of the stage about the message of the form provided.
+// The verdict is also added to the extra header fields of the form, if the action of the stage
+// is ActionHeaders or ActionTag or the message is suspicious.
+func (st *Stage) Check(f *form.Form) (*Verdict, error) {
+	msg, err := st.Mail.Message(f)
+	if err != nil {
+		return nil, fmt.Errorf("error building message: %w", err)
+	}
+	v, err := st.Daemon.Check(msg, f.ClientIP)
+	if err != nil {
+		return nil, err
+	}
+
+	if st.Action != ActionHeaders && st.Action != ActionTag && !v.Suspicious {
+		return v, nil
+	}
+	if f.Headers == nil {
+		f.Headers = make(map[string]string)
+	}
+	for name, value := range v.Headers() {
+		f.Headers[name] = value
+	}
+	return v, nil
+}
+
+// Headers returns the header fields that describe the verdict, like the ones added by SpamAssassin:
+// X-Spam-Flag, X-Spam-Score and X-Spam-Status. Suspicious messages are flagged like spam.
+func (v *Verdict) Headers() map[string]string {
+	flag, status := "NO", "No"
+	if v.Spam || v.Suspicious {
+		flag, status = "YES", "Yes"
+	}
+	status += fmt.Sprintf(", score=%.1f required=%.1f", v.Score, v.Threshold)
+	if len(v.Symbols) != 0 {
+		status += " tests=" + strings.Join(v.Symbols, ",")
+	}
+	return map[string]string{
+		"X-Spam-Flag":   flag,
+		"X-Spam-Score":  fmt.Sprintf("%.1f", v.Score),
+		"X-Spam-Status": status,
+	}
+}
+
+// String returns a description of the verdict, like "spam, score 16.2/5.0, symbols: GTUBE".
+func (v *Verdict) String() string {
+	s := "not spam"
+	if v.Spam {
+		s = "spam"
+	} else if v.Suspicious {
+		s = "suspicious"
+	}
+	s += fmt.Sprintf(", score %.1f/%.1f", v.Score, v.Threshold)
+	if len(v.Symbols) != 0 {
+		s += ", symbols: " + strings.Join(v.Symbols, ", ")
+	}
+	return s
+}
+
+// Check returns the verdict of spamd about the message provided. The client IP address is not sent,
+// since the SPAMC protocol doesn't support it.
+func (s *Spamd) Check(msg []byte, _ string) (*Verdict, error) {
+	address, timeout := s.Address, s.Timeout
+	if address == "" {
+		address = DefaultSpamdAddress
+	}
+	if timeout == 0 {
+		timeout = DefaultDaemonTimeout
+	}
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to spamd: %w", err)
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("error connecting to spamd: %w", err)
+	}
+
+	// SYMBOLS is CHECK, also returning the names of the tests that matched
+	req := "SYMBOLS SPAMC/1.5\r\nContent-length: " + strconv.Itoa(len(msg)) + "\r\n"
+	if s.User != "" {
+		req += "User: " + s.User + "\r\n"
+	}
+	if _, err = io.WriteString(conn, req+"\r\n"); err == nil {
+		_, err = conn.Write(msg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error sending message to spamd: %w", err)
+	}
+
+	v, err := readSpamdResponse(bufio.NewReader(conn))
+	if err != nil {
+		return nil, fmt.Errorf("invalid spamd response: %w", err)
+	}
+	return v, nil
+}
+
+// readSpamdResponse returns the verdict in the response to a SYMBOLS request of the SPAMC protocol.
+func readSpamdResponse(r *bufio.Reader) (*Verdict, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	// SPAMD/1.1 0 EX_OK
+	status := strings.Fields(line)
+	if len(status) < 3 || !strings.HasPrefix(status[0], "SPAMD/") {
+		return nil, fmt.Errorf("invalid status line \"%s\"", strings.TrimSpace(line))
+	}
+	if status[1] != "0" {
+		return nil, fmt.Errorf("error %s %s", status[1], strings.Join(status[2:], " "))
+	}
+
+	var v *Verdict
+	for {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(line[:i], "Spam") {
+			continue
+		}
+
+		// Spam: True ; 15.0 / 5.0
+		value := strings.Fields(strings.NewReplacer(";", " ", "/", " ").Replace(line[i+1:]))
+		if len(value) != 3 {
+			return nil, fmt.Errorf("invalid Spam header \"%s\"", line)
+		}
+		v = &Verdict{Spam: strings.EqualFold(value[0], "True") || strings.EqualFold(value[0], "Yes")}
+		if v.Score, err = strconv.ParseFloat(value[1], 64); err == nil {
+			v.Threshold, err = strconv.ParseFloat(value[2], 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid Spam header \"%s\"", line)
+		}
+	}
+	if v == nil {
+		return nil, errors.New("missing Spam header")
+	}
+
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, symbol := range strings.Split(string(body), ",") {
+		if symbol = strings.TrimSpace(symbol); symbol != "" {
+			v.Symbols = append(v.Symbols, symbol)
+		}
+	}
+	return v, nil
+}
+
+// Check returns the verdict of rspamd about the message provided. Messages are spam if the action of rspamd
+// is "reject" or "soft reject", and suspicious if it's "add header" or "rewrite subject", unless rspamd skips them.
+func (rs *Rspamd) Check(msg []byte, clientIP string) (*Verdict, error) {
+	url, timeout := rs.URL, rs.Timeout
+	if url == "" {
+		url = DefaultRspamdURL
+	}
+	if timeout == 0 {
+		timeout = DefaultDaemonTimeout
+	}
+	headers := make(map[string]string)
+	if clientIP != "" {
+		headers["IP"] = clientIP
+	}
+	if rs.Password != "" {
+		headers["Password"] = rs.Password
+	}
+
+	data, err := client.PostWith(&http.Client{Timeout: timeout}, url, mimeMessage, headers, msg)
+	if err != nil {
+		return nil, fmt.Errorf("error doing request to rspamd: %w", err)
+	}
+	var resp rspamdResponse
+	if err = json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("error parsing rspamd response: %w", err)
+	}
+
+	v := &Verdict{
+		Score:     resp.Score,
+		Threshold: resp.RequiredScore,
+		Symbols:   make([]string, 0, len(resp.Symbols)),
+	}
+	if !resp.IsSkipped {
+		switch resp.Action {
+		case "reject", "soft reject":
+			v.Spam = true
+		case "add header", "rewrite subject":
+			v.Suspicious = true
+		}
+	}
+	for name := range resp.Symbols {
+		v.Symbols = append(v.Symbols, name)
+	}
+	sort.Strings(v.Symbols)
+	return v, nil
+}
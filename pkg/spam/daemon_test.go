@@ -0,0 +1,205 @@
+package spam
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg/sender"
+	"github.com/nethruster/ptemplate-form-handler/pkg/spam/spamtest"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSpamd_Check(t *testing.T) {
+	srv := spamtest.NewSpamd()
+	defer srv.Close()
+	d := &Spamd{Address: srv.Addr, User: "forms"}
+
+	tests := []struct {
+		msg      string
+		expected Verdict
+	}{
+		{"Subject: Hi\r\n\r\nHello", Verdict{Spam: false, Score: 0, Threshold: 5}},
+		{"Subject: Hi\r\n\r\n" + spamtest.GTUBE, Verdict{Spam: true, Score: 1000, Threshold: 5, Symbols: []string{"GTUBE"}}},
+	}
+	for _, test := range tests {
+		v, err := d.Check([]byte(test.msg), "192.0.2.1")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(*v, test.expected) {
+			t.Errorf("%q: unexpected verdict:\n-> Expected: %v\n-> Found: %v", test.msg, &test.expected, v)
+		}
+	}
+
+	if msgs := srv.Messages(); len(msgs) != 2 || string(msgs[1]) != tests[1].msg {
+		t.Errorf("unexpected messages received by spamd: %q", msgs)
+	}
+	if users := srv.Users(); len(users) != 2 || users[0] != "forms" {
+		t.Errorf("unexpected users received by spamd: %q", users)
+	}
+
+	// Unreachable daemon
+	srv.Close()
+	if _, err := d.Check([]byte("Subject: Hi\r\n\r\nHello"), ""); err == nil {
+		t.Error("expected error checking with a closed spamd")
+	}
+}
+
+func TestReadSpamdResponse(t *testing.T) {
+	tests := []struct {
+		response string
+		expected *Verdict
+	}{
+		{"SPAMD/1.1 0 EX_OK\r\nContent-length: 23\r\nSpam: True ; 15.2 / 5.0\r\n\r\nBAYES_99,URIBL_BLACK\r\n",
+			&Verdict{Spam: true, Score: 15.2, Threshold: 5, Symbols: []string{"BAYES_99", "URIBL_BLACK"}}},
+		{"SPAMD/1.1 0 EX_OK\r\nSpam: False ; -1.9 / 5.0\r\n\r\n", &Verdict{Spam: false, Score: -1.9, Threshold: 5}},
+		{"SPAMD/1.0 76 Bad header line: (EOF)\r\n", nil},
+		{"HTTP/1.1 200 OK\r\n\r\n", nil},
+		{"SPAMD/1.1 0 EX_OK\r\nContent-length: 0\r\n\r\n", nil},
+		{"SPAMD/1.1 0 EX_OK\r\nSpam: True ; lots / 5.0\r\n\r\n", nil},
+		{"SPAMD/1.1 0 EX_OK\r\nSpam: True", nil},
+	}
+	for _, test := range tests {
+		v, err := readSpamdResponse(bufio.NewReader(strings.NewReader(test.response)))
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%q: expected error, found verdict %v", test.response, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.response, err)
+		} else if !reflect.DeepEqual(v, test.expected) {
+			t.Errorf("%q: unexpected verdict:\n-> Expected: %v\n-> Found: %v", test.response, test.expected, v)
+		}
+	}
+}
+
+func TestRspamd_Check(t *testing.T) {
+	srv := spamtest.NewRspamd()
+	defer srv.Close()
+	srv.Password = "q1"
+	d := &Rspamd{URL: srv.URL, Password: "q1"}
+
+	v, err := d.Check([]byte("Subject: Hi\r\n\r\nHello"), "192.0.2.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := (Verdict{Threshold: 5, Symbols: []string{}}); !reflect.DeepEqual(*v, expected) {
+		t.Errorf("unexpected verdict of a clean message:\n-> Expected: %v\n-> Found: %v", &expected, v)
+	}
+	v, err = d.Check([]byte("Subject: Hi\r\n\r\n"+spamtest.GTUBE), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := (Verdict{Spam: true, Score: 1000, Threshold: 5, Symbols: []string{"GTUBE"}}); !reflect.DeepEqual(*v, expected) {
+		t.Errorf("unexpected verdict of GTUBE:\n-> Expected: %v\n-> Found: %v", &expected, v)
+	}
+	if ips := srv.IPs(); len(ips) != 2 || ips[0] != "192.0.2.1" || ips[1] != "" {
+		t.Errorf("unexpected IPs received by rspamd: %q", ips)
+	}
+
+	// Wrong password
+	d.Password = "wrong"
+	if _, err := d.Check([]byte("Subject: Hi\r\n\r\nHello"), ""); err == nil {
+		t.Error("expected error checking with a wrong password")
+	}
+}
+
+func TestRspamd_Check_actions(t *testing.T) {
+	tests := []struct {
+		action     string
+		skipped    bool
+		spam       bool
+		suspicious bool
+	}{
+		{"no action", false, false, false},
+		{"greylist", false, false, false},
+		{"add header", false, false, true},
+		{"rewrite subject", false, false, true},
+		{"soft reject", false, true, false},
+		{"reject", false, true, false},
+		{"reject", true, false, false},
+	}
+	for _, test := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"is_skipped": %t, "score": 7.5, "required_score": 15, "action": "%s"}`, test.skipped, test.action)
+		}))
+		v, err := (&Rspamd{URL: srv.URL}).Check([]byte("Subject: Hi\r\n\r\nHello"), "")
+		srv.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.action, err)
+		} else if v.Spam != test.spam || v.Suspicious != test.suspicious {
+			t.Errorf("%s (skipped: %t): unexpected verdict: %v", test.action, test.skipped, v)
+		}
+	}
+}
+
+func TestVerdict_Headers(t *testing.T) {
+	v := &Verdict{Spam: true, Score: 1000, Threshold: 5, Symbols: []string{"GTUBE", "BAYES_99"}}
+	expected := map[string]string{
+		"X-Spam-Flag":   "YES",
+		"X-Spam-Score":  "1000.0",
+		"X-Spam-Status": "Yes, score=1000.0 required=5.0 tests=GTUBE,BAYES_99",
+	}
+	if headers := v.Headers(); !reflect.DeepEqual(headers, expected) {
+		t.Errorf("unexpected headers:\n-> Expected: %v\n-> Found: %v", expected, headers)
+	}
+	if s := v.String(); s != "spam, score 1000.0/5.0, symbols: GTUBE, BAYES_99" {
+		t.Errorf("unexpected description: %s", s)
+	}
+	if s := (&Verdict{Score: 1.5, Threshold: 5}).String(); s != "not spam, score 1.5/5.0" {
+		t.Errorf("unexpected description: %s", s)
+	}
+
+	v = &Verdict{Suspicious: true, Score: 7.5, Threshold: 15}
+	if flag := v.Headers()["X-Spam-Flag"]; flag != "YES" {
+		t.Errorf("unexpected flag of a suspicious message: %s", flag)
+	}
+	if s := v.String(); s != "suspicious, score 7.5/15.0" {
+		t.Errorf("unexpected description: %s", s)
+	}
+}
+
+func TestStage_Check(t *testing.T) {
+	srv := spamtest.NewSpamd()
+	defer srv.Close()
+	st := &Stage{
+		Daemon: &Spamd{Address: srv.Addr},
+		Mail: &sender.Mail{
+			WebName:    "mywebsite.com",
+			Recipients: sender.Recipients{To: []string{"test@mywebsite.com"}},
+			Account:    sender.Account{Username: "no-reply@mywebsite.com"},
+		},
+		Action: ActionTag,
+	}
+
+	f := newForm("John", "john@example.com", spamtest.GTUBE)
+	v, err := st.Check(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !v.Spam || f.Headers["X-Spam-Flag"] != "YES" {
+		t.Errorf("unexpected verdict %v with headers %v", v, f.Headers)
+	}
+	msgs := srv.Messages()
+	if len(msgs) != 1 || !strings.Contains(string(msgs[0]), "To: test@mywebsite.com\r\n") {
+		t.Errorf("unexpected messages received by spamd: %q", msgs)
+	}
+
+	// The verdict is only added with the headers and tag actions
+	for _, action := range []string{ActionHeaders, ActionTag, ActionQuarantine, ActionReject} {
+		st.Action = action
+		f = newForm("John", "john@example.com", "Hello")
+		if _, err = st.Check(f); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		expected := action == ActionHeaders || action == ActionTag
+		if _, ok := f.Headers["X-Spam-Flag"]; ok != expected {
+			t.Errorf("%s: unexpected headers: %v", action, f.Headers)
+		}
+	}
+}
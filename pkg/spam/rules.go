@@ -0,0 +1,244 @@
+package spam
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"github.com/nethruster/ptemplate-form-handler/pkg/ratelimit"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// regexLink matches the start of the links written in a text.
+var regexLink = regexp.MustCompile(`(?i)\b(?:https?://|ftp://|www\.)`)
+
+// DefaultDisposableDomains are well-known domains of disposable email addresses.
+var DefaultDisposableDomains = []string{
+	"10minutemail.com",
+	"discard.email",
+	"dispostable.com",
+	"fakeinbox.com",
+	"getnada.com",
+	"guerrillamail.com",
+	"mailinator.com",
+	"maildrop.cc",
+	"mohmal.com",
+	"sharklasers.com",
+	"temp-mail.org",
+	"tempmail.com",
+	"throwawaymail.com",
+	"trashmail.com",
+	"yopmail.com",
+}
+
+// Links represents a Rule that fires when the form has more than Max links.
+// It scores Score for each link over Max.
+type Links struct {
+	Max   int
+	Score float64
+}
+
+// Keywords represents a Rule that fires when the form contains any of the Words (case-insensitive)
+// or matches any of the Patterns. It scores Score for each word or pattern found.
+type Keywords struct {
+	Words    []string
+	Patterns []*regexp.Regexp
+	Score    float64
+}
+
+// Scripts represents a Rule that fires when the form has letters of any of the Blocked scripts,
+// named like in unicode.Scripts (for example "Cyrillic" or "Han").
+type Scripts struct {
+	Blocked []string
+	Score   float64
+}
+
+// Caps represents a Rule that fires when more than MaxRatio of the letters of the form are uppercase.
+// Forms with less than MinLetters letters are ignored, since short texts like names are often uppercase.
+type Caps struct {
+	MaxRatio   float64
+	MinLetters int
+	Score      float64
+}
+
+// DisposableDomains represents a Rule that fires when an email of the form belongs to any of the Domains
+// or their subdomains. Domains must be lowercase.
+type DisposableDomains struct {
+	Domains []string
+	Score   float64
+}
+
+// Repeated represents a Rule that fires when the same message has already been received Max times
+// in the last Period. Messages are compared by the multiline fields of the form (or by its text fields
+// if it has none), ignoring case and whitespace, so the same message sent with different names is detected.
+type Repeated struct {
+	Max    int
+	Period time.Duration
+	Score  float64
+
+	once    sync.Once
+	limiter *ratelimit.Limiter
+}
+
+// Name returns "links".
+func (*Links) Name() string {
+	return "links"
+}
+
+// Check counts the links of the form provided.
+func (l *Links) Check(f *form.Form) (float64, string) {
+	var n int
+	for _, v := range text(f) {
+		n += len(regexLink.FindAllStringIndex(v, -1))
+	}
+	if n <= l.Max {
+		return 0, ""
+	}
+	return float64(n-l.Max) * l.Score, fmt.Sprintf("%d links", n)
+}
+
+// Name returns "keywords".
+func (*Keywords) Name() string {
+	return "keywords"
+}
+
+// Check looks for the keywords in the form provided.
+func (k *Keywords) Check(f *form.Form) (float64, string) {
+	values := text(f)
+	all := strings.ToLower(strings.Join(values, "\n"))
+
+	var found []string
+	for _, w := range k.Words {
+		if strings.Contains(all, strings.ToLower(w)) {
+			found = append(found, "\""+w+"\"")
+		}
+	}
+	for _, p := range k.Patterns {
+		for _, v := range values {
+			if p.MatchString(v) {
+				found = append(found, "/"+p.String()+"/")
+				break
+			}
+		}
+	}
+	if len(found) == 0 {
+		return 0, ""
+	}
+	return float64(len(found)) * k.Score, "found " + strings.Join(found, ", ")
+}
+
+// Name returns "scripts".
+func (*Scripts) Name() string {
+	return "scripts"
+}
+
+// Check looks for letters of the blocked scripts in the form provided.
+func (s *Scripts) Check(f *form.Form) (float64, string) {
+	var found []string
+	for _, name := range s.Blocked {
+		table := unicode.Scripts[name]
+		if table == nil {
+			continue
+		}
+		for _, v := range text(f) {
+			if strings.IndexFunc(v, func(r rune) bool { return unicode.Is(table, r) }) >= 0 {
+				found = append(found, name)
+				break
+			}
+		}
+	}
+	if len(found) == 0 {
+		return 0, ""
+	}
+	return s.Score, strings.Join(found, ", ") + " text"
+}
+
+// Name returns "caps".
+func (*Caps) Name() string {
+	return "caps"
+}
+
+// Check computes the ratio of uppercase letters of the form provided.
+func (c *Caps) Check(f *form.Form) (float64, string) {
+	var letters, upper int
+	for _, v := range text(f) {
+		for _, r := range v {
+			if !unicode.IsLetter(r) {
+				continue
+			}
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	if letters == 0 || letters < c.MinLetters {
+		return 0, ""
+	}
+	ratio := float64(upper) / float64(letters)
+	if ratio <= c.MaxRatio {
+		return 0, ""
+	}
+	return c.Score, fmt.Sprintf("%.0f%% uppercase", 100*ratio)
+}
+
+// Name returns "disposable_domains".
+func (*DisposableDomains) Name() string {
+	return "disposable_domains"
+}
+
+// Check looks for emails of disposable domains in the form provided.
+func (d *DisposableDomains) Check(f *form.Form) (float64, string) {
+	for _, v := range f.Values {
+		if v.Type != form.TypeEmail {
+			continue
+		}
+		i := strings.LastIndexByte(v.Value, '@')
+		if i < 0 {
+			continue
+		}
+		domain := strings.ToLower(v.Value[i+1:])
+		for _, disposable := range d.Domains {
+			if domain == disposable || strings.HasSuffix(domain, "."+disposable) {
+				return d.Score, domain
+			}
+		}
+	}
+	return 0, ""
+}
+
+// Name returns "repeated".
+func (*Repeated) Name() string {
+	return "repeated"
+}
+
+// Check records the message of the form provided, and checks if it was already received too many times.
+// Forms without text are ignored.
+func (r *Repeated) Check(f *form.Form) (float64, string) {
+	var values []string
+	for _, v := range f.Values {
+		if v.Type == form.TypeMultiline {
+			values = append(values, v.Value)
+		}
+	}
+	if len(values) == 0 {
+		values = text(f)
+	}
+	message := strings.ToLower(strings.Join(strings.Fields(strings.Join(values, " ")), " "))
+	if message == "" {
+		return 0, ""
+	}
+	r.once.Do(func() {
+		r.limiter = &ratelimit.Limiter{Limit: r.Max, Period: r.Period}
+	})
+
+	sum := sha256.Sum256([]byte(message))
+	if ok, _ := r.limiter.Allow(hex.EncodeToString(sum[:])); ok {
+		return 0, ""
+	}
+	return r.Score, fmt.Sprintf("received more than %d times in %s", r.Max, r.Period)
+}
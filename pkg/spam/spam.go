@@ -0,0 +1,94 @@
+package spam
+
+// Package spam scores how likely the forms are spam with configurable rules, and decides
+// whether they are accepted, tagged as spam or rejected. It also checks their messages with spam daemons,
+// like SpamAssassin's spamd or rspamd.
+
+import (
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"strings"
+)
+
+// Actions taken with the forms, depending on their score.
+const (
+	ActionAccept = "accept"
+	ActionTag    = "tag"
+	ActionReject = "reject"
+)
+
+// Rule represents a type that looks for a sign of spam in the forms.
+type Rule interface {
+	// Name returns the name of the rule, used in the logs.
+	Name() string
+	// Check returns the score of the form provided and why the rule fired, or 0 if it didn't fire.
+	Check(f *form.Form) (float64, string)
+}
+
+// Filter represents a set of rules whose scores are summed up to decide what to do with the forms.
+// Forms scoring at least TagScore are tagged as spam, and the ones scoring at least RejectScore are rejected.
+// A zero TagScore or RejectScore disables that action.
+type Filter struct {
+	Rules       []Rule
+	TagScore    float64
+	RejectScore float64
+}
+
+// Hit represents a rule that fired for a form.
+type Hit struct {
+	Rule   string
+	Score  float64
+	Reason string
+}
+
+// Result represents the outcome of checking a form with a Filter.
+type Result struct {
+	Score  float64
+	Hits   []Hit
+	Action string
+}
+
+// Check runs all the rules of the filter over the form provided, and returns its score and the action to take.
+func (fl *Filter) Check(f *form.Form) *Result {
+	r := &Result{Action: ActionAccept}
+	for _, rule := range fl.Rules {
+		score, reason := rule.Check(f)
+		if score == 0 {
+			continue
+		}
+		r.Score += score
+		r.Hits = append(r.Hits, Hit{Rule: rule.Name(), Score: score, Reason: reason})
+	}
+
+	switch {
+	case fl.RejectScore > 0 && r.Score >= fl.RejectScore:
+		r.Action = ActionReject
+	case fl.TagScore > 0 && r.Score >= fl.TagScore:
+		r.Action = ActionTag
+	}
+	return r
+}
+
+// String returns a description of the rules that fired, like "links +2.0 (3 links), caps +1.0 (80% uppercase)".
+func (r *Result) String() string {
+	if len(r.Hits) == 0 {
+		return "no rule fired"
+	}
+	hits := make([]string, len(r.Hits))
+	for i, h := range r.Hits {
+		hits[i] = fmt.Sprintf("%s +%.1f (%s)", h.Rule, h.Score, h.Reason)
+	}
+	return strings.Join(hits, ", ")
+}
+
+// text returns the values of the text and multiline fields of the form provided, which are the ones
+// written by the submitter.
+func text(f *form.Form) []string {
+	values := make([]string, 0, len(f.Values))
+	for _, v := range f.Values {
+		if v.Type == form.TypeText || v.Type == form.TypeMultiline {
+			values = append(values, v.Value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,105 @@
+package spam
+
+import (
+	"github.com/nethruster/ptemplate-form-handler/pkg/form"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// newForm returns a form with the default schema and the values provided.
+func newForm(name, mail, msg string) *form.Form {
+	return &form.Form{Values: []form.Value{
+		{Name: "name", Label: "Name", Type: form.TypeText, Value: name},
+		{Name: "mail", Label: "Email", Type: form.TypeEmail, Value: mail},
+		{Name: "msg", Label: "Message", Type: form.TypeMultiline, Value: msg},
+	}}
+}
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		rule     Rule
+		form     *form.Form
+		expected float64
+		reason   string
+	}{
+		{&Links{Max: 1, Score: 2}, newForm("John", "john@example.com", "See https://example.com"), 0, ""},
+		{&Links{Max: 1, Score: 2}, newForm("John", "john@example.com", "http://a.com www.b.com HTTPS://c.com"), 4, "3 links"},
+		{&Links{Max: 0, Score: 1}, newForm("www.spam.com", "john@example.com", "Hi"), 1, "1 links"},
+		{&Keywords{Words: []string{"Viagra", "casino"}, Score: 3}, newForm("John", "john@example.com", "Cheap VIAGRA at the Casino"), 6, `found "Viagra", "casino"`},
+		{&Keywords{Patterns: []*regexp.Regexp{regexp.MustCompile(`(?i)\bseo\b`)}, Score: 2}, newForm("John", "john@example.com", "Best SEO services"), 2, `found /(?i)\bseo\b/`},
+		{&Keywords{Words: []string{"seo"}, Score: 2}, newForm("John", "seo@example.com", "Hello"), 0, ""},
+		{&Scripts{Blocked: []string{"Cyrillic", "Han"}, Score: 5}, newForm("Иван", "ivan@example.com", "Hello"), 5, "Cyrillic text"},
+		{&Scripts{Blocked: []string{"Cyrillic"}, Score: 5}, newForm("José", "jose@example.com", "¿Qué tal?"), 0, ""},
+		{&Caps{MaxRatio: 0.7, MinLetters: 10, Score: 1}, newForm("John", "john@example.com", "BUY NOW, LIMITED OFFER"), 1, "86% uppercase"},
+		{&Caps{MaxRatio: 0.7, MinLetters: 10, Score: 1}, newForm("JOHN", "john@example.com", "OK"), 0, ""},
+		{&Caps{MaxRatio: 0.7, MinLetters: 10, Score: 1}, newForm("John", "john@example.com", "I need a quote for 3 units"), 0, ""},
+		{&DisposableDomains{Domains: DefaultDisposableDomains, Score: 4}, newForm("John", "john@Mailinator.com", "Hi"), 4, "mailinator.com"},
+		{&DisposableDomains{Domains: DefaultDisposableDomains, Score: 4}, newForm("John", "john@eu.yopmail.com", "Hi"), 4, "eu.yopmail.com"},
+		{&DisposableDomains{Domains: DefaultDisposableDomains, Score: 4}, newForm("John", "john@notyopmail.com", "Hi"), 0, ""},
+	}
+	for _, test := range tests {
+		score, reason := test.rule.Check(test.form)
+		if score != test.expected || reason != test.reason {
+			t.Errorf("%s %v: unexpected result:\n-> Expected: %.1f (%s)\n-> Found: %.1f (%s)",
+				test.rule.Name(), test.form.Values, test.expected, test.reason, score, reason)
+		}
+	}
+}
+
+func TestRepeated_Check(t *testing.T) {
+	r := &Repeated{Max: 2, Period: time.Hour, Score: 5}
+	tests := []struct {
+		form     *form.Form
+		expected float64
+	}{
+		{newForm("John", "john@example.com", "Great offer for you"), 0},
+		{newForm("Jane", "jane@example.com", "great  offer\nfor YOU"), 0},
+		{newForm("Jack", "jack@example.com", "Great offer for you"), 5},
+		{newForm("John", "john@example.com", "A different message"), 0},
+		{newForm("John", "john@example.com", ""), 0},
+		{newForm("John", "john@example.com", ""), 0},
+		{newForm("John", "john@example.com", ""), 0},
+	}
+	for i, test := range tests {
+		if score, _ := r.Check(test.form); score != test.expected {
+			t.Errorf("form #%d: unexpected score:\n-> Expected: %.1f\n-> Found: %.1f", i, test.expected, score)
+		}
+	}
+}
+
+func TestFilter_Check(t *testing.T) {
+	fl := &Filter{
+		Rules: []Rule{
+			&Links{Max: 1, Score: 2},
+			&Keywords{Words: []string{"casino"}, Score: 3},
+			&DisposableDomains{Domains: DefaultDisposableDomains, Score: 4},
+		},
+		TagScore:    3,
+		RejectScore: 6,
+	}
+	tests := []struct {
+		form   *form.Form
+		score  float64
+		action string
+		hits   string
+	}{
+		{newForm("John", "john@example.com", "Hello"), 0, ActionAccept, "no rule fired"},
+		{newForm("John", "john@example.com", "http://a.com http://b.com"), 2, ActionAccept, "links +2.0 (2 links)"},
+		{newForm("John", "john@example.com", "Casino"), 3, ActionTag, `keywords +3.0 (found "casino")`},
+		{newForm("John", "john@yopmail.com", "http://a.com http://b.com"), 6, ActionReject, "links +2.0 (2 links), disposable_domains +4.0 (yopmail.com)"},
+	}
+	for _, test := range tests {
+		r := fl.Check(test.form)
+		if r.Score != test.score || r.Action != test.action || r.String() != test.hits {
+			t.Errorf("%v: unexpected result:\n-> Expected: %.1f %s (%s)\n-> Found: %.1f %s (%s)",
+				test.form.Values, test.score, test.action, test.hits, r.Score, r.Action, r)
+		}
+	}
+
+	// Without thresholds, forms are always accepted
+	fl.TagScore, fl.RejectScore = 0, 0
+	if r := fl.Check(newForm("John", "john@yopmail.com", "Casino")); r.Action != ActionAccept || r.Score != 7 {
+		t.Errorf("unexpected result without thresholds: %.1f %s", r.Score, r.Action)
+	}
+}
@@ -0,0 +1,236 @@
+package spamtest
+
+// Package spamtest provides fake spamd and rspamd daemons, which check the messages like the real ones
+// would check GTUBE. They are used in tests, so the spam daemon stage can be run without the daemons.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/nethruster/ptemplate-form-handler/pkg"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GTUBE is the Generic Test for Unsolicited Bulk Email. Messages containing it are spam for the fake daemons.
+const GTUBE = "XJS*C4JDBQADN1.NSBN3*2IDNEN*GTUBE-STANDARD-ANTI-UBE-TEST-EMAIL*C.34X"
+
+// Scores given by the fake daemons.
+const (
+	Threshold  = 5.0
+	GTUBEScore = 1000.0
+)
+
+// GTUBESymbol is the symbol reported by the fake daemons for the messages containing GTUBE.
+const GTUBESymbol = "GTUBE"
+
+// Spamd represents a fake spamd listening on Addr, which understands the SYMBOLS command of the SPAMC protocol.
+type Spamd struct {
+	Addr string
+
+	listener net.Listener
+	wg       sync.WaitGroup
+	mutex    sync.Mutex
+	messages [][]byte
+	users    []string
+}
+
+// Rspamd represents a fake rspamd, whose checkv2 endpoint is URL. If Password is not empty,
+// requests must be authenticated with it.
+type Rspamd struct {
+	URL      string
+	Password string
+
+	srv      *httptest.Server
+	mutex    sync.Mutex
+	messages [][]byte
+	ips      []string
+}
+
+// NewSpamd starts a Spamd in a random port of the loopback interface. It must be closed after being used.
+func NewSpamd() *Spamd {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("spamtest: failed to listen on a port: %v", err))
+	}
+	s := &Spamd{Addr: l.Addr().String(), listener: l}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Messages returns the messages checked, in order.
+func (s *Spamd) Messages() [][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([][]byte{}, s.messages...)
+}
+
+// Users returns the users of the checks done, in order. They are empty if the request had no user.
+func (s *Spamd) Users() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.users...)
+}
+
+// Close shuts down the Spamd.
+func (s *Spamd) Close() {
+	_ = s.listener.Close()
+	s.wg.Wait()
+}
+
+// serve accepts connections until the Spamd is closed.
+func (s *Spamd) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.handle(conn)
+		}()
+	}
+}
+
+// handle answers the request read from the connection provided.
+func (s *Spamd) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	if command := strings.Fields(line); len(command) != 2 || command[0] != "SYMBOLS" {
+		_, _ = io.WriteString(conn, "SPAMD/1.5 76 Bad header line: "+strings.TrimSpace(line)+"\r\n")
+		return
+	}
+
+	length, user := -1, ""
+	for {
+		if line, err = r.ReadString('\n'); err != nil {
+			return
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			break
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		name, value := strings.ToLower(line[:i]), strings.TrimSpace(line[i+1:])
+		switch name {
+		case "content-length":
+			length, _ = strconv.Atoi(value)
+		case "user":
+			user = value
+		}
+	}
+	if length < 0 {
+		_, _ = io.WriteString(conn, "SPAMD/1.5 76 Bad header line: missing Content-length\r\n")
+		return
+	}
+	msg := make([]byte, length)
+	if _, err = io.ReadFull(r, msg); err != nil {
+		return
+	}
+
+	s.mutex.Lock()
+	s.messages = append(s.messages, msg)
+	s.users = append(s.users, user)
+	s.mutex.Unlock()
+
+	spam, score, symbols := check(msg)
+	flag := "False"
+	if spam {
+		flag = "True"
+	}
+	body := strings.Join(symbols, ",")
+	_, _ = fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nSpam: %s ; %.1f / %.1f\r\nContent-length: %d\r\n\r\n%s",
+		flag, score, Threshold, len(body), body)
+}
+
+// NewRspamd starts a Rspamd in a random port of the loopback interface. It must be closed after being used.
+func NewRspamd() *Rspamd {
+	s := &Rspamd{}
+	s.srv = httptest.NewServer(s)
+	s.URL = s.srv.URL + "/checkv2"
+	return s
+}
+
+// Messages returns the messages checked, in order.
+func (s *Rspamd) Messages() [][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([][]byte{}, s.messages...)
+}
+
+// IPs returns the IP addresses of the clients of the checks done, in order.
+// They are empty if the request had no IP header.
+func (s *Rspamd) IPs() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.ips...)
+}
+
+// Close shuts down the Rspamd.
+func (s *Rspamd) Close() {
+	s.srv.Close()
+}
+
+// ServeHTTP checks the message in the body of the POST request provided, like the checkv2 endpoint of rspamd does.
+func (s *Rspamd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path != "/checkv2":
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case r.Method != http.MethodPost:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	case s.Password != "" && r.Header.Get("Password") != s.Password:
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	msg, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	s.messages = append(s.messages, msg)
+	s.ips = append(s.ips, r.Header.Get("IP"))
+	s.mutex.Unlock()
+
+	spam, score, symbols := check(msg)
+	resp := map[string]interface{}{
+		"is_skipped":     false,
+		"score":          score,
+		"required_score": Threshold,
+		"action":         "no action",
+		"symbols":        map[string]interface{}{},
+	}
+	if spam {
+		resp["action"] = "reject"
+		resp["symbols"] = map[string]interface{}{symbols[0]: map[string]interface{}{"name": symbols[0], "score": score}}
+	}
+	data, _ := json.Marshal(resp)
+	w.Header().Set(pkg.MimeContentType, pkg.MimeJSON)
+	_, _ = w.Write(data)
+}
+
+// check returns whether the message provided is spam, its score and the symbols that matched it.
+func check(msg []byte) (bool, float64, []string) {
+	if strings.Contains(string(msg), GTUBE) {
+		return true, GTUBEScore, []string{GTUBESymbol}
+	}
+	return false, 0, nil
+}
@@ -0,0 +1,79 @@
+package spamtest
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSpamd(t *testing.T) {
+	srv := NewSpamd()
+	defer srv.Close()
+
+	tests := []struct {
+		request  string
+		expected string
+	}{
+		{"SYMBOLS SPAMC/1.5\r\nContent-length: 5\r\n\r\nHello",
+			"SPAMD/1.1 0 EX_OK\r\nSpam: False ; 0.0 / 5.0\r\nContent-length: 0\r\n\r\n"},
+		{"SYMBOLS SPAMC/1.5\r\nContent-length: 68\r\nUser: forms\r\n\r\n" + GTUBE,
+			"SPAMD/1.1 0 EX_OK\r\nSpam: True ; 1000.0 / 5.0\r\nContent-length: 5\r\n\r\nGTUBE"},
+		{"PROCESS SPAMC/1.5\r\nContent-length: 5\r\n\r\nHello", "SPAMD/1.5 76 Bad header line: PROCESS SPAMC/1.5\r\n"},
+		{"SYMBOLS SPAMC/1.5\r\n\r\nHello", "SPAMD/1.5 76 Bad header line: missing Content-length\r\n"},
+	}
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", srv.Addr)
+		if err != nil {
+			t.Fatalf("error connecting: %s", err)
+		}
+		_, err = conn.Write([]byte(test.request))
+		var resp []byte
+		if err == nil {
+			resp, err = ioutil.ReadAll(conn)
+		}
+		conn.Close()
+		if err != nil {
+			t.Fatalf("error doing request: %s", err)
+		}
+		if string(resp) != test.expected {
+			t.Errorf("%q: unexpected response:\n-> Expected: %q\n-> Found: %q", test.request, test.expected, resp)
+		}
+	}
+
+	if users := srv.Users(); len(users) != 2 || users[0] != "" || users[1] != "forms" {
+		t.Errorf("unexpected users: %q", users)
+	}
+}
+
+func TestRspamd(t *testing.T) {
+	srv := NewRspamd()
+	defer srv.Close()
+
+	tests := []struct {
+		url      string
+		msg      string
+		status   int
+		expected string
+	}{
+		{srv.URL, "Hello", http.StatusOK, `{"action":"no action","is_skipped":false,"required_score":5,"score":0,"symbols":{}}`},
+		{srv.URL, GTUBE, http.StatusOK, `{"action":"reject","is_skipped":false,"required_score":5,"score":1000,"symbols":{"GTUBE":{"name":"GTUBE","score":1000}}}`},
+		{strings.TrimSuffix(srv.URL, "checkv2") + "symbols", "Hello", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		resp, err := http.Post(test.url, "message/rfc822", strings.NewReader(test.msg))
+		if err != nil {
+			t.Fatalf("error doing request: %s", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status || string(body) != test.expected {
+			t.Errorf("%s %q: unexpected response:\n-> Expected: %d %s\n-> Found: %d %s",
+				test.url, test.msg, test.status, test.expected, resp.StatusCode, body)
+		}
+	}
+	if msgs := srv.Messages(); len(msgs) != 2 || string(msgs[1]) != GTUBE {
+		t.Errorf("unexpected messages: %q", msgs)
+	}
+}
@@ -0,0 +1,213 @@
+package trap
+
+// Package trap detects the forms submitted by bots without bothering the people who fill them,
+// with honeypot fields and signed timestamp tokens.
+//
+// Honeypot fields are hidden from people by the site, so they are only filled by bots. Tokens are issued
+// when the page with the form is loaded and sent with the form, so forms submitted too fast after loading
+// the page, or with stale or reused tokens, are detected too.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxNonceLength is the maximum length of the nonces of the tokens, so the used tokens kept are small.
+const maxNonceLength = 64
+
+// Reasons why a submission is caught by the traps.
+var (
+	ErrHoneypot     = errors.New("honeypot field filled")
+	ErrMissingToken = errors.New("missing token")
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTooFast      = errors.New("submitted too fast")
+	ErrStaleToken   = errors.New("stale token")
+	ErrReusedToken  = errors.New("reused token")
+)
+
+// Traps represents the traps of the forms of a site.
+//
+// HoneypotFields are the fields that must be empty. If TokenField is not empty, the forms must have
+// in that field a token issued by NewToken with Secret, at least MinTime and at most MaxAge (if it's not zero) ago.
+// Each token can only be used once: the tokens of the forms that are not caught are kept until they are stale,
+// or forever if MaxAge is zero, unless they are released.
+//
+// Tokens have the format "<timestamp>.<nonce>.<signature>", where timestamp is the Unix time the token was issued at,
+// nonce is a random string of up to 64 letters and digits, and signature is the hex-encoded HMAC-SHA256
+// of "<site>.<timestamp>.<nonce>" with Secret. That way, tokens can also be issued by the sites themselves,
+// and the tokens of a site are not valid in another one.
+type Traps struct {
+	HoneypotFields []string
+	TokenField     string
+	Secret         []byte
+	MinTime        time.Duration
+	MaxAge         time.Duration
+
+	mutex     sync.Mutex
+	used      map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewToken returns a token for the forms of the site provided, issued at the time provided.
+func (t *Traps) NewToken(site string, issued time.Time) (string, error) {
+	random := make([]byte, 12)
+	if _, err := rand.Read(random); err != nil {
+		return "", fmt.Errorf("error generating token nonce: %w", err)
+	}
+	return t.newToken(site, issued, hex.EncodeToString(random)), nil
+}
+
+// newToken returns the token for the forms of the site provided, issued at the time provided with the nonce provided.
+func (t *Traps) newToken(site string, issued time.Time, nonce string) string {
+	timestamp := strconv.FormatInt(issued.Unix(), 10)
+	return timestamp + "." + nonce + "." + t.sign(site, timestamp, nonce)
+}
+
+// Check returns the reason why the values of a form of the site provided, submitted at the time provided,
+// are caught by the traps, or nil if they are not. In that case, the token of the form is marked as used,
+// so other forms with it are caught, unless it's released with Release.
+func (t *Traps) Check(site string, values map[string][]string, submitted time.Time) error {
+	for _, field := range t.HoneypotFields {
+		for _, v := range values[field] {
+			if strings.TrimSpace(v) != "" {
+				return fmt.Errorf("%w: %s", ErrHoneypot, field)
+			}
+		}
+	}
+
+	if t.TokenField == "" {
+		return nil
+	}
+	token := t.token(values)
+	if token == "" {
+		return ErrMissingToken
+	}
+
+	issued, err := t.parseToken(site, token)
+	if err != nil {
+		return err
+	}
+	elapsed := submitted.Sub(issued)
+	if elapsed < t.MinTime {
+		return fmt.Errorf("%w: %s after issuing the token", ErrTooFast, elapsed.Round(time.Millisecond))
+	}
+	if t.MaxAge > 0 && elapsed > t.MaxAge {
+		return fmt.Errorf("%w: issued %s ago", ErrStaleToken, elapsed.Round(time.Second))
+	}
+	return t.use(site+"."+token, issued, submitted)
+}
+
+// Release forgets the use of the token of the values of a form of the site provided, so it can be used again.
+// It's used when a form that was not caught by the traps is not accepted after all, like when it's invalid,
+// so it can be fixed and submitted again.
+func (t *Traps) Release(site string, values map[string][]string) {
+	token := t.token(values)
+	if token == "" {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.used, site+"."+token)
+}
+
+// token returns the token of the values of a form, or an empty string if they have none.
+func (t *Traps) token(values map[string][]string) string {
+	if t.TokenField == "" {
+		return ""
+	}
+	if vs := values[t.TokenField]; len(vs) != 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// use marks the token provided, issued at the time provided, as used at the time provided.
+// It returns ErrReusedToken if it was already used.
+func (t *Traps) use(token string, issued, now time.Time) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.used == nil {
+		t.used = make(map[string]time.Time)
+	}
+	t.sweep(now)
+
+	if _, ok := t.used[token]; ok {
+		return ErrReusedToken
+	}
+	var stale time.Time
+	if t.MaxAge > 0 {
+		stale = issued.Add(t.MaxAge)
+	}
+	t.used[token] = stale
+	return nil
+}
+
+// sweep forgets the used tokens that are stale, at most once every MaxAge, so they don't pile up.
+// The mutex must be held.
+func (t *Traps) sweep(now time.Time) {
+	if t.MaxAge <= 0 || now.Sub(t.lastSweep) < t.MaxAge {
+		return
+	}
+	t.lastSweep = now
+
+	for token, stale := range t.used {
+		if stale.Before(now) {
+			delete(t.used, token)
+		}
+	}
+}
+
+// parseToken returns the time the token provided was issued at, after checking that it was issued
+// for the site provided.
+func (t *Traps) parseToken(site, token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || !validNonce(parts[1]) {
+		return time.Time{}, ErrInvalidToken
+	}
+	timestamp, nonce, signature := parts[0], parts[1], parts[2]
+
+	mac, err := hex.DecodeString(signature)
+	if err != nil {
+		return time.Time{}, ErrInvalidToken
+	}
+	expected, _ := hex.DecodeString(t.sign(site, timestamp, nonce))
+	if !hmac.Equal(mac, expected) {
+		return time.Time{}, ErrInvalidToken
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, ErrInvalidToken
+	}
+	return time.Unix(unix, 0), nil
+}
+
+// sign returns the hex-encoded signature of the timestamp and the nonce provided for the site provided.
+func (t *Traps) sign(site, timestamp, nonce string) string {
+	h := hmac.New(sha256.New, t.Secret)
+	h.Write([]byte(site + "." + timestamp + "." + nonce))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// validNonce checks if the nonce provided is not empty nor too long and only has ASCII letters and digits.
+func validNonce(nonce string) bool {
+	if nonce == "" || len(nonce) > maxNonceLength {
+		return false
+	}
+	for _, r := range nonce {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package trap
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraps_Check(t *testing.T) {
+	traps := &Traps{
+		HoneypotFields: []string{"website", "fax"},
+		TokenField:     "form_token",
+		Secret:         []byte("0123456789abcdef"),
+		MinTime:        3 * time.Second,
+		MaxAge:         time.Hour,
+	}
+	now := time.Unix(1600000000, 0)
+	nonces := 0
+	token := func(site string, issued time.Time) string {
+		nonces++
+		return traps.newToken(site, issued, "n"+strconv.Itoa(nonces))
+	}
+	valid := token("shop", now.Add(-time.Minute))
+	other := (&Traps{Secret: []byte("fedcba9876543210")}).newToken("shop", now.Add(-time.Minute), "n0")
+
+	tests := []struct {
+		values   map[string][]string
+		expected error
+	}{
+		{map[string][]string{"form_token": {valid}}, nil},
+		{map[string][]string{"form_token": {valid}}, ErrReusedToken},
+		{map[string][]string{"form_token": {token("shop", now.Add(-time.Minute))}, "website": {""}, "fax": {"  "}}, nil},
+		{map[string][]string{"form_token": {token("shop", now.Add(-time.Minute))}, "website": {"http://spam.example.com"}}, ErrHoneypot},
+		{map[string][]string{"form_token": {token("shop", now.Add(-time.Minute))}, "fax": {"", "555-1234"}}, ErrHoneypot},
+		{map[string][]string{}, ErrMissingToken},
+		{map[string][]string{"form_token": {""}}, ErrMissingToken},
+		{map[string][]string{"form_token": {"garbage"}}, ErrInvalidToken},
+		{map[string][]string{"form_token": {"1600000000.zz"}}, ErrInvalidToken},
+		{map[string][]string{"form_token": {"1600000000.n.zz"}}, ErrInvalidToken},
+		{map[string][]string{"form_token": {traps.newToken("shop", now.Add(-time.Minute), "n-1")}}, ErrInvalidToken},
+		{map[string][]string{"form_token": {traps.newToken("shop", now.Add(-time.Minute), strings.Repeat("n", 65))}}, ErrInvalidToken},
+		{map[string][]string{"form_token": {other}}, ErrInvalidToken},
+		{map[string][]string{"form_token": {token("blog", now.Add(-time.Minute))}}, ErrInvalidToken},
+		{map[string][]string{"form_token": {"1599999999" + valid[10:]}}, ErrInvalidToken},
+		{map[string][]string{"form_token": {token("shop", now.Add(-time.Second))}}, ErrTooFast},
+		{map[string][]string{"form_token": {token("shop", now.Add(time.Minute))}}, ErrTooFast},
+		{map[string][]string{"form_token": {token("shop", now.Add(-2*time.Hour))}}, ErrStaleToken},
+	}
+	for _, test := range tests {
+		err := traps.Check("shop", test.values, now)
+		if test.expected == nil && err != nil || test.expected != nil && !errors.Is(err, test.expected) {
+			t.Errorf("%v: unexpected result:\n-> Expected: %v\n-> Found: %v", test.values, test.expected, err)
+		}
+	}
+
+	// Without token
+	traps = &Traps{HoneypotFields: []string{"website"}}
+	if err := traps.Check("shop", map[string][]string{}, now); err != nil {
+		t.Errorf("unexpected error without token: %s", err)
+	}
+	if err := traps.Check("shop", map[string][]string{"website": {"x"}}, now); !errors.Is(err, ErrHoneypot) {
+		t.Errorf("unexpected error of a filled honeypot without token: %v", err)
+	}
+}
+
+func TestTraps_Release(t *testing.T) {
+	traps := &Traps{TokenField: "form_token", Secret: []byte("0123456789abcdef"), MaxAge: time.Hour}
+	now := time.Unix(1600000000, 0)
+	values := map[string][]string{"form_token": {traps.newToken("shop", now.Add(-time.Minute), "n1")}}
+
+	if err := traps.Check("shop", values, now); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	traps.Release("shop", values)
+	if err := traps.Check("shop", values, now); err != nil {
+		t.Errorf("unexpected error for a released token: %s", err)
+	}
+	if err := traps.Check("shop", values, now); !errors.Is(err, ErrReusedToken) {
+		t.Errorf("unexpected error for a reused token: %v", err)
+	}
+
+	// Stale used tokens are forgotten
+	later := now.Add(2 * time.Hour)
+	if err := traps.Check("shop", map[string][]string{"form_token": {traps.newToken("shop", later.Add(-time.Minute), "n2")}}, later); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(traps.used) != 1 {
+		t.Errorf("stale used tokens not forgotten: %v", traps.used)
+	}
+}
+
+func TestTraps_NewToken(t *testing.T) {
+	// The signature can be reproduced by the sites with HMAC-SHA256
+	traps := &Traps{Secret: []byte("secret")}
+	token := traps.newToken("shop", time.Unix(1600000000, 0), "a1b2c3")
+	expected := "1600000000.a1b2c3.2e2c284b81847edab4703a8e52b909e8dc6da03869c6b9a79163a8ead7490c78"
+	if token != expected {
+		t.Errorf("unexpected token:\n-> Expected: %s\n-> Found: %s", expected, token)
+	}
+
+	token, err := traps.NewToken("shop", time.Unix(1600000000, 0))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if other, _ := traps.NewToken("shop", time.Unix(1600000000, 0)); token == other {
+		t.Errorf("tokens issued at the same time are equal: %s", token)
+	}
+}